@@ -0,0 +1,87 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/audit"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (s *Server) auditEntry(r *http.Request, entry audit.Entry) audit.Entry {
+	entry.Time = time.Now()
+	entry.RequestID = middleware.GetReqID(r.Context())
+	entry.Actor = GetIdentity(r.Context()).Name
+	entry.RemoteAddr = r.RemoteAddr
+	return entry
+}
+
+func (s *Server) recordAudit(entry audit.Entry, err error) {
+	if s.Audit == nil {
+		return
+	}
+	entry.Success = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if auditErr := s.Audit.Record(entry); auditErr != nil {
+		log.Error().Err(auditErr).Str("Action", entry.Action).Msg("Unable to write audit entry")
+	}
+}
+
+func (s *Server) audit(r *http.Request, entry audit.Entry, err error) {
+	s.recordAudit(s.auditEntry(r, entry), err)
+}
+
+func (s *Server) getAudit(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "Audit log not enabled"})
+		return
+	}
+	filter := audit.Filter{
+		Actor:   r.URL.Query().Get("actor"),
+		Action:  r.URL.Query().Get("action"),
+		Include: GetIdentity(r.Context()).canAccessSite,
+	}
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "from must be an RFC3339 time"})
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "to must be an RFC3339 time"})
+			return
+		}
+	}
+	if value := r.URL.Query().Get("site"); value != "" {
+		if filter.SiteID, err = strconv.Atoi(value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "site must be numeric"})
+			return
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "limit must be numeric"})
+			return
+		}
+	}
+	entries, err := s.Audit.Query(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to query audit log")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, MessageResponse{Error: "Error querying audit log"})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, entries)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/audit"
+)
+
+func TestGetAudit(t *testing.T) {
+	server, handler := newTestServer(t, defaultBackend)
+	start := time.Now().Add(-time.Hour)
+	for index, siteID := range []int{1, 2, 1, 0, 2, 2} {
+		entry := audit.Entry{Time: start.Add(time.Duration(index) * time.Minute), Actor: "admin", Action: "door.open", SiteID: siteID}
+		if err := server.Audit.Record(entry); err != nil {
+			t.Fatalf("recording audit entry: %v", err)
+		}
+	}
+	tests := []struct {
+		name   string
+		query  string
+		key    string
+		status int
+		want   []int
+	}{
+		{name: "everything", key: "admin-key", status: http.StatusOK, want: []int{1, 2, 1, 0, 2, 2}},
+		{name: "limited", query: "?limit=2", key: "admin-key", status: http.StatusOK, want: []int{2, 2}},
+		{name: "site", query: "?site=1", key: "admin-key", status: http.StatusOK, want: []int{1, 1}},
+		{name: "scoped", key: "site-admin-key", status: http.StatusOK, want: []int{1, 1, 0}},
+		{name: "scoped before the limit", query: "?limit=2", key: "site-admin-key", status: http.StatusOK, want: []int{1, 0}},
+		{name: "scoped to another site", query: "?site=2", key: "site-admin-key", status: http.StatusOK, want: []int{}},
+		{name: "invalid from", query: "?from=yesterday", key: "admin-key", status: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=some", key: "admin-key", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, "/api/v1/audit"+test.query, test.key, "")
+			if status != test.status {
+				t.Fatalf("status = %d, want %d: %s", status, test.status, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			entries := make([]audit.Entry, 0)
+			if err := json.Unmarshal([]byte(body), &entries); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			got := make([]int, 0, len(entries))
+			for _, entry := range entries {
+				got = append(got, entry.SiteID)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("sites = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
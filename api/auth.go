@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/config"
+	"github.com/samber/lo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type contextKey int
+
+const identityKey contextKey = iota
+
+const (
+	groupSites        = "sites"
+	groupAccessLevels = "accesslevels"
+	groupDepartments  = "departments"
+	groupDoors        = "doors"
+	groupUsers        = "users"
+	groupUpdate       = "update"
+	groupAudit        = "audit"
+	groupStream       = "stream"
+	groupWebhooks     = "webhooks"
+	groupMetrics      = "metrics"
+)
+
+type action int
+
+const (
+	actionRead action = iota
+	actionDoorControl
+	actionUserMutation
+	actionAdmin
+)
+
+var rolePermissions = map[string][]action{
+	config.RoleReadOnly:  {actionRead},
+	config.RoleReception: {actionRead, actionDoorControl, actionUserMutation},
+	config.RoleAdmin:     {actionRead, actionDoorControl, actionUserMutation, actionAdmin},
+}
+
+type Identity struct {
+	Name   string
+	Role   string
+	Sites  []int
+	Groups []string
+}
+
+var anonymous = &Identity{Name: "anonymous", Role: config.RoleAdmin}
+
+func (i *Identity) canAccessSite(siteID int) bool {
+	return len(i.Sites) == 0 || lo.Contains(i.Sites, siteID)
+}
+
+func (i *Identity) canAccessAllSites() bool {
+	return len(i.Sites) == 0
+}
+
+func (i *Identity) canAccessGroup(group string) bool {
+	return len(i.Groups) == 0 || lo.Contains(i.Groups, group)
+}
+
+func (i *Identity) can(required action) bool {
+	return lo.Contains(rolePermissions[i.Role], required)
+}
+
+func GetIdentity(ctx context.Context) *Identity {
+	identity, ok := ctx.Value(identityKey).(*Identity)
+	if !ok {
+		return anonymous
+	}
+	return identity
+}
+
+func getRequestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func (s *Server) findAPIKey(key string) *config.APIKey {
+	if key == "" {
+		return nil
+	}
+	for index := range s.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(s.APIKeys[index].Key.Value()), []byte(key)) == 1 {
+			return &s.APIKeys[index]
+		}
+	}
+	return nil
+}
+
+// findClientCert matches the verified client certificate of a request, if there is one, against the configured
+// subjects.  Either the full distinguished name or the common name can match.
+func (s *Server) findClientCert(r *http.Request) *config.ClientCert {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	for index := range s.ClientCerts {
+		if s.ClientCerts[index].Subject == subject.String() || s.ClientCerts[index].Subject == subject.CommonName {
+			return &s.ClientCerts[index]
+		}
+	}
+	return nil
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.APIKeys) == 0 && len(s.ClientCerts) == 0 && s.AllowUnauthenticated {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var identity *Identity
+		if cert := s.findClientCert(r); cert != nil {
+			identity = &Identity{
+				Name:   cert.Name,
+				Role:   cert.Role,
+				Sites:  cert.Sites,
+				Groups: cert.Groups,
+			}
+		} else if key := s.findAPIKey(getRequestKey(r)); key != nil {
+			identity = &Identity{
+				Name:   key.Name,
+				Role:   key.Role,
+				Sites:  key.Sites,
+				Groups: key.Groups,
+			}
+		} else {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, MessageResponse{Error: "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+	})
+}
+
+func (s *Server) authorise(group string, read action, write action) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := GetIdentity(r.Context())
+			required := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				required = read
+			}
+			allowed := identity.can(required) && identity.canAccessGroup(group)
+			if siteParam := chi.URLParam(r, "siteID"); siteParam != "" {
+				siteID, _ := strconv.Atoi(siteParam)
+				allowed = allowed && identity.canAccessSite(siteID)
+			}
+			if !allowed {
+				render.Status(r, http.StatusForbidden)
+				render.JSON(w, r, MessageResponse{Error: "Forbidden"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAllSites only allows identities that aren't limited to some sites, for changes that reach beyond the sites
+// the identity has, like adding a site, changing which Net2 server a site connects to, or triggering updates.
+func (s *Server) requireAllSites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !GetIdentity(r.Context()).canAccessAllSites() {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, MessageResponse{Error: "Forbidden"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+type ReadinessResponse struct {
+	Ready    bool   `json:"ready"`
+	NotReady []int  `json:"notReady,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, MessageResponse{Message: "ok"})
+}
+
+// readyz fails until every site has fetched all of its resources successfully, so the proxy isn't sent traffic while
+// its caches are still empty.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	sites := s.Sites.GetSites()
+	if sites == nil {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, ReadinessResponse{Error: "Sites not started"})
+		return
+	}
+	response := ReadinessResponse{Ready: true}
+	for id, site := range sites {
+		if !site.Ready() {
+			response.Ready = false
+			response.NotReady = append(response.NotReady, id)
+		}
+	}
+	slices.Sort(response.NotReady)
+	if !response.Ready {
+		render.Status(r, http.StatusServiceUnavailable)
+	} else {
+		render.Status(r, http.StatusOK)
+	}
+	render.JSON(w, r, response)
+}
+
+func (s *Server) getSiteStatus(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Sites.GetSite(siteID).Health())
+}
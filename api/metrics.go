@@ -0,0 +1,112 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/metrics"
+	"github.com/greboid/net2/net2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	usersDesc = prometheus.NewDesc("net2_users", "Number of users in each category.",
+		[]string{"site", "category"}, nil)
+	activeUsersDesc = prometheus.NewDesc("net2_active_users", "Number of users in each category that haven't expired.",
+		[]string{"site", "category"}, nil)
+	doorStatusDesc = prometheus.NewDesc("net2_door_status_flag", "Raw status flag reported by Net2 for each door.",
+		[]string{"site", "door", "name"}, nil)
+	doorOpenDesc = prometheus.NewDesc("net2_door_open", "Whether each door is currently open.",
+		[]string{"site", "door", "name"}, nil)
+	doorAlarmDesc = prometheus.NewDesc("net2_door_alarm_status", "Alarm status of each monitored door.",
+		[]string{"site", "door", "name", "zone"}, nil)
+	siteLastPolledDesc = prometheus.NewDesc("net2_site_last_sync_timestamp_seconds", "Time of the last complete sync of each site.",
+		[]string{"site", "name"}, nil)
+)
+
+type siteCollector struct {
+	sites *net2.SiteManager
+}
+
+func (c *siteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+	ch <- activeUsersDesc
+	ch <- doorStatusDesc
+	ch <- doorOpenDesc
+	ch <- doorAlarmDesc
+	ch <- siteLastPolledDesc
+}
+
+func (c *siteCollector) Collect(ch chan<- prometheus.Metric) {
+	for id, site := range c.sites.GetSites() {
+		siteID := strconv.Itoa(id)
+		if lastPolled := site.LastPolled(); !lastPolled.IsZero() {
+			ch <- prometheus.MustNewConstMetric(siteLastPolledDesc, prometheus.GaugeValue, float64(lastPolled.Unix()), siteID, site.Name)
+		}
+		categories := map[string][2]map[int]*net2.User{
+			"all": {site.GetUsers(), site.GetActiveUsers()},
+		}
+		for _, category := range site.GetCategories() {
+			users, _ := site.GetCategoryUsers(category.Name, net2.ScopeAll)
+			active, _ := site.GetCategoryUsers(category.Name, net2.ScopeActive)
+			categories[category.Name] = [2]map[int]*net2.User{users, active}
+		}
+		for category, users := range categories {
+			ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(len(users[0])), siteID, category)
+			ch <- prometheus.MustNewConstMetric(activeUsersDesc, prometheus.GaugeValue, float64(len(users[1])), siteID, category)
+		}
+		for doorID, door := range site.GetDoors() {
+			ch <- prometheus.MustNewConstMetric(doorStatusDesc, prometheus.GaugeValue, float64(door.StatusFlag), siteID, strconv.FormatUint(doorID, 10), door.Name)
+			ch <- prometheus.MustNewConstMetric(doorOpenDesc, prometheus.GaugeValue, boolToFloat(door.IsOpen()), siteID, strconv.FormatUint(doorID, 10), door.Name)
+		}
+		for doorID, door := range site.GetMonitoredDoors() {
+			ch <- prometheus.MustNewConstMetric(doorAlarmDesc, prometheus.GaugeValue, float64(door.AlarmStatus), siteID, strconv.FormatUint(doorID, 10), door.Name, door.AlarmZone)
+		}
+	}
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// instrument records the latency of every request against the route pattern that handled it, so paths with IDs in
+// them don't each get their own series.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.ObserveHTTP(r.Method, route, status, start)
+	})
+}
+
+// metrics serves the process wide metrics along with this server's own site metrics.  The site collector gets a
+// registry of its own so each server reports the sites it was given, rather than the first one to register.
+func (s *Server) metrics() http.HandlerFunc {
+	sites := prometheus.NewRegistry()
+	sites.MustRegister(&siteCollector{sites: s.Sites})
+	handler := promhttp.HandlerFor(prometheus.Gatherers{metrics.Registry, sites}, promhttp.HandlerOpts{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(GetIdentity(r.Context()).Sites) > 0 {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, MessageResponse{Error: "Forbidden"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
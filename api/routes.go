@@ -1,14 +1,17 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/greboid/net2/audit"
 	"github.com/greboid/net2/net2"
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 	"io"
 	"net/http"
 	"net/url"
@@ -51,7 +54,10 @@ func (s *Server) GetRoutes() *chi.Mux {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(10 * time.Second))
+	r.Use(instrument)
+	r.With(s.authenticate, s.authorise(groupMetrics, actionRead, actionRead)).Get("/metrics", s.metrics())
+	r.Get("/healthz", s.healthz)
+	r.Get("/readyz", s.readyz)
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		render.Status(r, http.StatusNotFound)
 		render.JSON(w, r, MessageResponse{Error: "Resource not found"})
@@ -61,72 +67,104 @@ func (s *Server) GetRoutes() *chi.Mux {
 		render.JSON(w, r, MessageResponse{Error: "Method not allowed"})
 	})
 	r.Route("/api/v1", func(r chi.Router) {
-		r.Get("/", s.Index)
-		r.Route("/update", func(r chi.Router) {
-			r.Get("/now", s.updateNow)
-			r.Get("/trigger", s.update)
+		r.Use(s.authenticate)
+		r.Route("/stream", func(r chi.Router) {
+			r.With(s.authorise(groupStream, actionRead, actionRead)).Get("/", s.stream)
+			r.With(s.authorise(groupStream, actionRead, actionRead), s.validateSiteID).Get("/{siteID:[0-9]+}", s.stream)
 		})
-		r.Route("/sites", func(r chi.Router) {
-			r.Get("/", s.getSites)
-			r.With(s.validateSiteID).Route("/{siteID:[0-9]+}", func(r chi.Router) {
-				r.Get("/", s.getSite)
-				r.Get("/uptodate", s.getUpToDate)
-				r.Get("/unknownTokens", s.getUnknownTokens)
-				r.Route("/accesslevels", func(r chi.Router) {
-					r.Get("/", s.getAccessLevels)
-				})
-				r.Route("/departments", func(r chi.Router) {
-					r.Get("/", s.getDepartments)
-					r.With(s.validateDepartmentName).Route("/{departmentName}", func(r chi.Router) {
-						r.Post("/activate", s.activateDepartmentUsers)
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(10 * time.Second))
+			r.Get("/", s.Index)
+			r.With(s.authorise(groupAudit, actionAdmin, actionAdmin)).Get("/audit", s.getAudit)
+			r.Route("/webhooks", func(r chi.Router) {
+				r.Use(s.authorise(groupWebhooks, actionAdmin, actionAdmin))
+				r.Get("/deliveries", s.getWebhookDeliveries)
+				r.Get("/deadletters", s.getWebhookDeadLetters)
+			})
+			r.Route("/users/search", func(r chi.Router) {
+				r.Use(s.authorise(groupUsers, actionRead, actionRead))
+				r.Get("/", s.searchUsers)
+				r.Post("/", s.searchUsersBody)
+			})
+			r.Route("/people/{localID}", func(r chi.Router) {
+				r.Use(s.authorise(groupUsers, actionRead, actionUserMutation))
+				r.Get("/", s.getPerson)
+				r.Post("/activate", s.activatePerson)
+				r.Post("/deactivate", s.deactivatePerson)
+				r.Post("/extend", s.extendPerson)
+			})
+			r.Route("/update", func(r chi.Router) {
+				r.Use(s.authorise(groupUpdate, actionAdmin, actionAdmin), s.requireAllSites)
+				r.Get("/now", s.updateNow)
+				r.Get("/trigger", s.update)
+			})
+			r.Route("/sites", func(r chi.Router) {
+				r.With(s.authorise(groupSites, actionRead, actionAdmin)).Get("/", s.getSites)
+				r.With(s.authorise(groupSites, actionRead, actionAdmin), s.requireAllSites).Post("/", s.addSite)
+				r.Route("/{siteID:[0-9]+}", func(r chi.Router) {
+					r.Group(func(r chi.Router) {
+						r.Use(s.authorise(groupSites, actionRead, actionAdmin), s.validateSiteID)
+						r.Get("/", s.getSite)
+						r.With(s.requireAllSites).Put("/", s.updateSite)
+						r.With(s.requireAllSites).Delete("/", s.removeSite)
+						r.Get("/uptodate", s.getUpToDate)
+						r.Get("/status", s.getSiteStatus)
+						r.Get("/unknownTokens", s.getUnknownTokens)
+						r.Get("/events", s.getEvents)
 					})
-				})
-				r.Route("/doors", func(r chi.Router) {
-					r.Get("/", s.getDoors)
-					r.Get("/monitored", s.getMonitoredDoors)
-					r.Get("/openable", s.getOpenableDoors)
-					r.With(s.validateOpenableDoor).Route("/openable/{doorName}", func(r chi.Router) {
-						r.Post("/open", s.openOpenableDoor)
+					r.Route("/accesslevels", func(r chi.Router) {
+						r.Use(s.authorise(groupAccessLevels, actionRead, actionAdmin), s.validateSiteID)
+						r.Get("/", s.getAccessLevels)
 					})
-					r.Post("/sequence", s.sequenceDoors)
-					r.With(s.validateDoorID).Route("/{doorID:[0-9]+}", func(r chi.Router) {
-						r.Get("/", s.getDoor)
-						r.Post("/open", s.openDoor)
-						r.Post("/relay1", s.relay1)
-						r.Post("/relay2", s.relay2)
-						r.Post("/close", s.closeDoor)
+					r.Route("/departments", func(r chi.Router) {
+						r.Use(s.authorise(groupDepartments, actionRead, actionUserMutation), s.validateSiteID)
+						r.Get("/", s.getDepartments)
+						r.With(s.validateDepartmentName).Route("/{departmentName}", func(r chi.Router) {
+							r.Post("/activate", s.activateDepartmentUsers)
+						})
 					})
-				})
-				r.Route("/users", func(r chi.Router) {
-					r.Get("/", s.getUsers)
-					r.Get("/active", s.getActiveUsers)
-					r.Get("/activetoday", s.getActiveUsersToday)
-					r.Get("/activestaff", s.getActiveStaff)
-					r.Get("/activestafftoday", s.getActiveStaffToday)
-					r.Get("/activevisitors", s.getActiveVisitors)
-					r.Get("/activevisitorstoday", s.getActiveVisitorsToday)
-					r.Get("/activenonstaff", s.getActiveNonStaff)
-					r.Get("/cancelled", s.getCancelledUsers)
-					r.Get("/visitors", s.getVisitors)
-					r.Get("/contractors", s.getContractors)
-					r.Get("/cleaners", s.getCleaners)
-					r.Get("/customers", s.getCustomers)
-					r.Get("/staff", s.getStaff)
-					r.Get("/blankpicture", s.getBlankPicture)
-					r.Get("/userpicturebylocalid/{localID:[0-9]+}", s.getUserPictureByLocalID)
-					r.With(s.validateUserID).Route("/{userID:[0-9]+}", func(r chi.Router) {
-						r.Get("/", s.getUser)
-						r.Get("/picture", s.getUserPicture)
-						r.Post("/resetantipassback", s.resetAntiPassback)
-						r.Post("/activate", s.activateUser)
-						r.Post("/deactivate", s.deactivateUser)
-						r.Post("/activateAndUpdate", s.activateAndUpdate)
-						r.Post("/deactivateAndUpdate", s.deactivateAndUpdate)
-						r.Post("/extendexpiry", s.extendExpiry)
-						r.Post("/setaccesslevel", s.setAccessLevel)
-						r.Post("/addaccesslevel", s.addAccessLevel)
-						r.Post("/removeaccesslevel", s.removeAccessLevel)
-						r.Post("/changedepartment", s.changeDepartment)
+					r.Route("/doors", func(r chi.Router) {
+						r.Use(s.authorise(groupDoors, actionRead, actionDoorControl), s.validateSiteID)
+						r.Get("/", s.getDoors)
+						r.Get("/monitored", s.getMonitoredDoors)
+						r.Get("/openable", s.getOpenableDoors)
+						r.With(s.validateOpenableDoor).Route("/openable/{doorName}", func(r chi.Router) {
+							r.Post("/open", s.openOpenableDoor)
+						})
+						r.Post("/sequence", s.sequenceDoors)
+						r.With(s.validateDoorID).Route("/{doorID:[0-9]+}", func(r chi.Router) {
+							r.Get("/", s.getDoor)
+							r.Post("/open", s.openDoor)
+							r.Post("/relay1", s.relay1)
+							r.Post("/relay2", s.relay2)
+							r.Post("/close", s.closeDoor)
+						})
+					})
+					r.Route("/users", func(r chi.Router) {
+						r.Use(s.authorise(groupUsers, actionRead, actionUserMutation), s.validateSiteID)
+						r.Get("/", s.getUsers)
+						r.Post("/", s.createUser)
+						r.Get("/active", s.getActiveUsers)
+						r.Get("/activetoday", s.getActiveUsersToday)
+						r.Get("/categories", s.getCategories)
+						r.Get("/category/{category}", s.getCategoryUsers)
+						r.Get("/blankpicture", s.getBlankPicture)
+						r.Get("/userpicturebylocalid/{localID:[0-9]+}", s.getUserPictureByLocalID)
+						r.With(s.validateUserID).Route("/{userID:[0-9]+}", func(r chi.Router) {
+							r.Get("/", s.getUser)
+							r.Delete("/", s.deleteUser)
+							r.Get("/picture", s.getUserPicture)
+							r.Post("/resetantipassback", s.resetAntiPassback)
+							r.Post("/activate", s.activateUser)
+							r.Post("/deactivate", s.deactivateUser)
+							r.Post("/activateAndUpdate", s.activateAndUpdate)
+							r.Post("/deactivateAndUpdate", s.deactivateAndUpdate)
+							r.Post("/extendexpiry", s.extendExpiry)
+							r.Post("/setaccesslevel", s.setAccessLevel)
+							r.Post("/addaccesslevel", s.addAccessLevel)
+							r.Post("/removeaccesslevel", s.removeAccessLevel)
+							r.Post("/changedepartment", s.changeDepartment)
+						})
 					})
 				})
 			})
@@ -161,7 +199,13 @@ func (s *Server) validateDoorID(next http.Handler) http.Handler {
 			render.JSON(w, r, MessageResponse{Error: "doorID must be numeric"})
 			return
 		}
-		if s.Sites.GetSite(siteID).GetDoor(doorID) == nil {
+		site := s.Sites.GetSite(siteID)
+		if site == nil {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+			return
+		}
+		if site.GetDoor(doorID) == nil {
 			render.Status(r, http.StatusNotFound)
 			render.JSON(w, r, MessageResponse{Error: "doorID not found"})
 			return
@@ -179,7 +223,13 @@ func (s *Server) validateUserID(next http.Handler) http.Handler {
 			render.JSON(w, r, MessageResponse{Error: "userID must be numeric"})
 			return
 		}
-		if s.Sites.GetSite(siteID).GetUser(userID) == nil {
+		site := s.Sites.GetSite(siteID)
+		if site == nil {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+			return
+		}
+		if site.GetUser(userID) == nil {
 			render.Status(r, http.StatusNotFound)
 			render.JSON(w, r, MessageResponse{Error: "userID not found"})
 			return
@@ -202,8 +252,13 @@ func (s *Server) validateOpenableDoor(next http.Handler) http.Handler {
 			render.JSON(w, r, MessageResponse{Error: "doorName is required"})
 			return
 		}
-		openableDoors := s.Sites.GetSite(siteID).GetOpenableDoors()
-		if _, exists := openableDoors[doorName]; !exists {
+		site := s.Sites.GetSite(siteID)
+		if site == nil {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+			return
+		}
+		if _, exists := site.GetOpenableDoors()[doorName]; !exists {
 			render.Status(r, http.StatusNotFound)
 			render.JSON(w, r, MessageResponse{Error: "openable door not found"})
 			return
@@ -219,8 +274,7 @@ func (s *Server) Index(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetUsers())
+	renderUsers(w, r, s.Sites.GetSite(siteID).GetUsers())
 }
 
 func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
@@ -233,7 +287,7 @@ func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
 func (s *Server) getUserPicture(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
-	picture, err := s.Sites.GetSite(siteID).GetUserPicture(userID)
+	picture, err := s.Sites.GetSite(siteID).GetUserPicture(r.Context(), userID)
 	if err != nil {
 		render.Status(r, http.StatusNotFound)
 		render.JSON(w, r, MessageResponse{Error: "Error getting picture"})
@@ -248,7 +302,7 @@ func (s *Server) getUserPicture(w http.ResponseWriter, r *http.Request) {
 func (s *Server) getUserPictureByLocalID(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	localID, _ := strconv.Atoi(chi.URLParam(r, "localID"))
-	picture, err := s.Sites.GetSite(siteID).GetUserPictureByLocalID(localID)
+	picture, err := s.Sites.GetSite(siteID).GetUserPictureByLocalID(r.Context(), localID)
 	if err != nil {
 		render.Status(r, http.StatusNotFound)
 		render.JSON(w, r, MessageResponse{Error: "Error getting picture"})
@@ -275,8 +329,11 @@ func (s *Server) getBlankPicture(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) getSites(w http.ResponseWriter, r *http.Request) {
+	identity := GetIdentity(r.Context())
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSites())
+	render.JSON(w, r, lo.PickBy(s.Sites.GetSites(), func(id int, _ *net2.Site) bool {
+		return identity.canAccessSite(id)
+	}))
 }
 
 func (s *Server) getSite(w http.ResponseWriter, r *http.Request) {
@@ -285,82 +342,36 @@ func (s *Server) getSite(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, s.Sites.GetSite(siteID))
 }
 
-func (s *Server) getActiveStaffToday(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveStaffToday())
-}
-
-func (s *Server) getActiveStaff(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveStaff())
-}
-
-func (s *Server) getActiveVisitors(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveVisitors())
-}
-
-func (s *Server) getActiveVisitorsToday(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveVisitorsToday())
-}
-
-func (s *Server) getActiveNonStaff(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveNonStaff())
-}
-
 func (s *Server) getActiveUsersToday(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveUsersToday())
+	renderUsers(w, r, s.Sites.GetSite(siteID).GetActiveUsersToday())
 }
 
 func (s *Server) getActiveUsers(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetActiveUsers())
-}
-
-func (s *Server) getCancelledUsers(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetCancelledUsers())
-}
-
-func (s *Server) getVisitors(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetVisitors())
-}
-
-func (s *Server) getContractors(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetContractors())
+	renderUsers(w, r, s.Sites.GetSite(siteID).GetActiveUsers())
 }
 
-func (s *Server) getCleaners(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCategories(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetCleaners())
+	render.JSON(w, r, s.Sites.GetSite(siteID).GetCategories())
 }
 
-func (s *Server) getCustomers(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCategoryUsers(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetCustomers())
-}
-
-func (s *Server) getStaff(w http.ResponseWriter, r *http.Request) {
-	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).GetStaff())
+	users, err := s.Sites.GetSite(siteID).GetCategoryUsers(chi.URLParam(r, "category"), r.URL.Query().Get("scope"))
+	switch {
+	case errors.Is(err, net2.ErrCategoryNotFound):
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "category not found"})
+		return
+	case err != nil:
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	renderUsers(w, r, users)
 }
 
 func (s *Server) getDoors(w http.ResponseWriter, r *http.Request) {
@@ -391,7 +402,8 @@ func (s *Server) getDoor(w http.ResponseWriter, r *http.Request) {
 func (s *Server) openDoor(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	doorID, _ := strconv.Atoi(chi.URLParam(r, "doorID"))
-	err := s.Sites.GetSite(siteID).OpenDoor(uint64(doorID))
+	err := s.Sites.GetSite(siteID).OpenDoor(r.Context(), uint64(doorID))
+	s.audit(r, audit.Entry{Action: "door.open", SiteID: siteID, DoorID: uint64(doorID)}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error opening door"})
@@ -404,7 +416,8 @@ func (s *Server) openDoor(w http.ResponseWriter, r *http.Request) {
 func (s *Server) relay1(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	doorID, _ := strconv.Atoi(chi.URLParam(r, "doorID"))
-	err := s.Sites.GetSite(siteID).OpenDoorWithRelay(uint64(doorID), false)
+	err := s.Sites.GetSite(siteID).OpenDoorWithRelay(r.Context(), uint64(doorID), false)
+	s.audit(r, audit.Entry{Action: "door.relay1", SiteID: siteID, DoorID: uint64(doorID)}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error opening door"})
@@ -417,7 +430,8 @@ func (s *Server) relay1(w http.ResponseWriter, r *http.Request) {
 func (s *Server) relay2(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	doorID, _ := strconv.Atoi(chi.URLParam(r, "doorID"))
-	err := s.Sites.GetSite(siteID).OpenDoorWithRelay(uint64(doorID), true)
+	err := s.Sites.GetSite(siteID).OpenDoorWithRelay(r.Context(), uint64(doorID), true)
+	s.audit(r, audit.Entry{Action: "door.relay2", SiteID: siteID, DoorID: uint64(doorID)}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error opening door"})
@@ -430,7 +444,8 @@ func (s *Server) relay2(w http.ResponseWriter, r *http.Request) {
 func (s *Server) closeDoor(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	doorID, _ := strconv.Atoi(chi.URLParam(r, "doorID"))
-	err := s.Sites.GetSite(siteID).CloseDoor(uint64(doorID))
+	err := s.Sites.GetSite(siteID).CloseDoor(r.Context(), uint64(doorID))
+	s.audit(r, audit.Entry{Action: "door.close", SiteID: siteID, DoorID: uint64(doorID)}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error closing door"})
@@ -443,7 +458,8 @@ func (s *Server) closeDoor(w http.ResponseWriter, r *http.Request) {
 func (s *Server) resetAntiPassback(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
-	err := s.Sites.GetSite(siteID).ResetAntiPassback(userID)
+	err := s.Sites.GetSite(siteID).ResetAntiPassback(r.Context(), userID)
+	s.audit(r, audit.Entry{Action: "user.resetantipassback", SiteID: siteID, UserID: userID}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error resetting anti passback"})
@@ -468,7 +484,8 @@ func (s *Server) getDepartments(w http.ResponseWriter, r *http.Request) {
 func (s *Server) activateUser(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
-	err := s.Sites.GetSite(siteID).ActivateUser(userID)
+	err := s.Sites.GetSite(siteID).ActivateUser(r.Context(), userID)
+	s.audit(r, audit.Entry{Action: "user.activate", SiteID: siteID, UserID: userID}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error activating user"})
@@ -481,7 +498,8 @@ func (s *Server) activateUser(w http.ResponseWriter, r *http.Request) {
 func (s *Server) deactivateUser(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
-	err := s.Sites.GetSite(siteID).DeactivateUser(userID)
+	err := s.Sites.GetSite(siteID).DeactivateUser(r.Context(), userID)
+	s.audit(r, audit.Entry{Action: "user.deactivate", SiteID: siteID, UserID: userID}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error deactivating user"})
@@ -501,13 +519,18 @@ func (s *Server) activateAndUpdate(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "Error activating user"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).UpdateUserNameAndExpiryAndAccessLevel(
+	err = s.Sites.GetSite(siteID).UpdateUserNameAndExpiryAndAccessLevel(r.Context(),
 		userID,
 		data.FirstName,
 		data.LastName,
 		GetTomorrow(),
 		data.AccessLevel,
 	)
+	s.audit(r, audit.Entry{Action: "user.activateAndUpdate", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"firstName":   data.FirstName,
+		"lastName":    data.LastName,
+		"accessLevel": data.AccessLevel,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error activating user"})
@@ -527,13 +550,18 @@ func (s *Server) deactivateAndUpdate(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "Error activating user"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).UpdateUserNameAndExpiryAndAccessLevel(
+	err = s.Sites.GetSite(siteID).UpdateUserNameAndExpiryAndAccessLevel(r.Context(),
 		userID,
 		data.FirstName,
 		data.LastName,
 		GetYesterday(),
 		data.AccessLevel,
 	)
+	s.audit(r, audit.Entry{Action: "user.deactivateAndUpdate", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"firstName":   data.FirstName,
+		"lastName":    data.LastName,
+		"accessLevel": data.AccessLevel,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error deactivating user"})
@@ -546,7 +574,11 @@ func (s *Server) deactivateAndUpdate(w http.ResponseWriter, r *http.Request) {
 func (s *Server) extendExpiry(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
-	err := s.Sites.GetSite(siteID).UpdateUserInfo(userID, map[string]interface{}{"ExpiryDate": GetTomorrow()})
+	expiry := GetTomorrow()
+	err := s.Sites.GetSite(siteID).UpdateUserInfo(r.Context(), userID, map[string]interface{}{"ExpiryDate": expiry})
+	s.audit(r, audit.Entry{Action: "user.extendexpiry", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"expiry": expiry,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "Error extending user expiry"})
@@ -557,15 +589,16 @@ func (s *Server) extendExpiry(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) update(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 	go func() {
-		s.Sites.UpdateAll()
+		s.Sites.UpdateAll(ctx)
 	}()
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, MessageResponse{Message: "Update triggered"})
 }
 
 func (s *Server) updateNow(w http.ResponseWriter, r *http.Request) {
-	s.Sites.UpdateAll()
+	s.Sites.UpdateAll(r.Context())
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, MessageResponse{Message: "Update complete"})
 }
@@ -616,8 +649,18 @@ func (s *Server) sequenceDoors(w http.ResponseWriter, r *http.Request) {
 			Time: duration,
 		})
 	}
+	site := s.Sites.GetSite(siteID)
+	if site == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+		return
+	}
+	entry := s.auditEntry(r, audit.Entry{Action: "door.sequence", SiteID: siteID, Parameters: map[string]interface{}{
+		"sequence": doors,
+	}})
+	ctx := context.WithoutCancel(r.Context())
 	go func() {
-		s.Sites.GetSite(siteID).SequenceDoor(doors...)
+		s.recordAudit(entry, site.SequenceDoor(ctx, doors...))
 	}()
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, MessageResponse{Message: "Sequence triggered"})
@@ -632,7 +675,10 @@ func (s *Server) addAccessLevel(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "level needs to be numeric"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).AddUserAccessLevel(userID, level)
+	err = s.Sites.GetSite(siteID).AddUserAccessLevel(r.Context(), userID, level)
+	s.audit(r, audit.Entry{Action: "user.addaccesslevel", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"level": level,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "error adding access level"})
@@ -651,7 +697,10 @@ func (s *Server) removeAccessLevel(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "level needs to be numeric"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).RemoveUserAccessLevel(userID, level)
+	err = s.Sites.GetSite(siteID).RemoveUserAccessLevel(r.Context(), userID, level)
+	s.audit(r, audit.Entry{Action: "user.removeaccesslevel", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"level": level,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "error removing access level"})
@@ -670,7 +719,10 @@ func (s *Server) setAccessLevel(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "level needs to be numeric"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).SetUserAccessLevel(userID, level)
+	err = s.Sites.GetSite(siteID).SetUserAccessLevel(r.Context(), userID, level)
+	s.audit(r, audit.Entry{Action: "user.setaccesslevel", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"level": level,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "error setting access level"})
@@ -683,13 +735,41 @@ func (s *Server) setAccessLevel(w http.ResponseWriter, r *http.Request) {
 func (s *Server) getUpToDate(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, !s.Sites.GetSite(siteID).LastPolled.Before(time.Now().Add(-1*3*time.Minute)))
+	render.JSON(w, r, s.Sites.GetSite(siteID).UpToDate())
 }
 
 func (s *Server) getUnknownTokens(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, s.Sites.GetSite(siteID).UnknownTokens)
+	render.JSON(w, r, s.Sites.GetSite(siteID).GetUnknownTokens())
+}
+
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	var from, to time.Time
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "from must be an RFC3339 time"})
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "to must be an RFC3339 time"})
+			return
+		}
+	}
+	eventType := r.URL.Query().Get("type")
+	if eventType != "" && eventType != net2.EventTypeKnown && eventType != net2.EventTypeUnknown {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: "type must be known or unknown"})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Sites.GetSite(siteID).GetEvents(from, to, eventType))
 }
 
 func (s *Server) changeDepartment(w http.ResponseWriter, r *http.Request) {
@@ -701,7 +781,10 @@ func (s *Server) changeDepartment(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, MessageResponse{Error: "department needs to be numeric"})
 		return
 	}
-	err = s.Sites.GetSite(siteID).ChangeUserDepartment(userID, department)
+	err = s.Sites.GetSite(siteID).ChangeUserDepartment(r.Context(), userID, department)
+	s.audit(r, audit.Entry{Action: "user.changedepartment", SiteID: siteID, UserID: userID, Parameters: map[string]interface{}{
+		"department": department,
+	}}, err)
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, MessageResponse{Error: "error changing user department"})
@@ -714,8 +797,13 @@ func (s *Server) changeDepartment(w http.ResponseWriter, r *http.Request) {
 func (s *Server) openOpenableDoor(w http.ResponseWriter, r *http.Request) {
 	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
 	doorName, _ := url.QueryUnescape(chi.URLParam(r, "doorName"))
-	openableDoors := s.Sites.GetSite(siteID).GetOpenableDoors()
-	sequence := openableDoors[doorName]
+	site := s.Sites.GetSite(siteID)
+	if site == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+		return
+	}
+	sequence := site.GetOpenableDoors()[doorName]
 
 	var doors []net2.DoorSequenceItem
 	for _, item := range sequence {
@@ -725,8 +813,12 @@ func (s *Server) openOpenableDoor(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	entry := s.auditEntry(r, audit.Entry{Action: "door.openable", SiteID: siteID, Parameters: map[string]interface{}{
+		"door": doorName,
+	}})
+	ctx := context.WithoutCancel(r.Context())
 	go func() {
-		s.Sites.GetSite(siteID).SequenceDoor(doors...)
+		s.recordAudit(entry, site.SequenceDoor(ctx, doors...))
 	}()
 
 	render.Status(r, http.StatusOK)
@@ -752,7 +844,13 @@ func (s *Server) validateDepartmentName(next http.Handler) http.Handler {
 			render.JSON(w, r, MessageResponse{Error: "departmentName is required"})
 			return
 		}
-		departments := s.Sites.GetSite(siteID).GetDepartments()
+		site := s.Sites.GetSite(siteID)
+		if site == nil {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+			return
+		}
+		departments := site.GetDepartments()
 		found := false
 		for _, dept := range departments {
 			if dept.Name == departmentName {
@@ -789,7 +887,10 @@ func (s *Server) activateDepartmentUsers(w http.ResponseWriter, r *http.Request)
 		}
 		
 		if inDepartment {
-			err := site.ActivateUser(user.ID)
+			err := site.ActivateUser(r.Context(), user.ID)
+			s.audit(r, audit.Entry{Action: "department.activate", SiteID: siteID, UserID: user.ID, Parameters: map[string]interface{}{
+				"department": departmentName,
+			}}, err)
 			if err != nil {
 				log.Error().Err(err).Int("userID", user.ID).Str("department", departmentName).Msg("Failed to activate user")
 				failedCount++
@@ -0,0 +1,537 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/greboid/net2/audit"
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/greboid/net2/net2"
+	"github.com/greboid/net2/webhook"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const testConfig = `
+apiKeys:
+  - name: admin
+    key: admin-key
+    role: admin
+  - name: site-admin
+    key: site-admin-key
+    role: admin
+    sites: [1]
+  - name: reader
+    key: reader-key
+    role: readonly
+    sites: [1]
+  - name: doorman
+    key: door-key
+    role: reception
+    groups: [doors]
+sites:
+  - id: 1
+    name: First
+    username: admin
+    password: password
+    ip: 127.0.0.1
+    localIDField: Staff Number
+    categories:
+      - name: staff
+        departments:
+          - prefix: Staff
+  - id: 2
+    name: Second
+    username: admin
+    password: password
+    ip: 127.0.0.2
+    localIDField: Staff Number
+`
+
+// newTestBackend returns a fake with a department, an access level, a door and two users.  Every site gets the same
+// users, so each person has a record on both sites.
+func newTestBackend() *net2.FakeBackend {
+	backend := net2.NewFakeBackend()
+	backend.AddCustomField(net2.CustomFieldDefinition{ID: 14, Name: "Staff Number"})
+	backend.AddDepartment(net2.Department{ID: 1, Name: "Staff - Engineering"})
+	backend.AddAccessLevel(net2.AccessLevel{ID: 1, Name: "All Hours"})
+	backend.AddDoor(net2.Door{ID: 1001, Name: "Front Door"}, 0)
+	backend.AddUser(net2.UserRecord{
+		ID: 1, Firstname: "Ada", Surname: "Lovelace", LocalID: "1001", DepartmentID: 1,
+		DepartmentName: "Staff - Engineering", AccessLevelName: "All Hours", ExpiryDate: "2099-12-31T23:59:59",
+	})
+	backend.AddUser(net2.UserRecord{
+		ID: 2, Firstname: "Charles", Surname: "Babbage", LocalID: "1002", DepartmentID: 1,
+		DepartmentName: "Staff - Engineering", AccessLevelName: "All Hours", ExpiryDate: "2024-06-30T23:59:59",
+	})
+	backend.AddEvent(net2.EventRecord{
+		ID: 1, Date: "2024-01-02T09:00:00", Type: 20, Description: "Access permitted", UserID: 1, FirstName: "Ada",
+		Surname: "Lovelace", Location: "Front Door", Token: 123456,
+	})
+	backend.AddEvent(net2.EventRecord{
+		ID: 2, Date: "2024-01-02T09:05:00", Type: 23, Description: "Access denied - unknown token",
+		Location: "Front Door", Token: 987654,
+	})
+	return backend
+}
+
+// newTestServer serves the routes for two sites, each over a backend from newBackend.
+func newTestServer(t *testing.T, newBackend func() net2.Backend) (*Server, http.Handler) {
+	t.Helper()
+	server, handler := startTestServer(t, newBackend)
+	for _, site := range server.Sites.GetSites() {
+		testutil.WaitFor(t, site.Ready)
+	}
+	return server, handler
+}
+
+// startTestServer is newTestServer without waiting for the sites to be ready.
+func startTestServer(t *testing.T, newBackend func() net2.Backend) (*Server, http.Handler) {
+	t.Helper()
+	conf := &config.Config{}
+	if err := yaml.Unmarshal([]byte(testConfig), conf); err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+	logger := zerolog.Nop()
+	sites := make([]*net2.Site, 0, len(conf.Sites))
+	for index := range conf.Sites {
+		if err := config.ValidateSite(&conf.Sites[index]); err != nil {
+			t.Fatalf("invalid site config: %v", err)
+		}
+		sites = append(sites, net2.NewSite(&conf.Sites[index], newBackend(), &logger))
+	}
+	manager := &net2.SiteManager{Logger: &logger}
+	if err := manager.Start(conf, sites); err != nil {
+		t.Fatalf("unable to start sites: %v", err)
+	}
+	t.Cleanup(manager.Stop)
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("unable to open audit log: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = auditLog.Close()
+	})
+	server := &Server{Sites: manager, APIKeys: conf.APIKeys, Audit: auditLog}
+	return server, server.GetRoutes()
+}
+
+func defaultBackend() net2.Backend {
+	return newTestBackend()
+}
+
+// request sends a request with an API key, if one is given, and returns the response status and body.
+func request(t *testing.T, handler http.Handler, method string, path string, key string, body string) (int, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestRoutesAuthorisation(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		want   int
+	}{
+		{name: "health needs no key", method: http.MethodGet, path: "/healthz", want: http.StatusOK},
+		{name: "missing key", method: http.MethodGet, path: "/api/v1/sites", want: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/api/v1/sites", key: "guess", want: http.StatusUnauthorized},
+		{name: "admin", method: http.MethodGet, path: "/api/v1/sites/2/users", key: "admin-key", want: http.StatusOK},
+		{name: "scoped key on its site", method: http.MethodGet, path: "/api/v1/sites/1/users", key: "reader-key", want: http.StatusOK},
+		{name: "scoped key on another site", method: http.MethodGet, path: "/api/v1/sites/2/users", key: "reader-key", want: http.StatusForbidden},
+		{name: "scoped key on a missing site", method: http.MethodGet, path: "/api/v1/sites/9/users", key: "reader-key", want: http.StatusForbidden},
+		{name: "scoped key streaming another site", method: http.MethodGet, path: "/api/v1/stream/2", key: "reader-key", want: http.StatusForbidden},
+		{name: "admin on a missing site", method: http.MethodGet, path: "/api/v1/sites/9/users", key: "admin-key", want: http.StatusNotFound},
+		{name: "read only key opening a door", method: http.MethodPost, path: "/api/v1/sites/1/doors/1001/open", key: "reader-key", want: http.StatusForbidden},
+		{name: "door group opening a door", method: http.MethodPost, path: "/api/v1/sites/1/doors/1001/open", key: "door-key", want: http.StatusOK},
+		{name: "door group reading users", method: http.MethodGet, path: "/api/v1/sites/1/users", key: "door-key", want: http.StatusForbidden},
+		{name: "missing door", method: http.MethodPost, path: "/api/v1/sites/1/doors/9/open", key: "door-key", want: http.StatusNotFound},
+		{name: "read only key reading the audit log", method: http.MethodGet, path: "/api/v1/audit", key: "reader-key", want: http.StatusForbidden},
+		{name: "scoped admin adding a site", method: http.MethodPost, path: "/api/v1/sites", key: "site-admin-key", body: `{"id":3}`, want: http.StatusForbidden},
+		{name: "scoped admin updating another site", method: http.MethodPut, path: "/api/v1/sites/2", key: "site-admin-key", body: `{}`, want: http.StatusForbidden},
+		{name: "scoped admin updating its site", method: http.MethodPut, path: "/api/v1/sites/1", key: "site-admin-key", body: `{"ip":"10.0.0.1"}`, want: http.StatusForbidden},
+		{name: "scoped admin removing its site", method: http.MethodDelete, path: "/api/v1/sites/1", key: "site-admin-key", want: http.StatusForbidden},
+		{name: "scoped admin reading its site", method: http.MethodGet, path: "/api/v1/sites/1", key: "site-admin-key", want: http.StatusOK},
+		{name: "scoped admin updating every site", method: http.MethodGet, path: "/api/v1/update/now", key: "site-admin-key", want: http.StatusForbidden},
+		{name: "scoped admin triggering an update", method: http.MethodGet, path: "/api/v1/update/trigger", key: "site-admin-key", want: http.StatusForbidden},
+		{name: "admin updating every site", method: http.MethodGet, path: "/api/v1/update/now", key: "admin-key", want: http.StatusOK},
+		{name: "unknown route", method: http.MethodGet, path: "/api/v1/nothing", key: "admin-key", want: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := request(t, handler, test.method, test.path, test.key, test.body); status != test.want {
+				t.Errorf("status = %d, want %d: %s", status, test.want, body)
+			}
+		})
+	}
+}
+
+func TestRoutesBearerToken(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/sites", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestRoutesWithoutCredentials(t *testing.T) {
+	tests := []struct {
+		name                 string
+		allowUnauthenticated bool
+		status               int
+	}{
+		{name: "refused", status: http.StatusUnauthorized},
+		{name: "allowed", allowUnauthenticated: true, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := newTestServer(t, defaultBackend)
+			server.APIKeys = nil
+			server.AllowUnauthenticated = test.allowUnauthenticated
+			if status, body := request(t, server.GetRoutes(), http.MethodGet, "/api/v1/update/trigger", "", ""); status != test.status {
+				t.Errorf("status = %d, want %d: %s", status, test.status, body)
+			}
+		})
+	}
+}
+
+func TestGetSitesIsScoped(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "admin-key", want: []string{"1", "2"}},
+		{key: "reader-key", want: []string{"1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, "/api/v1/sites", test.key, "")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			sites := make(map[string]json.RawMessage)
+			if err := json.Unmarshal([]byte(body), &sites); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if len(sites) != len(test.want) {
+				t.Fatalf("sites = %s, want %v", body, test.want)
+			}
+			for _, id := range test.want {
+				if _, ok := sites[id]; !ok {
+					t.Errorf("site %s missing from %s", id, body)
+				}
+			}
+		})
+	}
+}
+
+func TestAddSiteRejectsHostSecrets(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name     string
+		password string
+	}{
+		{name: "file", password: "file:/etc/shadow"},
+		{name: "environment", password: "${env:HOME}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"id":3,"name":"Third","username":"admin","ip":"127.0.0.3","password":"` + test.password + `"}`
+			status, response := request(t, handler, http.MethodPost, "/api/v1/sites", "admin-key", body)
+			if status != http.StatusBadRequest || !strings.Contains(response, config.ErrSecretReference.Error()) {
+				t.Errorf("status = %d, want %d: %s", status, http.StatusBadRequest, response)
+			}
+		})
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/healthz", want: `{"message":"ok"}`},
+		{path: "/readyz", want: `{"ready":true}`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, test.path, "", "")
+			if status != http.StatusOK || strings.TrimSpace(body) != test.want {
+				t.Errorf("status = %d: %s, want %s", status, body, test.want)
+			}
+		})
+	}
+	status, body := request(t, handler, http.MethodGet, "/api/v1/sites/1/status", "reader-key", "")
+	health := &net2.SiteHealth{}
+	if err := json.Unmarshal([]byte(body), health); status != http.StatusOK || err != nil {
+		t.Errorf("status = %d: %s", status, body)
+	}
+}
+
+func TestReadyzWaitsForASuccessfulSync(t *testing.T) {
+	backend := newTestBackend()
+	backend.SetError(errors.New("connection refused"))
+	server, handler := startTestServer(t, func() net2.Backend { return backend })
+	site := server.Sites.GetSite(1)
+	testutil.WaitFor(t, func() bool { return site.Status().State == net2.SiteStateFailed })
+	status, body := request(t, handler, http.MethodGet, "/readyz", "", "")
+	if status != http.StatusServiceUnavailable || strings.TrimSpace(body) != `{"ready":false,"notReady":[1,2]}` {
+		t.Errorf("status = %d: %s", status, body)
+	}
+	backend.SetError(nil)
+	server.Sites.UpdateAll(context.Background())
+	if status, body = request(t, handler, http.MethodGet, "/readyz", "", ""); status != http.StatusOK {
+		t.Errorf("status = %d: %s", status, body)
+	}
+}
+
+func TestGetDoors(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{name: "all", path: "/api/v1/sites/1/doors", want: []string{"1001"}},
+		{name: "monitored", path: "/api/v1/sites/1/doors/monitored", want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, test.path, "door-key", "")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			doors := make(map[string]*net2.Door)
+			if err := json.Unmarshal([]byte(body), &doors); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if got := slices.Sorted(maps.Keys(doors)); !slices.Equal(got, test.want) {
+				t.Errorf("doors = %v, want %v", got, test.want)
+			}
+		})
+	}
+	status, body := request(t, handler, http.MethodGet, "/api/v1/sites/1/doors/1001", "door-key", "")
+	door := &net2.Door{}
+	if err := json.Unmarshal([]byte(body), door); status != http.StatusOK || err != nil || door.Name != "Front Door" {
+		t.Errorf("status = %d: %s", status, body)
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	server, handler := newTestServer(t, defaultBackend)
+	testutil.WaitFor(t, func() bool {
+		return len(server.Sites.GetSite(1).GetEvents(time.Time{}, time.Time{}, "")) == 2
+	})
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   []int64
+	}{
+		{name: "all", path: "/api/v1/sites/1/events", status: http.StatusOK, want: []int64{1, 2}},
+		{name: "known", path: "/api/v1/sites/1/events?type=known", status: http.StatusOK, want: []int64{1}},
+		{name: "unknown tokens", path: "/api/v1/sites/1/unknownTokens", status: http.StatusOK, want: []int64{2}},
+		{name: "before", path: "/api/v1/sites/1/events?to=2024-01-02T09:01:00Z", status: http.StatusOK, want: []int64{1}},
+		{name: "invalid type", path: "/api/v1/sites/1/events?type=some", status: http.StatusBadRequest},
+		{name: "invalid time", path: "/api/v1/sites/1/events?from=today", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, test.path, "reader-key", "")
+			if status != test.status {
+				t.Fatalf("status = %d, want %d: %s", status, test.status, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			events := make([]net2.Event, 0)
+			if err := json.Unmarshal([]byte(body), &events); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			got := make([]int64, 0, len(events))
+			for _, event := range events {
+				got = append(got, event.ID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("events = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamIsScoped(t *testing.T) {
+	server, handler := newTestServer(t, defaultBackend)
+	listener := httptest.NewServer(handler)
+	t.Cleanup(listener.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listener.URL+"/api/v1/stream?types=door.status", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("X-API-Key", "reader-key")
+	resp, err := listener.Client().Do(req)
+	if err != nil {
+		t.Fatalf("connecting to stream: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	server.Sites.Changes.Publish(2, net2.ChangeDoorStatus, map[string]int{"door": 2})
+	server.Sites.Changes.Publish(1, net2.ChangeUserUpdated, map[string]int{"user": 1})
+	server.Sites.Changes.Publish(1, net2.ChangeDoorStatus, map[string]int{"door": 1})
+	lines := make([]string, 0, 3)
+	scanner := bufio.NewScanner(resp.Body)
+	for len(lines) < 3 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || lines[1] != "event: door.status" || !strings.Contains(lines[2], `"siteID":1`) {
+		t.Errorf("event = %q", lines)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	server, handler := newTestServer(t, defaultBackend)
+	received := atomic.Int32{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(receiver.Close)
+	dispatcher, err := webhook.NewDispatcher([]config.Webhook{{Name: "hook", URL: receiver.URL, MaxAttempts: 1}}, "")
+	if err != nil {
+		t.Fatalf("creating dispatcher: %v", err)
+	}
+	dispatcher.Start(server.Sites.Changes)
+	t.Cleanup(dispatcher.Stop)
+	server.Webhooks = dispatcher
+	testutil.WaitFor(t, func() bool {
+		if received.Load() == 0 {
+			server.Sites.Changes.Publish(1, net2.ChangeDoorStatus, map[string]int{"door": 1})
+			return false
+		}
+		return true
+	})
+	server.Sites.Changes.Publish(2, net2.ChangeDoorStatus, map[string]int{"door": 1})
+	testutil.WaitFor(t, func() bool {
+		return slices.ContainsFunc(dispatcher.Attempts(""), func(attempt webhook.Attempt) bool {
+			return attempt.SiteID == 2
+		})
+	})
+	tests := []struct {
+		name  string
+		key   string
+		query string
+		sites []int
+	}{
+		{name: "all sites", key: "admin-key", query: "?webhook=hook", sites: []int{1, 2}},
+		{name: "other webhook", key: "admin-key", query: "?webhook=other", sites: []int{}},
+		{name: "site scoped", key: "site-admin-key", query: "", sites: []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, "/api/v1/webhooks/deliveries"+test.query, test.key, "")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			attempts := make([]webhook.Attempt, 0)
+			if err := json.Unmarshal([]byte(body), &attempts); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			sites := make([]int, 0)
+			for _, attempt := range attempts {
+				if attempt.Success && attempt.StatusCode == http.StatusNoContent && !slices.Contains(sites, attempt.SiteID) {
+					sites = append(sites, attempt.SiteID)
+				}
+			}
+			slices.Sort(sites)
+			if !slices.Equal(sites, test.sites) {
+				t.Errorf("sites = %v, want %v: %s", sites, test.sites, body)
+			}
+		})
+	}
+	status, body := request(t, handler, http.MethodGet, "/api/v1/webhooks/deadletters", "admin-key", "")
+	if status != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("status = %d: %s", status, body)
+	}
+}
+
+// TestValidatorsHandleRemovedSites checks the validators behind validateSiteID don't panic if the site is removed
+// between the two checks.
+func TestValidatorsHandleRemovedSites(t *testing.T) {
+	server, _ := newTestServer(t, defaultBackend)
+	router := chi.NewRouter()
+	router.With(server.validateDoorID).Get("/sites/{siteID}/doors/{doorID}", func(http.ResponseWriter, *http.Request) {})
+	router.With(server.validateUserID).Get("/sites/{siteID}/users/{userID}", func(http.ResponseWriter, *http.Request) {})
+	router.With(server.validateOpenableDoor).Get("/sites/{siteID}/openable/{doorName}", func(http.ResponseWriter, *http.Request) {})
+	router.With(server.validateDepartmentName).Get("/sites/{siteID}/departments/{departmentName}", func(http.ResponseWriter, *http.Request) {})
+	router.Post("/sites/{siteID}/sequence", server.sequenceDoors)
+	for _, path := range []string{"/sites/9/doors/1001", "/sites/9/users/1", "/sites/9/openable/Front", "/sites/9/departments/Staff"} {
+		if status, body := request(t, router, http.MethodGet, path, "", ""); status != http.StatusNotFound {
+			t.Errorf("%s: status = %d: %s", path, status, body)
+		}
+	}
+	if status, body := request(t, router, http.MethodPost, "/sites/9/sequence", "", `[{"door":"1001"}]`); status != http.StatusNotFound {
+		t.Errorf("sequence: status = %d: %s", status, body)
+	}
+}
+
+func TestMetricsReportEachServersSites(t *testing.T) {
+	for range 2 {
+		server, handler := newTestServer(t, defaultBackend)
+		status, body := request(t, handler, http.MethodGet, "/metrics", "admin-key", "")
+		if status != http.StatusOK {
+			t.Fatalf("status = %d: %s", status, body)
+		}
+		for id := range server.Sites.GetSites() {
+			want := `net2_site_last_sync_timestamp_seconds{name="` + server.Sites.GetSite(id).Name + `",site="` + strconv.Itoa(id) + `"}`
+			if !strings.Contains(body, want) {
+				t.Errorf("metrics missing %s", want)
+			}
+		}
+		server.Sites.Stop()
+		if status, body = request(t, handler, http.MethodGet, "/metrics", "admin-key", ""); strings.Contains(body, "net2_site_last_sync") {
+			t.Errorf("status = %d, stopped sites still reported", status)
+		}
+	}
+}
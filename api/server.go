@@ -2,28 +2,37 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/greboid/net2/audit"
+	"github.com/greboid/net2/config"
 	"github.com/greboid/net2/net2"
+	"github.com/greboid/net2/webhook"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 )
 
 type Server struct {
-	Server   *http.Server
-	shutdown chan os.Signal
-	Sites    *net2.SiteManager
+	Server               *http.Server
+	listeners            []net.Listener
+	shutdown             chan os.Signal
+	Sites                *net2.SiteManager
+	APIKeys              []config.APIKey
+	ClientCerts          []config.ClientCert
+	AllowUnauthenticated bool
+	Audit                *audit.Log
+	Webhooks             *webhook.Dispatcher
 }
 
-func (s *Server) listenAndServe() error {
-	if s.shutdown == nil {
-		s.shutdown = make(chan os.Signal)
-	}
-	if err := s.Server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+func (s *Server) serve(listener net.Listener) error {
+	if err := s.Server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		log.Debug().Err(err).Msg("Server error")
 		return err
 	}
@@ -43,21 +52,80 @@ func (s *Server) waitForShutdown() error {
 	return err
 }
 
-func (s *Server) Init(port int, handler http.Handler) {
+// Init opens the listeners set in the config: TCP on the bind address, using TLS if a certificate is configured, and
+// a Unix socket.  TCP is only used alongside a socket if a bind address is set.
+func (s *Server) Init(conf *config.Config, handler http.Handler) error {
 	s.Server = &http.Server{
-		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
 		Handler: handler,
 	}
+	if conf.BindAddress != "" {
+		listener, err := net.Listen("tcp", net.JoinHostPort(conf.BindAddress, strconv.Itoa(conf.APIPort)))
+		if err != nil {
+			return err
+		}
+		if conf.TLS.Cert != "" {
+			reloader, err := newCertReloader(conf.TLS)
+			if err != nil {
+				_ = listener.Close()
+				return err
+			}
+			listener = tls.NewListener(listener, reloader.tlsConfig())
+		}
+		log.Info().Str("Address", listener.Addr().String()).Bool("TLS", conf.TLS.Cert != "").Msg("Listening")
+		s.listeners = append(s.listeners, listener)
+	}
+	if conf.Socket != "" {
+		listener, err := listenUnix(conf.Socket, conf.SocketMode)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		log.Info().Str("Socket", conf.Socket).Msg("Listening")
+		s.listeners = append(s.listeners, listener)
+	}
+	return nil
+}
+
+// listenUnix listens on a Unix socket, replacing a socket left behind by a previous run.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	permissions, _ := strconv.ParseUint(mode, 8, 32)
+	if err = os.Chmod(path, os.FileMode(permissions)); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.listeners = nil
 }
 
 func (s *Server) Run() error {
-	if s.Server == nil {
+	if s.Server == nil || len(s.listeners) == 0 {
 		return fmt.Errorf("server must be initialised")
 	}
+	s.shutdown = make(chan os.Signal)
 	g := new(errgroup.Group)
-	g.Go(func() error {
-		return s.listenAndServe()
-	})
+	for _, listener := range s.listeners {
+		g.Go(func() error {
+			return s.serve(listener)
+		})
+	}
 	g.Go(func() error {
 		return s.waitForShutdown()
 	})
@@ -0,0 +1,404 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating ca: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for the subject, for a server on 127.0.0.1 or for a client.
+func (c *testCA) issue(t *testing.T, subject pkix.Name, server bool) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// keyPair issues a client certificate that can be presented by a tls.Config.
+func (c *testCA) keyPair(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := c.issue(t, subject, false)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("loading key pair: %v", err)
+	}
+	return pair
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path
+}
+
+// serverTLSConfig writes a server certificate issued by the CA, and the CA itself as the client CA.
+func serverTLSConfig(t *testing.T, ca *testCA, commonName string) config.ServerTLS {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: commonName}, true)
+	return config.ServerTLS{
+		Cert:     writeTestFile(t, filepath.Join(dir, "cert.pem"), certPEM),
+		Key:      writeTestFile(t, filepath.Join(dir, "key.pem"), keyPEM),
+		ClientCA: writeTestFile(t, filepath.Join(dir, "ca.pem"), ca.pem),
+	}
+}
+
+// serve initialises the server with the config and serves its listeners until the test ends.
+func serve(t *testing.T, server *Server, conf *config.Config, handler http.Handler) {
+	t.Helper()
+	if err := server.Init(conf, handler); err != nil {
+		t.Fatalf("initialising server: %v", err)
+	}
+	for _, listener := range server.listeners {
+		go func() {
+			_ = server.Server.Serve(listener)
+		}()
+	}
+	t.Cleanup(func() {
+		_ = server.Server.Close()
+	})
+}
+
+// getSites fetches the sites the client can see, returning how many there are.
+func getSites(client *http.Client, url string, key string) (int, int, error) {
+	req, _ := http.NewRequest(http.MethodGet, url+"/api/v1/sites", nil)
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	sites := make(map[string]json.RawMessage)
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(&sites); err != nil {
+			return 0, 0, err
+		}
+	}
+	return resp.StatusCode, len(sites), nil
+}
+
+func TestTLSClientCerts(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	admin := ca.keyPair(t, pkix.Name{CommonName: "admin-client"})
+	reader := ca.keyPair(t, pkix.Name{CommonName: "reader-client", Organization: []string{"Example"}})
+	readerName := ca.keyPair(t, pkix.Name{CommonName: "reader-client"})
+	unknown := ca.keyPair(t, pkix.Name{CommonName: "someone-else"})
+	untrusted := otherCA.keyPair(t, pkix.Name{CommonName: "admin-client"})
+	tests := []struct {
+		name    string
+		cert    *tls.Certificate
+		key     string
+		require bool
+		status  int
+		sites   int
+		wantErr bool
+	}{
+		{name: "no certificate", status: http.StatusUnauthorized},
+		{name: "api key", key: "admin-key", status: http.StatusOK, sites: 2},
+		{name: "common name", cert: &admin, status: http.StatusOK, sites: 2},
+		{name: "distinguished name", cert: &reader, status: http.StatusOK, sites: 1},
+		{name: "common name of a distinguished name", cert: &readerName, status: http.StatusUnauthorized},
+		{name: "certificate takes priority over the api key", cert: &reader, key: "admin-key", status: http.StatusOK, sites: 1},
+		{name: "unknown subject", cert: &unknown, status: http.StatusUnauthorized},
+		{name: "unknown subject with an api key", cert: &unknown, key: "admin-key", status: http.StatusOK, sites: 2},
+		{name: "untrusted certificate", cert: &untrusted, wantErr: true},
+		{name: "required", cert: &admin, require: true, status: http.StatusOK, sites: 2},
+		{name: "required but missing", key: "admin-key", require: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, handler := newTestServer(t, defaultBackend)
+			server.ClientCerts = []config.ClientCert{
+				{Subject: "admin-client", Name: "admin cert", Role: "admin"},
+				{Subject: "CN=reader-client,O=Example", Name: "reader cert", Role: "readonly", Sites: []int{1}},
+			}
+			conf := &config.Config{BindAddress: "127.0.0.1", TLS: serverTLSConfig(t, ca, "server")}
+			conf.TLS.RequireClientCert = test.require
+			serve(t, server, conf, handler)
+			tlsConfig := &tls.Config{RootCAs: pool}
+			if test.cert != nil {
+				// Always present the certificate, even one the server's CA didn't issue.
+				tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return test.cert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			defer client.CloseIdleConnections()
+			status, sites, err := getSites(client, "https://"+server.listeners[0].Addr().String(), test.key)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && (status != test.status || sites != test.sites) {
+				t.Errorf("status = %d with %d sites, want %d with %d sites", status, sites, test.status, test.sites)
+			}
+		})
+	}
+}
+
+func TestTLSWithoutClientCA(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	server, handler := newTestServer(t, defaultBackend)
+	server.ClientCerts = []config.ClientCert{{Subject: "admin-client", Name: "admin cert", Role: "admin"}}
+	conf := &config.Config{BindAddress: "127.0.0.1", TLS: serverTLSConfig(t, ca, "server")}
+	conf.TLS.ClientCA = ""
+	serve(t, server, conf, handler)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{ca.keyPair(t, pkix.Name{CommonName: "admin-client"})},
+	}}}
+	defer client.CloseIdleConnections()
+	url := "https://" + server.listeners[0].Addr().String()
+	if status, _, err := getSites(client, url, ""); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("status = %d, error = %v, want the certificate ignored", status, err)
+	}
+	if status, _, err := getSites(client, url, "reader-key"); err != nil || status != http.StatusOK {
+		t.Errorf("status = %d, error = %v with an api key", status, err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	conf := serverTLSConfig(t, ca, "first")
+	reloader, err := newCertReloader(conf)
+	if err != nil {
+		t.Fatalf("creating reloader: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	go func() {
+		_ = server.Serve(tls.NewListener(listener, reloader.tlsConfig()))
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serving := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	// replace writes new files with a later modification time, as a rotation within the same second could otherwise
+	// go unnoticed.
+	modified := time.Now()
+	replace := func(certPEM []byte, keyPEM []byte) {
+		t.Helper()
+		modified = modified.Add(time.Minute)
+		for path, data := range map[string][]byte{conf.Cert: certPEM, conf.Key: keyPEM} {
+			writeTestFile(t, path, data)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatalf("touching %s: %v", path, err)
+			}
+		}
+	}
+	expireCheck := func() {
+		reloader.lock.Lock()
+		defer reloader.lock.Unlock()
+		reloader.checked = time.Time{}
+	}
+
+	if got := serving(); got != "first" {
+		t.Fatalf("serving %s, want first", got)
+	}
+	replace(ca.issue(t, pkix.Name{CommonName: "second"}, true))
+	if got := serving(); got != "first" {
+		t.Errorf("serving %s before the check interval, want first", got)
+	}
+	expireCheck()
+	if got := serving(); got != "second" {
+		t.Errorf("serving %s after the files changed, want second", got)
+	}
+	_, keyPEM := ca.issue(t, pkix.Name{CommonName: "third"}, true)
+	certPEM, _ := ca.issue(t, pkix.Name{CommonName: "third"}, true)
+	replace(certPEM, keyPEM)
+	expireCheck()
+	if got := serving(); got != "second" {
+		t.Errorf("serving %s after a mismatched key, want second kept", got)
+	}
+	if err = os.Remove(conf.Key); err != nil {
+		t.Fatalf("removing key: %v", err)
+	}
+	expireCheck()
+	if got := serving(); got != "second" {
+		t.Errorf("serving %s after the key was removed, want second kept", got)
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	tests := []struct {
+		name   string
+		modify func(conf *config.ServerTLS)
+	}{
+		{name: "missing certificate", modify: func(conf *config.ServerTLS) {
+			conf.Cert += ".missing"
+		}},
+		{name: "missing client ca", modify: func(conf *config.ServerTLS) {
+			conf.ClientCA += ".missing"
+		}},
+		{name: "invalid client ca", modify: func(conf *config.ServerTLS) {
+			conf.ClientCA = conf.Key
+		}},
+		{name: "mismatched key", modify: func(conf *config.ServerTLS) {
+			conf.Cert = conf.ClientCA
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := serverTLSConfig(t, ca, "server")
+			test.modify(&conf)
+			if _, err := newCertReloader(conf); err == nil {
+				t.Error("created a reloader")
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		stale bool
+	}{
+		{name: "owner only", mode: "0600"},
+		{name: "group", mode: "0660"},
+		{name: "replaces a stale socket", mode: "0660", stale: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "api.sock")
+			if test.stale {
+				listener, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatalf("listening: %v", err)
+				}
+				listener.(*net.UnixListener).SetUnlinkOnClose(false)
+				_ = listener.Close()
+			}
+			server, handler := newTestServer(t, defaultBackend)
+			serve(t, server, &config.Config{Socket: path, SocketMode: test.mode}, handler)
+			if len(server.listeners) != 1 {
+				t.Fatalf("listeners = %d, want only the socket", len(server.listeners))
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("checking socket: %v", err)
+			}
+			if want, _ := strconv.ParseUint(test.mode, 8, 32); info.Mode().Perm() != os.FileMode(want) {
+				t.Errorf("socket mode = %s, want %s", info.Mode().Perm(), test.mode)
+			}
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return new(net.Dialer).DialContext(ctx, "unix", path)
+				},
+			}}
+			defer client.CloseIdleConnections()
+			if status, sites, err := getSites(client, "http://net2proxy", "admin-key"); err != nil || status != http.StatusOK || sites != 2 {
+				t.Errorf("status = %d with %d sites, error = %v", status, sites, err)
+			}
+		})
+	}
+}
+
+func TestUnixSocketRefusesToReplaceFiles(t *testing.T) {
+	path := writeTestFile(t, filepath.Join(t.TempDir(), "api.sock"), []byte("not a socket"))
+	server, handler := newTestServer(t, defaultBackend)
+	err := server.Init(&config.Config{Socket: path, SocketMode: "0660"}, handler)
+	if err == nil {
+		server.closeListeners()
+		t.Fatal("listened over a file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "not a socket" {
+		t.Errorf("file was changed to %q", data)
+	}
+}
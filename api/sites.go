@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/audit"
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func (s *Server) addSite(w http.ResponseWriter, r *http.Request) {
+	site := config.SiteConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+		invalidSite(w, r, err)
+		return
+	}
+	if site.ID <= 0 {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: "id must be a positive number"})
+		return
+	}
+	validated := site
+	if err := config.ValidateSite(&validated); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	err := s.Sites.AddSite(site)
+	s.audit(r, audit.Entry{Action: "site.add", SiteID: site.ID, Parameters: siteAuditParameters(&validated)}, err)
+	if !s.siteChanged(w, r, err) {
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, s.Sites.GetSite(site.ID))
+}
+
+func (s *Server) updateSite(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	current, ok := s.Sites.SiteConfig(siteID)
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+		return
+	}
+	site, err := patchSiteConfig(current, r.Body)
+	if err != nil {
+		invalidSite(w, r, err)
+		return
+	}
+	site.ID = siteID
+	validated := site
+	if err := config.ValidateSite(&validated); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	err = s.Sites.UpdateSite(site)
+	s.audit(r, audit.Entry{Action: "site.update", SiteID: siteID, Parameters: siteAuditParameters(&validated)}, err)
+	if !s.siteChanged(w, r, err) {
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Sites.GetSite(siteID))
+}
+
+func (s *Server) removeSite(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	err := s.Sites.RemoveSite(siteID)
+	s.audit(r, audit.Entry{Action: "site.remove", SiteID: siteID}, err)
+	if !s.siteChanged(w, r, err) {
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, MessageResponse{Message: "Site removed"})
+}
+
+// patchSiteConfig applies the fields in a request body to a copy of a site's config.  Objects are merged, so only the
+// fields given are changed, but lists are replaced as a whole rather than merged element by element.  The password is
+// copied across rather than round tripped, as it may be a file or environment reference that JSON doesn't accept.
+func patchSiteConfig(current config.SiteConfig, body io.Reader) (config.SiteConfig, error) {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return config.SiteConfig{}, err
+	}
+	data, err := json.Marshal(&current)
+	if err != nil {
+		return config.SiteConfig{}, err
+	}
+	var merged map[string]interface{}
+	if err = json.Unmarshal(data, &merged); err != nil {
+		return config.SiteConfig{}, err
+	}
+	_, passwordChanged := patch["password"]
+	if !passwordChanged {
+		delete(merged, "password")
+	}
+	mergeJSON(merged, patch)
+	if data, err = json.Marshal(merged); err != nil {
+		return config.SiteConfig{}, err
+	}
+	site := config.SiteConfig{}
+	if err = json.Unmarshal(data, &site); err != nil {
+		return config.SiteConfig{}, err
+	}
+	if !passwordChanged {
+		site.Password = current.Password
+	}
+	return site, nil
+}
+
+func mergeJSON(target map[string]interface{}, patch map[string]interface{}) {
+	for key, value := range patch {
+		nested, isObject := value.(map[string]interface{})
+		existing, hasObject := target[key].(map[string]interface{})
+		if isObject && hasObject {
+			mergeJSON(existing, nested)
+		} else {
+			target[key] = value
+		}
+	}
+}
+
+func invalidSite(w http.ResponseWriter, r *http.Request, err error) {
+	message := "Invalid site"
+	if errors.Is(err, config.ErrSecretReference) {
+		message = err.Error()
+	}
+	render.Status(r, http.StatusBadRequest)
+	render.JSON(w, r, MessageResponse{Error: message})
+}
+
+func (s *Server) siteChanged(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, net2.ErrSiteExists):
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, MessageResponse{Error: "Site already exists"})
+	case errors.Is(err, net2.ErrSiteNotFound):
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "siteID not found"})
+	default:
+		log.Error().Err(err).Msg("Unable to change sites")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, MessageResponse{Error: "Error changing sites"})
+	}
+	return false
+}
+
+func siteAuditParameters(site *config.SiteConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     site.Name,
+		"ip":       site.IP,
+		"port":     site.Port,
+		"username": site.Username,
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	siteID := 0
+	if siteParam := chi.URLParam(r, "siteID"); siteParam != "" {
+		siteID, _ = strconv.Atoi(siteParam)
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	var lastEventID uint64
+	if lastID != "" {
+		var err error
+		if lastEventID, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "Last-Event-ID must be numeric"})
+			return
+		}
+	}
+	var types []string
+	if value := r.URL.Query().Get("types"); value != "" {
+		types = strings.Split(value, ",")
+	}
+	identity := GetIdentity(r.Context())
+	wanted := func(change *net2.Change) bool {
+		if siteID != 0 && change.SiteID != siteID {
+			return false
+		}
+		if len(types) > 0 && !lo.Contains(types, change.Type) {
+			return false
+		}
+		return identity.canAccessSite(change.SiteID)
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	changes, backlog := s.Sites.Changes.Subscribe(lastEventID)
+	defer s.Sites.Changes.Unsubscribe(changes)
+	for index := range backlog {
+		if wanted(&backlog[index]) {
+			if err := writeChange(w, &backlog[index]); err != nil {
+				return
+			}
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		log.Debug().Err(err).Msg("Unable to flush event stream")
+		return
+	}
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			if !wanted(&change) {
+				continue
+			}
+			if err := writeChange(w, &change); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeChange(w http.ResponseWriter, change *net2.Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		log.Error().Err(err).Uint64("ID", change.ID).Msg("Unable to marshal change")
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.ID, change.Type, data)
+	return err
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/greboid/net2/config"
+	"github.com/rs/zerolog/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes, at most.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the listener's TLS config, reloading the certificate, key and client CA when any of the files
+// change so certificates can be rotated without a restart.  If a reload fails the previous config is kept.
+type certReloader struct {
+	conf     config.ServerTLS
+	lock     sync.Mutex
+	current  *tls.Config
+	modified time.Time
+	checked  time.Time
+}
+
+func newCertReloader(conf config.ServerTLS) (*certReloader, error) {
+	reloader := &certReloader{conf: conf}
+	modified, err := reloader.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if reloader.current, err = reloader.load(); err != nil {
+		return nil, err
+	}
+	reloader.modified = modified
+	reloader.checked = time.Now()
+	return reloader, nil
+}
+
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
+
+func (c *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.current, nil
+	}
+	c.checked = time.Now()
+	modified, err := c.lastModified()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to check TLS certificate, keeping the current certificate")
+		return c.current, nil
+	}
+	if !modified.After(c.modified) {
+		return c.current, nil
+	}
+	loaded, err := c.load()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reload TLS certificate, keeping the current certificate")
+		return c.current, nil
+	}
+	log.Info().Str("Cert", c.conf.Cert).Msg("Reloaded TLS certificate")
+	c.current = loaded
+	c.modified = modified
+	return c.current, nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.conf.Cert, c.conf.Key, c.conf.ClientCA} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.conf.Cert, c.conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tls certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+	if c.conf.ClientCA != "" {
+		pem, err := os.ReadFile(c.conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tls client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in tls client ca " + c.conf.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.conf.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
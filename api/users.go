@@ -0,0 +1,348 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/audit"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog/log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// userListParameters are the query parameters that ask for a filtered, ordered page of users rather than the map of
+// every user.
+var userListParameters = []string{"name", "localID", "department", "accessLevel", "expiresBefore", "expiresAfter",
+	"seenBefore", "seenAfter", "location", "sort", "offset", "limit", "cursor"}
+
+// renderUsers responds with the users as they are, or if any list parameters are given, the matching page of them.
+func renderUsers(w http.ResponseWriter, r *http.Request, users map[int]*net2.User) {
+	query := r.URL.Query()
+	listing := false
+	for _, parameter := range userListParameters {
+		listing = listing || query.Has(parameter)
+	}
+	if !listing {
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, users)
+		return
+	}
+	filter, err := parseUserFilter(query)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	page, err := filter.Apply(users)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, page)
+}
+
+func parseUserFilter(query url.Values) (*net2.UserFilter, error) {
+	filter := &net2.UserFilter{
+		Name:        query.Get("name"),
+		LocalID:     query.Get("localID"),
+		AccessLevel: query.Get("accessLevel"),
+		Location:    query.Get("location"),
+		Sort:        query.Get("sort"),
+		Cursor:      query.Get("cursor"),
+	}
+	numbers := []struct {
+		name  string
+		value *int
+	}{
+		{"department", &filter.DepartmentID},
+		{"offset", &filter.Offset},
+		{"limit", &filter.Limit},
+	}
+	for _, number := range numbers {
+		if value := query.Get(number.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return nil, errors.New(number.name + " must be a positive number")
+			}
+			*number.value = parsed
+		}
+	}
+	times := []struct {
+		name  string
+		value *time.Time
+	}{
+		{"expiresBefore", &filter.ExpiresBefore},
+		{"expiresAfter", &filter.ExpiresAfter},
+		{"seenBefore", &filter.SeenBefore},
+		{"seenAfter", &filter.SeenAfter},
+	}
+	for _, item := range times {
+		if value := query.Get(item.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, errors.New(item.name + " must be an RFC3339 time")
+			}
+			*item.value = parsed
+		}
+	}
+	if filter.Cursor != "" && filter.Offset != 0 {
+		return nil, errors.New("only one of offset and cursor can be used")
+	}
+	return filter, nil
+}
+
+// UserSearchData is a search sent as a request body, which is the only way to search by PIN so that PINs aren't left
+// in URLs, and so in the logs of anything between the client and the proxy.
+type UserSearchData struct {
+	Query   string `json:"q"`
+	Name    string `json:"name"`
+	LocalID string `json:"localID"`
+	GUID    string `json:"guid"`
+	PIN     string `json:"pin"`
+	Token   int64  `json:"token"`
+}
+
+func (d *UserSearchData) Bind(_ *http.Request) error {
+	if d.Query == "" && d.Name == "" && d.LocalID == "" && d.GUID == "" && d.PIN == "" && d.Token == 0 {
+		return errors.New("a search term is required")
+	}
+	return nil
+}
+
+func (s *Server) searchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("pin") {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: "pin must be sent in a POST body"})
+		return
+	}
+	search := net2.UserSearch{
+		Query:   query.Get("q"),
+		Name:    query.Get("name"),
+		LocalID: query.Get("localID"),
+		GUID:    query.Get("guid"),
+	}
+	if value := query.Get("token"); value != "" {
+		token, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, MessageResponse{Error: "token must be numeric"})
+			return
+		}
+		search.Token = token
+	}
+	if search.Empty() {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: "a search term is required"})
+		return
+	}
+	identity := GetIdentity(r.Context())
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Sites.SearchUsers(r.Context(), search, identity.canAccessSite))
+}
+
+func (s *Server) searchUsersBody(w http.ResponseWriter, r *http.Request) {
+	data := &UserSearchData{}
+	if err := render.Bind(r, data); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	identity := GetIdentity(r.Context())
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Sites.SearchUsers(r.Context(), net2.UserSearch(*data), identity.canAccessSite))
+}
+
+// ExtendExpiryData is the new expiry for every record linked to a person.
+type ExtendExpiryData struct {
+	Expiry time.Time `json:"expiry"`
+}
+
+func (d *ExtendExpiryData) Bind(_ *http.Request) error {
+	if d.Expiry.IsZero() {
+		return errors.New("missing required field expiry")
+	}
+	return nil
+}
+
+func (s *Server) getPerson(w http.ResponseWriter, r *http.Request) {
+	localID := chi.URLParam(r, "localID")
+	person := s.Sites.FindPerson(r.Context(), localID, GetIdentity(r.Context()).canAccessSite)
+	if len(person.Results) == 0 && len(person.Failed) == 0 {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "person not found"})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, person)
+}
+
+func (s *Server) activatePerson(w http.ResponseWriter, r *http.Request) {
+	s.applyToPerson(w, r, "person.activate", nil, func(ctx context.Context, site *net2.Site, userID int) error {
+		return site.ActivateUser(ctx, userID)
+	})
+}
+
+func (s *Server) deactivatePerson(w http.ResponseWriter, r *http.Request) {
+	s.applyToPerson(w, r, "person.deactivate", nil, func(ctx context.Context, site *net2.Site, userID int) error {
+		return site.DeactivateUser(ctx, userID)
+	})
+}
+
+func (s *Server) extendPerson(w http.ResponseWriter, r *http.Request) {
+	data := &ExtendExpiryData{}
+	if err := render.Bind(r, data); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	parameters := map[string]interface{}{"expiry": data.Expiry}
+	s.applyToPerson(w, r, "person.extend", parameters, func(ctx context.Context, site *net2.Site, userID int) error {
+		return site.ExtendUserExpiry(ctx, userID, data.Expiry)
+	})
+}
+
+// applyToPerson runs an action on every record linked to the person in the request, auditing each one.
+func (s *Server) applyToPerson(w http.ResponseWriter, r *http.Request, action string, parameters map[string]interface{}, apply func(ctx context.Context, site *net2.Site, userID int) error) {
+	localID := chi.URLParam(r, "localID")
+	results := s.Sites.ApplyToPerson(r.Context(), localID, GetIdentity(r.Context()).canAccessSite, apply)
+	if len(results.Results) == 0 && len(results.Failed) == 0 {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, MessageResponse{Error: "person not found"})
+		return
+	}
+	for _, result := range results.Results {
+		if result.Skipped {
+			continue
+		}
+		entryParameters := map[string]interface{}{"localID": localID}
+		maps.Copy(entryParameters, parameters)
+		s.audit(r, audit.Entry{Action: action, SiteID: result.SiteID, UserID: result.UserID, Parameters: entryParameters}, result.Err)
+	}
+	if results.Failures() {
+		render.Status(r, http.StatusMultiStatus)
+	} else {
+		render.Status(r, http.StatusOK)
+	}
+	render.JSON(w, r, results)
+}
+
+// CreateUserData is a user to create.  The picture is base64 encoded, and customFields are keyed by field name.
+type CreateUserData struct {
+	FirstName    string            `json:"firstName"`
+	LastName     string            `json:"lastName"`
+	Department   int               `json:"department"`
+	AccessLevels []int             `json:"accessLevels"`
+	Activate     time.Time         `json:"activate"`
+	Expiry       time.Time         `json:"expiry"`
+	PIN          string            `json:"pin"`
+	LocalID      string            `json:"localID"`
+	CustomFields map[string]string `json:"customFields"`
+	Picture      []byte            `json:"picture"`
+}
+
+func (d *CreateUserData) Bind(_ *http.Request) error {
+	if d.FirstName == "" {
+		return errors.New("missing required field firstName")
+	}
+	if d.LastName == "" {
+		return errors.New("missing required field lastName")
+	}
+	if !d.Expiry.IsZero() && !d.Activate.IsZero() && d.Expiry.Before(d.Activate) {
+		return errors.New("expiry must be after activate")
+	}
+	return nil
+}
+
+// CreateUserFailure is returned when Net2 created a user but setting up their department, access levels or picture,
+// or reloading them, failed.
+type CreateUserFailure struct {
+	Error  string `json:"error"`
+	UserID int    `json:"userID"`
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	data := &CreateUserData{}
+	if err := render.Bind(r, data); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+		return
+	}
+	user, err := s.Sites.GetSite(siteID).CreateUser(r.Context(), net2.NewUser{
+		FirstName:    data.FirstName,
+		LastName:     data.LastName,
+		DepartmentID: data.Department,
+		AccessLevels: data.AccessLevels,
+		Activate:     data.Activate,
+		Expiry:       data.Expiry,
+		PIN:          data.PIN,
+		LocalID:      data.LocalID,
+		CustomFields: data.CustomFields,
+		Picture:      data.Picture,
+	})
+	entry := audit.Entry{Action: "user.create", SiteID: siteID, Parameters: map[string]interface{}{
+		"firstName":    data.FirstName,
+		"lastName":     data.LastName,
+		"department":   data.Department,
+		"accessLevels": data.AccessLevels,
+		"expiry":       data.Expiry,
+		"localID":      data.LocalID,
+	}}
+	created := &net2.UserCreatedError{}
+	switch {
+	case user != nil:
+		entry.UserID = user.ID
+	case errors.As(err, &created):
+		entry.UserID = created.UserID
+	}
+	s.audit(r, entry, err)
+	switch {
+	case err == nil:
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, user)
+	case errors.Is(err, net2.ErrInvalidNewUser):
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, MessageResponse{Error: err.Error()})
+	case entry.UserID != 0:
+		log.Error().Err(err).Int("Site", siteID).Int("UserID", entry.UserID).Msg("Unable to set up new user")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, CreateUserFailure{Error: "User created, but not fully set up", UserID: entry.UserID})
+	default:
+		log.Error().Err(err).Int("Site", siteID).Msg("Unable to create user")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, MessageResponse{Error: "Error creating user"})
+	}
+}
+
+// deleteUser deletes a user, or with archive=true expires them and removes their access levels instead so their
+// history is kept.
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	siteID, _ := strconv.Atoi(chi.URLParam(r, "siteID"))
+	userID, _ := strconv.Atoi(chi.URLParam(r, "userID"))
+	archive, _ := strconv.ParseBool(r.URL.Query().Get("archive"))
+	site := s.Sites.GetSite(siteID)
+	action := "user.delete"
+	remove := site.DeleteUser
+	if archive {
+		action = "user.archive"
+		remove = site.ArchiveUser
+	}
+	user, err := remove(r.Context(), userID)
+	s.audit(r, audit.Entry{Action: action, SiteID: siteID, UserID: userID}, err)
+	if err != nil {
+		log.Error().Err(err).Int("Site", siteID).Int("UserID", userID).Msg("Unable to remove user")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, MessageResponse{Error: "Error removing user"})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, user)
+}
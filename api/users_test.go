@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/greboid/net2/audit"
+	"github.com/greboid/net2/net2"
+)
+
+func TestGetUsersFilter(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int
+	}{
+		{name: "name", query: "?name=ada", status: http.StatusOK, want: []int{1}},
+		{name: "sorted", query: "?sort=-firstName", status: http.StatusOK, want: []int{2, 1}},
+		{name: "limited", query: "?limit=1", status: http.StatusOK, want: []int{1}},
+		{name: "invalid sort", query: "?sort=height", status: http.StatusBadRequest},
+		{name: "offset and cursor", query: "?offset=1&cursor=abc", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, "/api/v1/sites/1/users"+test.query, "admin-key", "")
+			if status != test.status {
+				t.Fatalf("status = %d, want %d: %s", status, test.status, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			page := &net2.UserPage{}
+			if err := json.Unmarshal([]byte(body), page); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			got := make([]int, 0, len(page.Users))
+			for _, user := range page.Users {
+				got = append(got, user.ID)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("users = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchUsersIsScoped(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name  string
+		path  string
+		key   string
+		sites []int
+	}{
+		{name: "search", path: "/api/v1/users/search?q=ada", key: "admin-key", sites: []int{1, 2}},
+		{name: "scoped search", path: "/api/v1/users/search?q=ada", key: "reader-key", sites: []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, test.path, test.key, "")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			results := &net2.SearchResults{}
+			if err := json.Unmarshal([]byte(body), results); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if len(results.Results) != len(test.sites) {
+				t.Fatalf("results = %s, want sites %v", body, test.sites)
+			}
+			for index, result := range results.Results {
+				if result.SiteID != test.sites[index] || result.User.ID != 1 {
+					t.Errorf("result %d = site %d user %d", index, result.SiteID, result.User.ID)
+				}
+			}
+		})
+	}
+	if status, body := request(t, handler, http.MethodGet, "/api/v1/users/search", "admin-key", ""); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", status, http.StatusBadRequest, body)
+	}
+}
+
+func TestSearchUsersByPIN(t *testing.T) {
+	_, handler := newTestServer(t, func() net2.Backend {
+		backend := newTestBackend()
+		backend.AddUser(net2.UserRecord{
+			ID: 1, Firstname: "Ada", Surname: "Lovelace", LocalID: "1001", PIN: "4321", DepartmentID: 1,
+			DepartmentName: "Staff - Engineering", AccessLevelName: "All Hours", ExpiryDate: "2099-12-31T23:59:59",
+		})
+		return backend
+	})
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+		sites  []int
+	}{
+		{name: "pin in the body", method: http.MethodPost, body: `{"pin":"4321"}`, key: "admin-key", status: http.StatusOK, sites: []int{1, 2}},
+		{name: "scoped pin in the body", method: http.MethodPost, body: `{"pin":"4321"}`, key: "reader-key", status: http.StatusOK, sites: []int{1}},
+		{name: "body with a query", method: http.MethodPost, body: `{"q":"ada"}`, key: "admin-key", status: http.StatusOK, sites: []int{1, 2}},
+		{name: "empty body", method: http.MethodPost, body: `{}`, key: "admin-key", status: http.StatusBadRequest},
+		{name: "pin in the URL", method: http.MethodGet, path: "?pin=4321", key: "admin-key", status: http.StatusBadRequest},
+		{name: "query doesn't match pins", method: http.MethodGet, path: "?q=4321", key: "admin-key", status: http.StatusOK, sites: []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, test.method, "/api/v1/users/search"+test.path, test.key, test.body)
+			if status != test.status {
+				t.Fatalf("status = %d, want %d: %s", status, test.status, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			results := &net2.SearchResults{}
+			if err := json.Unmarshal([]byte(body), results); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			sites := make([]int, 0, len(results.Results))
+			for _, result := range results.Results {
+				sites = append(sites, result.SiteID)
+			}
+			if !slices.Equal(sites, test.sites) {
+				t.Errorf("results from sites %v, want %v: %s", sites, test.sites, body)
+			}
+		})
+	}
+}
+
+func TestPeopleAreScoped(t *testing.T) {
+	_, handler := newTestServer(t, defaultBackend)
+	tests := []struct {
+		name  string
+		path  string
+		key   string
+		sites []int
+	}{
+		{name: "person", path: "/api/v1/people/1001", key: "admin-key", sites: []int{1, 2}},
+		{name: "scoped person", path: "/api/v1/people/1001", key: "reader-key", sites: []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := request(t, handler, http.MethodGet, test.path, test.key, "")
+			if status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			results := &net2.SearchResults{}
+			if err := json.Unmarshal([]byte(body), results); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if len(results.Results) != len(test.sites) {
+				t.Fatalf("results = %s, want sites %v", body, test.sites)
+			}
+			for index, result := range results.Results {
+				if result.SiteID != test.sites[index] || result.User.ID != 1 {
+					t.Errorf("result %d = site %d user %d", index, result.SiteID, result.User.ID)
+				}
+			}
+		})
+	}
+	if status, body := request(t, handler, http.MethodGet, "/api/v1/people/9999", "admin-key", ""); status != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", status, http.StatusNotFound, body)
+	}
+}
+
+func TestExtendPerson(t *testing.T) {
+	server, handler := newTestServer(t, defaultBackend)
+	status, body := request(t, handler, http.MethodPost, "/api/v1/people/1002/extend", "admin-key", `{"expiry":"2030-01-01T00:00:00Z"}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	entries, err := server.Audit.Query(audit.Filter{Action: "person.extend"})
+	if err != nil {
+		t.Fatalf("querying audit log: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].Success || entries[0].Actor != "admin" || entries[0].UserID != 2 {
+		t.Errorf("audit entries = %+v", entries)
+	}
+}
+
+func TestExtendPersonPartialFailure(t *testing.T) {
+	backends := make([]*net2.FakeBackend, 0)
+	_, handler := newTestServer(t, func() net2.Backend {
+		backend := newTestBackend()
+		backends = append(backends, backend)
+		return backend
+	})
+	backends[1].SetError(errors.New("connection refused"))
+	status, body := request(t, handler, http.MethodPost, "/api/v1/people/1002/extend", "admin-key", `{"expiry":"2030-01-01T00:00:00Z"}`)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want %d: %s", status, http.StatusMultiStatus, body)
+	}
+	results := &net2.PersonActionResults{}
+	if err := json.Unmarshal([]byte(body), results); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(results.Results) != 2 || !results.Results[0].Success || results.Results[1].Success {
+		t.Errorf("results = %s", body)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		userID int
+		error  string
+		audit  bool
+	}{
+		{
+			name:   "created",
+			body:   `{"firstName":"Alan","lastName":"Turing","department":1,"accessLevels":[1],"localID":"1003"}`,
+			status: http.StatusCreated,
+			userID: 3,
+			audit:  true,
+		},
+		{
+			name:   "missing name",
+			body:   `{"lastName":"Turing"}`,
+			status: http.StatusBadRequest,
+			error:  "missing required field firstName",
+		},
+		{
+			name:   "unknown department",
+			body:   `{"firstName":"Alan","lastName":"Turing","department":9}`,
+			status: http.StatusBadRequest,
+			error:  "invalid user: department not found: 9",
+			audit:  true,
+		},
+		{
+			name:   "partially created",
+			body:   `{"firstName":"Alan","lastName":"Turing","picture":"cGljdHVyZQ=="}`,
+			status: http.StatusInternalServerError,
+			userID: 3,
+			error:  "User created, but not fully set up",
+			audit:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, handler := newTestServer(t, func() net2.Backend {
+				backend := newTestBackend()
+				backend.SetPictureError(errors.New("picture rejected by 10.0.0.1"))
+				return backend
+			})
+			status, body := request(t, handler, http.MethodPost, "/api/v1/sites/1/users", "admin-key", test.body)
+			if status != test.status {
+				t.Fatalf("status = %d, want %d: %s", status, test.status, body)
+			}
+			response := struct {
+				ID     int    `json:"id"`
+				UserID int    `json:"userID"`
+				Error  string `json:"error"`
+			}{}
+			if err := json.Unmarshal([]byte(body), &response); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if response.Error != test.error || max(response.ID, response.UserID) != test.userID {
+				t.Errorf("response = %s", body)
+			}
+			entries, err := server.Audit.Query(audit.Filter{Action: "user.create"})
+			if err != nil {
+				t.Fatalf("querying audit log: %v", err)
+			}
+			if !test.audit {
+				if len(entries) != 0 {
+					t.Errorf("audit entries = %+v, want none", entries)
+				}
+				return
+			}
+			if len(entries) != 1 || entries[0].UserID != test.userID || entries[0].Success != (test.error == "") {
+				t.Errorf("audit entries = %+v", entries)
+			}
+		})
+	}
+}
+
+func TestDeleteUserHidesUpstreamErrors(t *testing.T) {
+	backend := newTestBackend()
+	_, handler := newTestServer(t, func() net2.Backend { return backend })
+	backend.SetError(errors.New("dial tcp 10.0.0.1:8080: connection refused"))
+	status, body := request(t, handler, http.MethodDelete, "/api/v1/sites/1/users/1", "admin-key", "")
+	if status != http.StatusInternalServerError || body != `{"error":"Error removing user"}`+"\n" {
+		t.Errorf("status = %d: %s", status, body)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/webhook"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"net/http"
+)
+
+func (s *Server) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, []webhook.Attempt{})
+		return
+	}
+	identity := GetIdentity(r.Context())
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, lo.Filter(s.Webhooks.Attempts(r.URL.Query().Get("webhook")), func(item webhook.Attempt, _ int) bool {
+		return identity.canAccessSite(item.SiteID)
+	}))
+}
+
+func (s *Server) getWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.Webhooks == nil {
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, []webhook.DeadLetter{})
+		return
+	}
+	letters, err := s.Webhooks.DeadLetters(r.URL.Query().Get("webhook"))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read dead letters")
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, MessageResponse{Error: "Error reading dead letters"})
+		return
+	}
+	identity := GetIdentity(r.Context())
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, lo.Filter(letters, func(item webhook.DeadLetter, _ int) bool {
+		return identity.canAccessSite(item.Change.SiteID)
+	}))
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time       time.Time              `json:"time"`
+	RequestID  string                 `json:"requestID,omitempty"`
+	Actor      string                 `json:"actor"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty"`
+	Action     string                 `json:"action"`
+	SiteID     int                    `json:"siteID,omitempty"`
+	UserID     int                    `json:"userID,omitempty"`
+	DoorID     uint64                 `json:"doorID,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Success    bool                   `json:"success"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Filter selects audit entries.  Include, if set, decides which sites' entries can be returned, and is applied
+// before the limit.  Entries that aren't for a site are always included.
+type Filter struct {
+	From    time.Time
+	To      time.Time
+	SiteID  int
+	Actor   string
+	Action  string
+	Limit   int
+	Include func(siteID int) bool
+}
+
+func (f *Filter) matches(entry *Entry) bool {
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && entry.Time.After(f.To) {
+		return false
+	}
+	if f.SiteID != 0 && entry.SiteID != f.SiteID {
+		return false
+	}
+	if f.Actor != "" && entry.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && entry.Action != f.Action {
+		return false
+	}
+	if f.Include != nil && entry.SiteID != 0 && !f.Include(entry.SiteID) {
+		return false
+	}
+	return true
+}
+
+type Log struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+func (l *Log) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Query reads the log through its own handle, so recording isn't blocked while a large log is scanned.  An entry
+// that is still being written is skipped.
+func (l *Log) Query(filter Filter) ([]Entry, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := Entry{}
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.matches(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
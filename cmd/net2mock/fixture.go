@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"github.com/greboid/net2/net2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+)
+
+type Fixture struct {
+	Username     string         `yaml:"username"`
+	Password     string         `yaml:"password"`
+	Users        []FixtureUser  `yaml:"users"`
+	Doors        []FixtureDoor  `yaml:"doors"`
+	Departments  []FixtureItem  `yaml:"departments"`
+	AccessLevels []FixtureItem  `yaml:"accessLevels"`
+	Areas        []FixtureItem  `yaml:"areas"`
+	CustomFields []FixtureItem  `yaml:"customFields"`
+	Events       []FixtureEvent `yaml:"events"`
+}
+
+type FixtureItem struct {
+	ID   int    `yaml:"id"`
+	Name string `yaml:"name"`
+}
+
+type FixtureDoor struct {
+	ID     uint64 `yaml:"id"`
+	Name   string `yaml:"name"`
+	Status int    `yaml:"status"`
+}
+
+type FixtureUser struct {
+	ID             int     `yaml:"id"`
+	GUID           string  `yaml:"guid"`
+	FirstName      string  `yaml:"firstName"`
+	Surname        string  `yaml:"surname"`
+	ActivateDate   string  `yaml:"activateDate"`
+	ExpiryDate     string  `yaml:"expiryDate"`
+	PIN            string  `yaml:"pin"`
+	LocalID        string  `yaml:"localID"`
+	Department     int     `yaml:"department"`
+	AccessLevels   []int   `yaml:"accessLevels"`
+	Tokens         []int64 `yaml:"tokens"`
+	LastLocation   string  `yaml:"lastLocation"`
+	LastAccessTime string  `yaml:"lastAccessTime"`
+	Picture        string  `yaml:"picture"`
+	Inactive       bool    `yaml:"inactive"`
+}
+
+type FixtureEvent struct {
+	ID          int64  `yaml:"id"`
+	Date        string `yaml:"date"`
+	Type        int    `yaml:"type"`
+	Description string `yaml:"description"`
+	UserID      int    `yaml:"userID"`
+	FirstName   string `yaml:"firstName"`
+	Surname     string `yaml:"surname"`
+	Location    string `yaml:"location"`
+	Token       int64  `yaml:"token"`
+}
+
+// LoadFixture reads a YAML (or JSON, which is valid YAML) fixture file.
+func LoadFixture(file string) (*Fixture, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	if err = yaml.Unmarshal(bytes, fixture); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// Backend seeds a fake backend from the fixture, picture paths are relative to the fixture file.
+func (f *Fixture) Backend(fixtureDir string) (*net2.FakeBackend, error) {
+	backend := net2.NewFakeBackend()
+	departments := make(map[int]string)
+	for _, item := range f.Departments {
+		departments[item.ID] = item.Name
+		backend.AddDepartment(net2.Department{ID: item.ID, Name: item.Name})
+	}
+	for _, item := range f.AccessLevels {
+		backend.AddAccessLevel(net2.AccessLevel{ID: item.ID, Name: item.Name})
+	}
+	for _, item := range f.Areas {
+		backend.AddArea(net2.Area{ID: item.ID, Name: item.Name})
+	}
+	for _, item := range f.CustomFields {
+		backend.AddCustomField(net2.CustomFieldDefinition{ID: item.ID, Name: item.Name})
+	}
+	for _, door := range f.Doors {
+		backend.AddDoor(net2.Door{ID: door.ID, Name: door.Name}, door.Status)
+	}
+	for _, user := range f.Users {
+		backend.AddUser(net2.UserRecord{
+			UserGUID:       user.GUID,
+			ID:             user.ID,
+			Firstname:      user.FirstName,
+			Surname:        user.Surname,
+			ActivateDate:   user.ActivateDate,
+			ExpiryDate:     user.ExpiryDate,
+			PIN:            user.PIN,
+			LastLocation:   user.LastLocation,
+			LastAccessTime: user.LastAccessTime,
+			DepartmentID:   user.Department,
+			DepartmentName: departments[user.Department],
+			LocalID:        user.LocalID,
+		})
+		if err := backend.SetUserPermissions(context.Background(), user.ID, net2.Permission{
+			AccessLevels:          append([]int{}, user.AccessLevels...),
+			IndividualPermissions: []net2.AccessLevel{},
+		}); err != nil {
+			return nil, err
+		}
+		for _, token := range user.Tokens {
+			backend.AddToken(user.ID, token)
+		}
+		if user.Inactive {
+			backend.SetUserActive(user.ID, false)
+		}
+		if user.Picture != "" {
+			path := user.Picture
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(fixtureDir, path)
+			}
+			picture, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			backend.SetPicture(user.ID, picture)
+		}
+	}
+	for _, event := range f.Events {
+		backend.AddEvent(net2.EventRecord{
+			ID:          event.ID,
+			Date:        event.Date,
+			Type:        event.Type,
+			Description: event.Description,
+			UserID:      event.UserID,
+			FirstName:   event.FirstName,
+			Surname:     event.Surname,
+			Location:    event.Location,
+			Token:       event.Token,
+		})
+	}
+	return backend, nil
+}
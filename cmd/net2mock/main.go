@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/csmith/envflag"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	fixtureFile   = flag.String("fixture", "./fixture.yml", "Path to the YAML or JSON fixture file")
+	port          = flag.Int("port", 8080, "Port to listen on")
+	certFile      = flag.String("cert", "", "Path to a TLS certificate, serves HTTPS if set along with key")
+	keyFile       = flag.String("key", "", "Path to the TLS certificate's private key")
+	tokenLifetime = flag.Duration("token-lifetime", time.Hour, "How long issued access tokens remain valid")
+	Debug         = flag.Bool("debug", false, "Enable debug logging")
+)
+
+func main() {
+	envflag.Parse()
+	createLogger(*Debug)
+	fixture, err := LoadFixture(*fixtureFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to load fixture")
+	}
+	backend, err := fixture.Backend(filepath.Dir(*fixtureFile))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to seed fixture")
+	}
+	server := &MockServer{
+		Backend:       backend,
+		Username:      fixture.Username,
+		Password:      fixture.Password,
+		TokenLifetime: *tokenLifetime,
+	}
+	log.Info().Int("Port", *port).Int("Users", len(fixture.Users)).Int("Doors", len(fixture.Doors)).Msg("Starting net2 mock")
+	address := fmt.Sprintf("0.0.0.0:%d", *port)
+	if *certFile != "" && *keyFile != "" {
+		err = http.ListenAndServeTLS(address, *certFile, *keyFile, server.Routes())
+	} else {
+		err = http.ListenAndServe(address, server.Routes())
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("error running mock server")
+	}
+}
+
+func createLogger(debug bool) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	if debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+}
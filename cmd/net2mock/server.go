@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	usersQuery    = regexp.MustCompile(`(?i)\bFROM\s+UsersEx\b`)
+	userIDsQuery  = regexp.MustCompile(`(?i)^\s*SELECT\s+userID\s+FROM\s+UsersEx\b`)
+	devicesQuery  = regexp.MustCompile(`(?i)\bFROM\s+devices\b`)
+	eventsQuery   = regexp.MustCompile(`(?i)\bFROM\s+EventsEx\b`)
+	cardsQuery    = regexp.MustCompile(`(?i)\bFROM\s+Cards\b`)
+	cardNoWhere   = regexp.MustCompile(`(?i)\bCardNo\s*=\s*(\d+)`)
+	userIDWhere   = regexp.MustCompile(`(?i)\buserID\s*=\s*(\d+)`)
+	changedColumn = regexp.MustCompile(`(?i)\b(\w+)\s+as\s+ChangedAt\b`)
+	localIDColumn = regexp.MustCompile(`(?i)\b(\w+)\s+as\s+LocalID\b`)
+	changedSince  = regexp.MustCompile(`(?i)\bAND\s+\w+\s*>=\s*'([^']+)'`)
+	eventIDWhere  = regexp.MustCompile(`(?i)\bEventID\s*>\s*(\d+)`)
+	topClause     = regexp.MustCompile(`(?i)\bTOP\s+(\d+)`)
+)
+
+type MockServer struct {
+	Backend       *net2.FakeBackend
+	Username      string
+	Password      string
+	TokenLifetime time.Duration
+	tokenLock     sync.Mutex
+	tokens        map[string]time.Time
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (m *MockServer) Routes() http.Handler {
+	router := chi.NewRouter()
+	router.Use(middleware.RealIP)
+	router.Use(middleware.Recoverer)
+	router.Use(m.logRequest)
+	router.Post("/api/v1/authorization/tokens", m.issueToken)
+	router.Group(func(r chi.Router) {
+		r.Use(m.requireToken)
+		r.Get("/api/v1/customquery/querydb", m.customQuery)
+		r.Get("/api/v1/doors", m.getDoors)
+		r.Get("/api/v1/departments", m.getDepartments)
+		r.Get("/api/v1/accesslevels", m.getAccessLevels)
+		r.Get("/api/v1/accesslevels/areas", m.getAreas)
+		r.Get("/api/v1/users/customfieldnames", m.getCustomFields)
+		r.Post("/api/v1/users", m.createUser)
+		r.Route("/api/v1/users/{userID}", func(r chi.Router) {
+			r.Put("/", m.updateUser)
+			r.Delete("/", m.deleteUser)
+			r.Get("/image", m.getUserImage)
+			r.Put("/image", m.setUserImage)
+			r.Put("/departments", m.setUserDepartment)
+			r.Get("/doorpermissionset", m.getUserPermissions)
+			r.Put("/doorpermissionset", m.setUserPermissions)
+		})
+		r.Post("/api/v1/commands/door/open", m.openDoor)
+		r.Post("/api/v1/commands/door/close", m.closeDoor)
+		r.Post("/api/v1/commands/door/control", m.controlDoor)
+		r.Post("/api/v1/commands/antipassback/reset", m.resetAntiPassback)
+	})
+	return router
+}
+
+func (m *MockServer) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		log.Debug().Str("Method", r.Method).Str("URL", r.URL.String()).Int("Status", ww.Status()).Msg("Request")
+	})
+}
+
+func (m *MockServer) issueToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "invalid_request"})
+		return
+	}
+	if (m.Username != "" && r.PostForm.Get("username") != m.Username) ||
+		(m.Password != "" && r.PostForm.Get("password") != m.Password) {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "invalid_grant"})
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errorResponse{Error: "server_error"})
+		return
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errorResponse{Error: "server_error"})
+		return
+	}
+	m.tokenLock.Lock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for existing, expiry := range m.tokens {
+		if now.After(expiry) {
+			delete(m.tokens, existing)
+		}
+	}
+	m.tokens[token] = now.Add(m.TokenLifetime)
+	m.tokenLock.Unlock()
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, tokenResponse{
+		AccessToken:  token,
+		TokenType:    "bearer",
+		ExpiresIn:    int(m.TokenLifetime.Seconds()),
+		RefreshToken: refresh,
+	})
+}
+
+func (m *MockServer) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		m.tokenLock.Lock()
+		expiry, valid := m.tokens[token]
+		m.tokenLock.Unlock()
+		if !ok || !valid || time.Now().After(expiry) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *MockServer) customQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	switch {
+	case userIDsQuery.MatchString(query):
+		ids, err := m.Backend.ActiveUserIDs(r.Context())
+		users := make([]map[string]int, 0, len(ids))
+		for _, id := range ids {
+			users = append(users, map[string]int{"userID": id})
+		}
+		m.respond(w, r, users, err)
+	case usersQuery.MatchString(query):
+		userQuery := net2.UserQuery{}
+		if match := userIDWhere.FindStringSubmatch(query); match != nil {
+			userQuery.UserID, _ = strconv.Atoi(match[1])
+		}
+		if match := localIDColumn.FindStringSubmatch(query); match != nil {
+			userQuery.LocalIDColumn = match[1]
+		}
+		if match := changedColumn.FindStringSubmatch(query); match != nil {
+			userQuery.ChangedColumn = match[1]
+		}
+		if match := changedSince.FindStringSubmatch(query); match != nil {
+			userQuery.ChangedSince = match[1]
+		}
+		users, err := m.Backend.QueryUsers(r.Context(), userQuery)
+		m.respond(w, r, users, err)
+	case devicesQuery.MatchString(query):
+		status, err := m.Backend.DeviceStatus(r.Context())
+		devices := make([]map[string]int, 0, len(status))
+		for address, flag := range status {
+			devices = append(devices, map[string]int{"Address": address, "StatusFlag": flag})
+		}
+		m.respond(w, r, devices, err)
+	case cardsQuery.MatchString(query):
+		var token int64
+		if match := cardNoWhere.FindStringSubmatch(query); match != nil {
+			token, _ = strconv.ParseInt(match[1], 10, 64)
+		}
+		ids, err := m.Backend.TokenUsers(r.Context(), token)
+		cards := make([]map[string]int64, 0, len(ids))
+		for _, id := range ids {
+			cards = append(cards, map[string]int64{"UserID": int64(id), "CardNo": token})
+		}
+		m.respond(w, r, cards, err)
+	case eventsQuery.MatchString(query):
+		limit := 500
+		if match := topClause.FindStringSubmatch(query); match != nil {
+			limit, _ = strconv.Atoi(match[1])
+		}
+		var afterID int64
+		if match := eventIDWhere.FindStringSubmatch(query); match != nil {
+			afterID, _ = strconv.ParseInt(match[1], 10, 64)
+		}
+		events, err := m.Backend.Events(r.Context(), afterID, limit)
+		m.respond(w, r, events, err)
+	default:
+		log.Warn().Str("Query", query).Msg("Unsupported query")
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "unsupported query"})
+	}
+}
+
+func (m *MockServer) getDoors(w http.ResponseWriter, r *http.Request) {
+	doors, err := m.Backend.Doors(r.Context())
+	m.respond(w, r, doors, err)
+}
+
+func (m *MockServer) getDepartments(w http.ResponseWriter, r *http.Request) {
+	departments, err := m.Backend.Departments(r.Context())
+	m.respond(w, r, departments, err)
+}
+
+func (m *MockServer) getAccessLevels(w http.ResponseWriter, r *http.Request) {
+	accessLevels, err := m.Backend.AccessLevels(r.Context())
+	m.respond(w, r, accessLevels, err)
+}
+
+func (m *MockServer) getAreas(w http.ResponseWriter, r *http.Request) {
+	areas, err := m.Backend.Areas(r.Context())
+	m.respond(w, r, areas, err)
+}
+
+func (m *MockServer) getCustomFields(w http.ResponseWriter, r *http.Request) {
+	fields, err := m.Backend.CustomFields(r.Context())
+	m.respond(w, r, fields, err)
+}
+
+func (m *MockServer) updateUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	info := make(map[string]interface{})
+	if !decodeBody(w, r, &info) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.UpdateUser(r.Context(), userID, info))
+}
+
+func (m *MockServer) createUser(w http.ResponseWriter, r *http.Request) {
+	info := make(map[string]interface{})
+	if !decodeBody(w, r, &info) {
+		return
+	}
+	userID, err := m.Backend.CreateUser(r.Context(), info)
+	if err != nil {
+		m.respondEmpty(w, r, http.StatusCreated, err)
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, map[string]int{"id": userID})
+}
+
+func (m *MockServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusNoContent, m.Backend.DeleteUser(r.Context(), userID))
+}
+
+func (m *MockServer) setUserImage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	picture, err := io.ReadAll(r.Body)
+	if err != nil || len(picture) == 0 {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "invalid body"})
+		return
+	}
+	m.respondEmpty(w, r, http.StatusNoContent, m.Backend.SetUserPicture(r.Context(), userID, picture))
+}
+
+func (m *MockServer) getUserImage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	picture, err := m.Backend.UserPicture(r.Context(), userID)
+	if errors.Is(err, net2.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.respondEmpty(w, r, http.StatusOK, err)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(picture))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(picture)
+}
+
+func (m *MockServer) setUserDepartment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	department := &net2.Department{}
+	if !decodeBody(w, r, department) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusNoContent, m.Backend.SetUserDepartment(r.Context(), userID, department))
+}
+
+func (m *MockServer) getUserPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	permissions, err := m.Backend.UserPermissions(r.Context(), userID)
+	m.respond(w, r, permissions, err)
+}
+
+func (m *MockServer) setUserPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(w, r)
+	if !ok {
+		return
+	}
+	permissions := net2.Permission{}
+	if !decodeBody(w, r, &permissions) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.SetUserPermissions(r.Context(), userID, permissions))
+}
+
+func (m *MockServer) openDoor(w http.ResponseWriter, r *http.Request) {
+	command := struct {
+		DoorID uint64 `json:"doorId"`
+	}{}
+	if !decodeBody(w, r, &command) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.OpenDoor(r.Context(), command.DoorID))
+}
+
+func (m *MockServer) closeDoor(w http.ResponseWriter, r *http.Request) {
+	command := struct {
+		DoorID uint64 `json:"doorId"`
+	}{}
+	if !decodeBody(w, r, &command) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.CloseDoor(r.Context(), command.DoorID))
+}
+
+func (m *MockServer) controlDoor(w http.ResponseWriter, r *http.Request) {
+	command := struct {
+		DoorID        uint64 `json:"doorId"`
+		RelayFunction struct {
+			RelayID       string `json:"RelayId"`
+			RelayAction   string `json:"RelayAction"`
+			RelayOpenTime int    `json:"RelayOpenTime"`
+		} `json:"RelayFunction"`
+	}{}
+	if !decodeBody(w, r, &command) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.OpenDoorRelay(r.Context(), command.DoorID, command.RelayFunction.RelayID, command.RelayFunction.RelayOpenTime))
+}
+
+func (m *MockServer) resetAntiPassback(w http.ResponseWriter, r *http.Request) {
+	command := struct {
+		UserID int `json:"userId"`
+	}{}
+	if !decodeBody(w, r, &command) {
+		return
+	}
+	m.respondEmpty(w, r, http.StatusOK, m.Backend.ResetAntiPassback(r.Context(), command.UserID))
+}
+
+func (m *MockServer) respond(w http.ResponseWriter, r *http.Request, data interface{}, err error) {
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errorResponse{Error: err.Error()})
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, data)
+}
+
+func (m *MockServer) respondEmpty(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func getUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "invalid user ID"})
+		return 0, false
+	}
+	return userID, true
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errorResponse{Error: "invalid body"})
+		return false
+	}
+	return true
+}
+
+func randomToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
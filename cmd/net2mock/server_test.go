@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// newMockSite serves the example fixture and returns the config of a site pointing at it, logging in with password.
+func newMockSite(t *testing.T, password string) (*config.SiteConfig, *Fixture) {
+	t.Helper()
+	fixture, err := LoadFixture("fixture.example.yml")
+	if err != nil {
+		t.Fatalf("loading fixture: %v", err)
+	}
+	backend, err := fixture.Backend(".")
+	if err != nil {
+		t.Fatalf("seeding fixture: %v", err)
+	}
+	mock := &MockServer{Backend: backend, Username: fixture.Username, Password: fixture.Password, TokenLifetime: time.Hour}
+	server := httptest.NewServer(mock.Routes())
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	site := &config.SiteConfig{}
+	siteYAML := fmt.Sprintf("id: 1\nname: Mock\nusername: %s\npassword: %s\nip: %s\nport: %s\nlocalIDField: Staff Number\n",
+		fixture.Username, password, host, port)
+	if err = yaml.Unmarshal([]byte(siteYAML), site); err != nil {
+		t.Fatalf("parsing site: %v", err)
+	}
+	site.Upstream.Attempts = 1
+	if err = config.ValidateSite(site); err != nil {
+		t.Fatalf("invalid site: %v", err)
+	}
+	return site, fixture
+}
+
+func TestHTTPBackendAgainstMock(t *testing.T) {
+	site, fixture := newMockSite(t, "password")
+	logger := zerolog.Nop()
+	backend, err := net2.NewHTTPBackend(site, "client", "", "", &logger)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+	ctx := context.Background()
+	doors, err := backend.Doors(ctx)
+	if err != nil {
+		t.Fatalf("listing doors: %v", err)
+	}
+	if len(doors) != len(fixture.Doors) {
+		t.Errorf("doors = %d, want %d", len(doors), len(fixture.Doors))
+	}
+	users, err := backend.QueryUsers(ctx, net2.UserQuery{})
+	if err != nil {
+		t.Fatalf("querying users: %v", err)
+	}
+	if len(users) != len(fixture.Users) {
+		t.Errorf("users = %d, want %d", len(users), len(fixture.Users))
+	}
+}
+
+func TestHTTPBackendAgainstMockRejectsBadPasswords(t *testing.T) {
+	site, _ := newMockSite(t, "wrong")
+	logger := zerolog.Nop()
+	backend, err := net2.NewHTTPBackend(site, "client", "", "", &logger)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+	if _, err = backend.Doors(context.Background()); err == nil {
+		t.Error("listed doors without logging in")
+	}
+}
+
+func TestSiteAgainstMock(t *testing.T) {
+	site, fixture := newMockSite(t, "password")
+	logger := zerolog.Nop()
+	backend, err := net2.NewHTTPBackend(site, "client", "", "", &logger)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+	running := net2.NewSite(site, backend, &logger)
+	if err = running.Start(); err != nil {
+		t.Fatalf("starting site: %v", err)
+	}
+	t.Cleanup(running.Stop)
+	testutil.WaitFor(t, running.Ready)
+	if got := len(running.GetUsers()); got != len(fixture.Users) {
+		t.Errorf("users = %d, want %d", got, len(fixture.Users))
+	}
+	if got := len(running.GetDoors()); got != len(fixture.Doors) {
+		t.Errorf("doors = %d, want %d", got, len(fixture.Doors))
+	}
+	if running.LocalIDField == "" {
+		t.Error("local ID field wasn't found")
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"github.com/csmith/envflag"
 	"github.com/greboid/net2/api"
+	"github.com/greboid/net2/audit"
 	"github.com/greboid/net2/config"
 	"github.com/greboid/net2/net2"
+	"github.com/greboid/net2/webhook"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/lo"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
 	"syscall"
 )
@@ -19,41 +22,141 @@ import (
 var (
 	configFile = flag.String("config", "./config.yml", "Path to the config file")
 	Debug      = flag.Bool("debug", false, "Enable debug logging")
+	recordDir  = flag.String("record", "", "Record all Net2 traffic to this directory, one sub directory per site")
+	replayDir  = flag.String("replay", "", "Replay Net2 traffic from this directory instead of contacting the servers")
+	secretKey  = flag.String("secret-key", "", "Base64 or hex encoded 32 byte key used to decrypt encrypted secrets in the config")
+	keyFile    = flag.String("secret-key-file", "", "Path to a file containing the key used to decrypt encrypted secrets")
 )
 
 func main() {
 	envflag.Parse()
 	logger := createLogger(*Debug)
+	if err := loadSecretKey(); err != nil {
+		log.Fatal().Err(err).Msg("Unable to load secret key")
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal().Err(err).Msg("Command failed")
+		}
+		return
+	}
 	loadedConfig, err := config.LoadConfig(*configFile)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to load config")
 	}
-	sites := net2.GetSites(loadedConfig, logger)
-	run(sites, loadedConfig.APIPort, logger)
+	if *recordDir != "" && *replayDir != "" {
+		log.Fatal().Msg("Only one of record and replay can be used")
+	}
+	loadedConfig.RecordDir = *recordDir
+	loadedConfig.ReplayDir = *replayDir
+	if *recordDir != "" {
+		log.Warn().Str("Directory", *recordDir).Msg("Recording Net2 traffic")
+	}
+	if *replayDir != "" {
+		log.Warn().Str("Directory", *replayDir).Msg("Replaying Net2 traffic, no changes will reach Net2")
+	}
+	sites, err := net2.GetSites(loadedConfig, logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to create sites")
+	}
+	run(sites, loadedConfig, logger)
 }
 
-func run(sites []*net2.Site, apiPort int, logger *zerolog.Logger) {
+func run(sites []*net2.Site, conf *config.Config, logger *zerolog.Logger) {
 	log.Info().Msg("Starting net2 proxy")
 	log.Info().Str("Sites", strings.Join(lo.Map(sites, func(item *net2.Site, index int) string {
 		return fmt.Sprintf("%s", item.Name)
 	}), ",")).Msg("Loaded sites")
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	siteManager := &net2.SiteManager{Logger: logger}
-	err := siteManager.Start(sites)
+	siteManager := &net2.SiteManager{Logger: logger, ConfigFile: *configFile}
+	err := siteManager.Start(conf, sites)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to start sites")
 	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	go func() {
+		for range sigc {
+			reloadConfig(siteManager)
+		}
+	}()
+	if len(conf.APIKeys) == 0 && len(conf.ClientCerts) == 0 && conf.AllowUnauthenticated {
+		log.Warn().Msg("No API keys configured, the API is unauthenticated")
+	}
+	var auditLog *audit.Log
+	if conf.AuditLog != "" {
+		auditLog, err = audit.Open(conf.AuditLog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to open audit log")
+		}
+		defer func() {
+			_ = auditLog.Close()
+		}()
+	} else {
+		log.Warn().Msg("No audit log configured, changes will not be audited")
+	}
+	var dispatcher *webhook.Dispatcher
+	if len(conf.Webhooks) > 0 {
+		dispatcher, err = webhook.NewDispatcher(conf.Webhooks, conf.DeadLetterLog)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to configure webhooks")
+		}
+		dispatcher.Start(siteManager.Changes)
+		defer dispatcher.Stop()
+	}
 	ws := api.Server{
-		Sites: siteManager,
+		Sites:                siteManager,
+		APIKeys:              conf.APIKeys,
+		ClientCerts:          conf.ClientCerts,
+		Audit:                auditLog,
+		Webhooks:             dispatcher,
+		AllowUnauthenticated: conf.AllowUnauthenticated,
+	}
+	if err = ws.Init(conf, ws.GetRoutes()); err != nil {
+		log.Fatal().Err(err).Msg("Unable to start web server")
 	}
-	ws.Init(apiPort, ws.GetRoutes())
 	if err = ws.Run(); err != nil {
 		log.Error().Err(err).Msg("error running web server")
 	}
 	log.Info().Msg("Exiting.")
 }
 
+func reloadConfig(siteManager *net2.SiteManager) {
+	log.Info().Str("Config", *configFile).Msg("Reloading config")
+	newConfig, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reload config, keeping current config")
+		return
+	}
+	current := siteManager.Config()
+	newConfig.RecordDir = current.RecordDir
+	newConfig.ReplayDir = current.ReplayDir
+	if newConfig.APIPort != current.APIPort ||
+		newConfig.AuditLog != current.AuditLog || newConfig.DeadLetterLog != current.DeadLetterLog ||
+		newConfig.BindAddress != current.BindAddress || newConfig.Socket != current.Socket ||
+		newConfig.SocketMode != current.SocketMode || newConfig.TLS != current.TLS ||
+		!reflect.DeepEqual(newConfig.ClientCerts, current.ClientCerts) ||
+		newConfig.AllowUnauthenticated != current.AllowUnauthenticated ||
+		!reflect.DeepEqual(newConfig.APIKeys, current.APIKeys) || !reflect.DeepEqual(newConfig.Webhooks, current.Webhooks) {
+		log.Warn().Msg("Only site changes are reloaded, restart to apply other changes")
+	}
+	newConfig.APIPort = current.APIPort
+	newConfig.AuditLog = current.AuditLog
+	newConfig.DeadLetterLog = current.DeadLetterLog
+	newConfig.BindAddress = current.BindAddress
+	newConfig.Socket = current.Socket
+	newConfig.SocketMode = current.SocketMode
+	newConfig.TLS = current.TLS
+	newConfig.ClientCerts = current.ClientCerts
+	newConfig.APIKeys = current.APIKeys
+	newConfig.AllowUnauthenticated = current.AllowUnauthenticated
+	newConfig.Webhooks = current.Webhooks
+	if err = siteManager.Reconfigure(newConfig); err != nil {
+		log.Error().Err(err).Msg("Error reconfiguring sites, keeping the current config")
+		return
+	}
+	log.Info().Int("Sites", siteManager.Count()).Msg("Config reloaded")
+}
+
 func createLogger(debug bool) *zerolog.Logger {
 	logger := log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	log.Logger = logger
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/greboid/net2/config"
+	"io"
+	"os"
+	"strings"
+)
+
+func loadSecretKey() error {
+	if *secretKey != "" && *keyFile != "" {
+		return errors.New("only one of secret-key and secret-key-file can be used")
+	}
+	key := *secretKey
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key = strings.TrimRight(string(data), "\r\n")
+	}
+	return config.SetSecretKey(key)
+}
+
+func runCommand(args []string) error {
+	switch strings.Join(args, " ") {
+	case "config encrypt":
+		return encryptSecret(os.Stdin, os.Stdout)
+	default:
+		return fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+	}
+}
+
+// encryptSecret reads a value from the first line of input and prints it encrypted with the secret key, ready to be
+// pasted into the config.
+func encryptSecret(in io.Reader, out io.Writer) error {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	value := strings.TrimRight(line, "\r\n")
+	if value == "" {
+		return errors.New("no value to encrypt")
+	}
+	encrypted, err := config.EncryptSecret(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, encrypted)
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/greboid/net2/config"
+	"gopkg.in/yaml.v3"
+)
+
+const testSecretKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestEncryptSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		input   string
+		want    string
+		wantErr error
+	}{
+		{name: "line", key: testSecretKey, input: "password\n", want: "password"},
+		{name: "windows line ending", key: testSecretKey, input: "password\r\n", want: "password"},
+		{name: "no line ending", key: testSecretKey, input: "password", want: "password"},
+		{name: "only the first line", key: testSecretKey, input: "password\nsomething else\n", want: "password"},
+		{name: "empty", key: testSecretKey, input: "\n", wantErr: errors.New("no value to encrypt")},
+		{name: "no key", input: "password\n", wantErr: config.ErrNoSecretKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := config.SetSecretKey(test.key); err != nil {
+				t.Fatalf("setting key: %v", err)
+			}
+			t.Cleanup(func() {
+				_ = config.SetSecretKey("")
+			})
+			out := &bytes.Buffer{}
+			err := encryptSecret(strings.NewReader(test.input), out)
+			if test.wantErr != nil {
+				if err == nil || err.Error() != test.wantErr.Error() {
+					t.Errorf("error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("encrypting: %v", err)
+			}
+			encrypted := strings.TrimSuffix(out.String(), "\n")
+			if !strings.HasPrefix(encrypted, "enc:") || strings.Contains(encrypted, test.want) {
+				t.Fatalf("output = %q, want an encrypted reference", out.String())
+			}
+			var secret config.Secret
+			if err = yaml.Unmarshal([]byte(encrypted), &secret); err != nil {
+				t.Fatalf("decrypting output: %v", err)
+			}
+			if secret.Value() != test.want {
+				t.Errorf("decrypted %q, want %q", secret.Value(), test.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecretKey(t *testing.T) {
+	dir := t.TempDir()
+	validFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(validFile, []byte(testSecretKey+"\n"), 0600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+	tests := []struct {
+		name    string
+		key     string
+		file    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "key", key: testSecretKey},
+		{name: "key file", file: validFile},
+		{name: "passphrase", key: "hunter2", wantErr: true},
+		{name: "passphrase file", file: passphraseFile, wantErr: true},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "both", key: testSecretKey, file: validFile, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*secretKey, *keyFile = test.key, test.file
+			t.Cleanup(func() {
+				*secretKey, *keyFile = "", ""
+				_ = config.SetSecretKey("")
+			})
+			if err := loadSecretKey(); (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
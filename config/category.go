@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var categoryName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// compiledRegexes caches department regexes by pattern, so matching doesn't need state in the config itself.
+var compiledRegexes sync.Map
+
+// Matches reports whether the category includes a department: it matches one of the departments, or there are none
+// listed, and none of the exclusions.
+func (c Category) Matches(id int, name string) bool {
+	included := len(c.Departments) == 0
+	for _, match := range c.Departments {
+		if match.Matches(id, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, match := range c.Exclude {
+		if match.Matches(id, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m DepartmentMatch) Matches(id int, name string) bool {
+	switch {
+	case m.Prefix != "":
+		return strings.HasPrefix(name, m.Prefix)
+	case m.Exact != "":
+		return name == m.Exact
+	case m.Regex != "":
+		regex, err := compileRegex(m.Regex)
+		return err == nil && regex.MatchString(name)
+	default:
+		return m.ID != 0 && id == m.ID
+	}
+}
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := compiledRegexes.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiledRegexes.Store(pattern, regex)
+	return regex, nil
+}
+
+// FindCategory returns the site's category with the given name.
+func (s *SiteConfig) FindCategory(name string) (Category, bool) {
+	for _, category := range s.Categories {
+		if category.Name == name {
+			return category, true
+		}
+	}
+	return Category{}, false
+}
+
+func validateCategories(site *SiteConfig) error {
+	site.Categories = append(slices.Clip(site.Categories), legacyCategories(site)...)
+	seen := make(map[string]bool)
+	for _, category := range site.Categories {
+		if !categoryName.MatchString(category.Name) || category.Name == "all" {
+			return errors.New("invalid category name " + category.Name)
+		}
+		if seen[category.Name] {
+			return errors.New("duplicate category " + category.Name)
+		}
+		seen[category.Name] = true
+		for _, match := range slices.Concat(category.Departments, category.Exclude) {
+			if err := validateDepartmentMatch(match); err != nil {
+				return errors.New(err.Error() + " in category " + category.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func validateDepartmentMatch(match DepartmentMatch) error {
+	set := 0
+	for _, value := range []bool{match.Prefix != "", match.Exact != "", match.Regex != "", match.ID != 0} {
+		if value {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("department matchers need exactly one of prefix, exact, regex or id")
+	}
+	if match.Regex != "" {
+		if _, err := compileRegex(match.Regex); err != nil {
+			return errors.New("invalid department regex " + match.Regex)
+		}
+	}
+	return nil
+}
+
+// legacyCategories converts the old fixed department prefixes into categories, and clears them so the config is
+// saved in the new form.  Categories that are already defined aren't replaced.
+func legacyCategories(site *SiteConfig) []Category {
+	legacy := []struct {
+		prefix   *string
+		category Category
+	}{
+		{&site.StaffDeptPrefix, Category{Name: "staff"}},
+		{&site.CleanerDeptPrefix, Category{Name: "cleaners", IssuedAtReception: true}},
+		{&site.ContractorDeptPrefix, Category{Name: "contractors", IssuedAtReception: true}},
+		{&site.VisitorDeptPrefix, Category{Name: "visitors", IssuedAtReception: true}},
+		{&site.CustomerDeptPrefix, Category{Name: "customers", DeactivateOnLeave: true}},
+		{&site.CancelledDeptPrefix, Category{Name: "cancelled"}},
+	}
+	var categories []Category
+	for _, item := range legacy {
+		if *item.prefix == "" {
+			continue
+		}
+		if _, exists := site.FindCategory(item.category.Name); !exists {
+			item.category.Departments = []DepartmentMatch{{Prefix: *item.prefix}}
+			categories = append(categories, item.category)
+		}
+		if item.category.Name == "staff" {
+			if _, exists := site.FindCategory("nonstaff"); !exists {
+				categories = append(categories, Category{Name: "nonstaff", Exclude: []DepartmentMatch{{Prefix: *item.prefix}}})
+			}
+		}
+		*item.prefix = ""
+	}
+	return categories
+}
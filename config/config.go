@@ -1,19 +1,45 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"github.com/robfig/cron/v3"
+	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var columnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func (d *Duration) MarshalJSON() ([]byte, error) {
 	return json.Marshal(time.Duration(*d).String())
 }
 
-func (d *Duration) MarshalYAML() (interface{}, error) {
-	return time.Duration(*d).String(), nil
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	out, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(out)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
 }
 
 func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
@@ -38,28 +64,365 @@ func LoadConfig(file string) (*Config, error) {
 	if config.APIPort == 0 {
 		config.APIPort = 8000
 	}
-	if config.ClientID == "" {
+	if config.ClientID.Value() == "" {
 		return nil, errors.New("clientid is required")
 	}
-	for index := range config.Sites {
-		if config.Sites[index].Port == 0 {
-			config.Sites[index].Port = 8080
+	for index := range config.APIKeys {
+		if config.APIKeys[index].Name == "" {
+			return nil, errors.New("name is required for api keys")
+		}
+		if config.APIKeys[index].Key.Value() == "" {
+			return nil, errors.New("key is required for api key: " + config.APIKeys[index].Name)
+		}
+		if !lo.Contains(Roles, config.APIKeys[index].Role) {
+			return nil, errors.New("invalid role for api key: " + config.APIKeys[index].Name)
+		}
+		for _, group := range config.APIKeys[index].Groups {
+			if !lo.Contains(AuthGroups, group) {
+				return nil, errors.New("invalid group " + group + " for api key: " + config.APIKeys[index].Name)
+			}
+		}
+	}
+	if err = validateListener(config); err != nil {
+		return nil, err
+	}
+	if len(config.APIKeys) == 0 && len(config.ClientCerts) == 0 && !config.AllowUnauthenticated {
+		return nil, errors.New("apiKeys or clientCerts are required, or set allowUnauthenticated to run without them")
+	}
+	for index := range config.Webhooks {
+		if config.Webhooks[index].Name == "" {
+			return nil, errors.New("name is required for webhooks")
+		}
+		if config.Webhooks[index].URL == "" {
+			return nil, errors.New("url is required for webhook: " + config.Webhooks[index].Name)
 		}
-		if config.Sites[index].ID == -1 {
-			return nil, errors.New("id is required for site: " + config.Sites[index].Name)
+		if config.Webhooks[index].Secret.Value() == "" {
+			return nil, errors.New("secret is required for webhook: " + config.Webhooks[index].Name)
 		}
-		if config.Sites[index].Username == "" {
-			return nil, errors.New("username is required for site: " + config.Sites[index].Name)
+		if config.Webhooks[index].MaxAttempts == 0 {
+			config.Webhooks[index].MaxAttempts = 5
 		}
-		if config.Sites[index].Password == "" {
-			return nil, errors.New("password is required for site: " + config.Sites[index].Name)
+		if config.Webhooks[index].Timeout == 0 {
+			config.Webhooks[index].Timeout = Duration(10 * time.Second)
 		}
-		if config.Sites[index].IP == "" {
-			return nil, errors.New("ip is required for site: " + config.Sites[index].Name)
+	}
+	config.RawSites = slices.Clone(config.Sites)
+	siteIDs := make(map[int]bool, len(config.Sites))
+	for index := range config.Sites {
+		if siteIDs[config.Sites[index].ID] {
+			return nil, errors.New("duplicate id for site: " + config.Sites[index].Name)
 		}
-		if config.Sites[index].LocalIDField == "" {
-			return nil, errors.New("localIDField is required for site: " + config.Sites[index].Name)
+		siteIDs[config.Sites[index].ID] = true
+		if err = ValidateSite(&config.Sites[index]); err != nil {
+			return nil, err
 		}
 	}
 	return config, nil
 }
+
+func validateListener(config *Config) error {
+	if config.BindAddress == "" && config.Socket == "" {
+		config.BindAddress = "0.0.0.0"
+	}
+	if config.Socket != "" && config.SocketMode == "" {
+		config.SocketMode = "0660"
+	}
+	if config.SocketMode != "" {
+		if _, err := strconv.ParseUint(config.SocketMode, 8, 32); err != nil {
+			return errors.New("invalid socketMode " + config.SocketMode)
+		}
+	}
+	if (config.TLS.Cert == "") != (config.TLS.Key == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+	if config.TLS.Cert != "" && config.BindAddress == "" {
+		return errors.New("tls only applies to the TCP listener, set bindAddress to use it alongside a socket")
+	}
+	if config.TLS.ClientCA != "" && config.TLS.Cert == "" {
+		return errors.New("tls clientCA needs a cert and key")
+	}
+	for index := range config.ClientCerts {
+		client := config.ClientCerts[index]
+		if client.Subject == "" {
+			return errors.New("subject is required for client certs")
+		}
+		if client.Name == "" {
+			return errors.New("name is required for client cert: " + client.Subject)
+		}
+		if !lo.Contains(Roles, client.Role) {
+			return errors.New("invalid role for client cert: " + client.Name)
+		}
+		for _, group := range client.Groups {
+			if !lo.Contains(AuthGroups, group) {
+				return errors.New("invalid group " + group + " for client cert: " + client.Name)
+			}
+		}
+	}
+	if len(config.ClientCerts) > 0 && config.TLS.ClientCA == "" {
+		return errors.New("clientCerts need a tls clientCA")
+	}
+	return nil
+}
+
+// ValidateSite checks the required fields of a site are set, and fills in defaults for the optional ones.
+func ValidateSite(site *SiteConfig) error {
+	if site.HeldOpenAfter == 0 {
+		site.HeldOpenAfter = Duration(time.Minute)
+	}
+	if site.Port == 0 {
+		site.Port = 8080
+	}
+	if site.LegacyHttps {
+		site.Https = true
+		site.LegacyHttps = false
+	}
+	if err := validateTLS(&site.TLS); err != nil {
+		return errors.New(err.Error() + " for site: " + site.Name)
+	}
+	if err := validatePolling(&site.Polling); err != nil {
+		return errors.New(err.Error() + " for site: " + site.Name)
+	}
+	if err := validateUpstream(&site.Upstream); err != nil {
+		return errors.New(err.Error() + " for site: " + site.Name)
+	}
+	if err := validateCategories(site); err != nil {
+		return errors.New(err.Error() + " for site: " + site.Name)
+	}
+	if site.ID == -1 {
+		return errors.New("id is required for site: " + site.Name)
+	}
+	if site.Username == "" {
+		return errors.New("username is required for site: " + site.Name)
+	}
+	if site.Password.Value() == "" {
+		return errors.New("password is required for site: " + site.Name)
+	}
+	if site.IP == "" {
+		return errors.New("ip is required for site: " + site.Name)
+	}
+	if site.LocalIDField == "" {
+		return errors.New("localIDField is required for site: " + site.Name)
+	}
+	return nil
+}
+
+func validatePolling(polling *Polling) error {
+	defaults := []struct {
+		value    *Duration
+		fallback time.Duration
+	}{
+		{&polling.Doors, time.Minute},
+		{&polling.Users, time.Minute},
+		{&polling.Departments, time.Minute},
+		{&polling.AccessLevels, time.Minute},
+		{&polling.Events, 10 * time.Second},
+		{&polling.MaxBackoff, 10 * time.Minute},
+		{&polling.UsersFullSync, time.Hour},
+		{&polling.PermissionTimeout, 10 * time.Second},
+		{&polling.PermissionCache, 10 * time.Minute},
+	}
+	for _, item := range defaults {
+		if *item.value < 0 {
+			return errors.New("polling intervals can't be negative")
+		}
+		if *item.value == 0 {
+			*item.value = Duration(item.fallback)
+		}
+	}
+	if polling.PermissionWorkers < 0 {
+		return errors.New("permissionWorkers can't be negative")
+	}
+	if polling.PermissionWorkers == 0 {
+		polling.PermissionWorkers = 4
+	}
+	if polling.Jitter < 0 {
+		return errors.New("polling jitter can't be negative")
+	}
+	if polling.UsersChangedColumn != "" && !columnName.MatchString(polling.UsersChangedColumn) {
+		return errors.New("invalid usersChangedColumn " + polling.UsersChangedColumn)
+	}
+	for index := range polling.QuietHours {
+		quiet := polling.QuietHours[index]
+		if _, err := cron.ParseStandard(quiet.Start); err != nil {
+			return errors.New("invalid quiet hours start " + quiet.Start)
+		}
+		if quiet.Duration <= 0 {
+			return errors.New("duration is required for quiet hours " + quiet.Start)
+		}
+		if quiet.Interval < 0 {
+			return errors.New("quiet hours interval can't be negative")
+		}
+		for _, resource := range quiet.Resources {
+			if !lo.Contains(PolledResources, resource) {
+				return errors.New("invalid quiet hours resource " + resource)
+			}
+		}
+	}
+	return nil
+}
+
+// TLSVersions maps the accepted values of minVersion to TLS versions.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func validateTLS(conf *TLS) error {
+	if conf.MinVersion == "" {
+		conf.MinVersion = "1.2"
+	}
+	if _, ok := TLSVersions[conf.MinVersion]; !ok {
+		return errors.New("invalid tls minVersion " + conf.MinVersion)
+	}
+	if (conf.ClientCert == "") != (conf.ClientKey == "") {
+		return errors.New("tls clientCert and clientKey must be set together")
+	}
+	if conf.Fingerprint != "" {
+		if _, err := ParseFingerprint(conf.Fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseFingerprint decodes a SHA-256 certificate fingerprint written in hex, with or without colons between the bytes.
+func ParseFingerprint(fingerprint string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, errors.New("invalid tls fingerprint, expected a SHA-256 hash in hex")
+	}
+	return decoded, nil
+}
+
+func validateUpstream(upstream *Upstream) error {
+	if upstream.Timeout < 0 || upstream.RetryDelay < 0 || upstream.BreakerCooldown < 0 {
+		return errors.New("upstream durations can't be negative")
+	}
+	if upstream.Attempts < 0 || upstream.BreakerThreshold < 0 {
+		return errors.New("upstream attempts and breakerThreshold can't be negative")
+	}
+	if upstream.Timeout == 0 {
+		upstream.Timeout = Duration(30 * time.Second)
+	}
+	if upstream.Attempts == 0 {
+		upstream.Attempts = 3
+	}
+	if upstream.RetryDelay == 0 {
+		upstream.RetryDelay = Duration(500 * time.Millisecond)
+	}
+	if upstream.BreakerThreshold == 0 {
+		upstream.BreakerThreshold = 5
+	}
+	if upstream.BreakerCooldown == 0 {
+		upstream.BreakerCooldown = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// Interval returns how often a resource should be polled outside of quiet hours.
+func (p Polling) Interval(resource string) time.Duration {
+	switch resource {
+	case ResourceDoors:
+		return time.Duration(p.Doors)
+	case ResourceUsers:
+		return time.Duration(p.Users)
+	case ResourceDepartments:
+		return time.Duration(p.Departments)
+	case ResourceAccessLevels:
+		return time.Duration(p.AccessLevels)
+	case ResourceEvents:
+		return time.Duration(p.Events)
+	}
+	return time.Minute
+}
+
+// Quiet reports whether a resource is in quiet hours at the given time, and if so the slowest interval that applies.
+// An interval of zero means polling is paused.  Quiet hours apply to everything but events unless they list the
+// resources they cover.
+func (p Polling) Quiet(resource string, now time.Time) (time.Duration, bool) {
+	var interval time.Duration
+	quiet := false
+	for index := range p.QuietHours {
+		window := p.QuietHours[index]
+		if len(window.Resources) == 0 && resource == ResourceEvents {
+			continue
+		}
+		if len(window.Resources) > 0 && !lo.Contains(window.Resources, resource) {
+			continue
+		}
+		schedule, err := cron.ParseStandard(window.Start)
+		if err != nil {
+			continue
+		}
+		if schedule.Next(now.Add(-time.Duration(window.Duration))).After(now) {
+			continue
+		}
+		if window.Interval == 0 {
+			return 0, true
+		}
+		quiet = true
+		interval = max(interval, time.Duration(window.Interval))
+	}
+	return interval, quiet
+}
+
+// SaveSites replaces the sites in the config file, leaving everything else in the file, including comments, as it is.
+// The file is replaced atomically so a failed write can't leave a truncated config.
+func SaveSites(file string, sites []SiteConfig) error {
+	existing, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	document := &yaml.Node{}
+	if err = yaml.Unmarshal(existing, document); err != nil {
+		return err
+	}
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return errors.New("config file is not a mapping")
+	}
+	root := document.Content[0]
+	value := &yaml.Node{}
+	if err = value.Encode(sites); err != nil {
+		return err
+	}
+	replaced := false
+	for index := 0; index+1 < len(root.Content); index += 2 {
+		if root.Content[index].Value == "sites" {
+			root.Content[index+1] = value
+			replaced = true
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "sites"}, value)
+	}
+	data := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(data)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(document); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(temp.Name())
+	}()
+	if _, err = temp.Write(data.Bytes()); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(temp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
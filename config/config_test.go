@@ -0,0 +1,259 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadConfigRequiresCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "no credentials", config: "clientid: client\n", wantErr: true},
+		{name: "unauthenticated allowed", config: "clientid: client\nallowUnauthenticated: true\n"},
+		{name: "api key", config: "clientid: client\napiKeys:\n  - name: admin\n    key: secret\n    role: admin\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(file, []byte(test.config), 0600); err != nil {
+				t.Fatalf("writing config: %v", err)
+			}
+			if _, err := LoadConfig(file); (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigKeepsRawSites(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	site := "  - id: 1\n    name: Site\n    username: admin\n    password: password\n    ip: 127.0.0.1\n    localIDField: Staff Number\n"
+	if err := os.WriteFile(file, []byte("clientid: client\nallowUnauthenticated: true\nsites:\n"+site), 0600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	conf, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	if conf.Sites[0].Port != 8080 || conf.Sites[0].Polling.Users == 0 {
+		t.Errorf("site = %+v, want defaults filled in", conf.Sites[0])
+	}
+	if len(conf.RawSites) != 1 || conf.RawSites[0].Port != 0 || conf.RawSites[0].Polling.Users != 0 || conf.RawSites[0].TLS.MinVersion != "" {
+		t.Errorf("raw sites = %+v, want them as written", conf.RawSites)
+	}
+}
+
+const (
+	testSecretKey      = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	otherTestSecretKey = "6665656463616665666565646361666566656564636166656665656463616665"
+)
+
+// setTestSecretKey sets the secret key for the rest of the test.
+func setTestSecretKey(t *testing.T, key string) {
+	t.Helper()
+	if err := SetSecretKey(key); err != nil {
+		t.Fatalf("setting secret key: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = SetSecretKey("")
+	})
+}
+
+func TestSetSecretKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want error
+	}{
+		{name: "none", key: ""},
+		{name: "base64", key: testSecretKey},
+		{name: "hex", key: otherTestSecretKey},
+		{name: "passphrase", key: "correct horse battery staple", want: ErrInvalidSecretKey},
+		{name: "short base64", key: "MDEyMzQ1Njc4OWFiY2RlZg==", want: ErrInvalidSecretKey},
+		{name: "short hex", key: "0123456789abcdef", want: ErrInvalidSecretKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				_ = SetSecretKey("")
+			})
+			if err := SetSecretKey(test.key); !errors.Is(err, test.want) {
+				t.Errorf("error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSecretResolution(t *testing.T) {
+	setTestSecretKey(t, testSecretKey)
+	encrypted, err := EncryptSecret("encrypted password")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "secret")
+	if err = os.WriteFile(file, []byte("file password\n"), 0600); err != nil {
+		t.Fatalf("writing secret: %v", err)
+	}
+	t.Setenv("NET2_TEST_SECRET", "env password")
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", raw: "plain password", want: "plain password"},
+		{name: "environment", raw: "${env:NET2_TEST_SECRET}", want: "env password"},
+		{name: "unset environment", raw: "${env:NET2_TEST_UNSET}", wantErr: true},
+		{name: "unterminated environment is plain", raw: "${env:NET2_TEST_SECRET", want: "${env:NET2_TEST_SECRET"},
+		{name: "file", raw: "file:" + file, want: "file password"},
+		{name: "missing file", raw: "file:" + file + ".missing", wantErr: true},
+		{name: "encrypted", raw: encrypted, want: "encrypted password"},
+		{name: "corrupt encrypted", raw: "enc:not base64!", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var holder struct {
+				Password Secret `yaml:"password"`
+			}
+			node, _ := yaml.Marshal(map[string]string{"password": test.raw})
+			err := yaml.Unmarshal(node, &holder)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if holder.Password.Value() != test.want {
+				t.Errorf("value = %q, want %q", holder.Password.Value(), test.want)
+			}
+			saved, err := yaml.Marshal(holder)
+			if err != nil {
+				t.Fatalf("marshalling: %v", err)
+			}
+			var written map[string]string
+			if err = yaml.Unmarshal(saved, &written); err != nil {
+				t.Fatalf("parsing marshalled secret: %v", err)
+			}
+			if written["password"] != test.raw {
+				t.Errorf("marshalled %q, want the reference %q", written["password"], test.raw)
+			}
+		})
+	}
+}
+
+func TestEncryptedSecretNeedsTheKey(t *testing.T) {
+	setTestSecretKey(t, testSecretKey)
+	encrypted, err := EncryptSecret("password")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	var secret Secret
+	setTestSecretKey(t, otherTestSecretKey)
+	if err = yaml.Unmarshal([]byte(encrypted), &secret); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+	setTestSecretKey(t, "")
+	if err = yaml.Unmarshal([]byte(encrypted), &secret); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("error without a key = %v, want %v", err, ErrNoSecretKey)
+	}
+	if _, err = EncryptSecret("password"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("encrypting without a key = %v, want %v", err, ErrNoSecretKey)
+	}
+}
+
+func TestSecretJSON(t *testing.T) {
+	setTestSecretKey(t, testSecretKey)
+	encrypted, err := EncryptSecret("encrypted password")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	t.Setenv("NET2_TEST_SECRET", "env password")
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		err  error
+	}{
+		{name: "plain", raw: "plain password", want: "plain password"},
+		{name: "encrypted", raw: encrypted, want: "encrypted password"},
+		{name: "environment", raw: "${env:NET2_TEST_SECRET}", err: ErrSecretReference},
+		{name: "file", raw: "file:/etc/passwd", err: ErrSecretReference},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := json.Marshal(test.raw)
+			var secret Secret
+			if err := json.Unmarshal(data, &secret); !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if secret.Value() != test.want {
+				t.Errorf("value = %q, want %q", secret.Value(), test.want)
+			}
+			if marshalled, _ := json.Marshal(secret); string(marshalled) != string(data) {
+				t.Errorf("marshalled %s, want %s", marshalled, data)
+			}
+		})
+	}
+}
+
+func TestLoadConfigListeners(t *testing.T) {
+	const base = "clientid: client\nallowUnauthenticated: true\n"
+	const certs = "tls:\n  cert: cert.pem\n  key: key.pem\n"
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "default bind address", config: base},
+		{name: "socket", config: base + "socket: /run/net2.sock\n"},
+		{name: "tls", config: base + certs},
+		{name: "tls with a socket and bind address", config: base + certs + "socket: /run/net2.sock\nbindAddress: 127.0.0.1\n"},
+		{name: "tls with only a socket", config: base + certs + "socket: /run/net2.sock\n", wantErr: true},
+		{name: "client ca with only a socket", config: base + certs + "  clientCA: ca.pem\nsocket: /run/net2.sock\n", wantErr: true},
+		{name: "client ca without a cert", config: base + "tls:\n  clientCA: ca.pem\n", wantErr: true},
+		{name: "invalid socket mode", config: base + "socket: /run/net2.sock\nsocketMode: rw\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(file, []byte(test.config), 0600); err != nil {
+				t.Fatalf("writing config: %v", err)
+			}
+			if _, err := LoadConfig(file); (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenableDoorsJSON(t *testing.T) {
+	data := `{"name":"Front","sequence":[{"id":1001,"duration":"5s"},{"id":1002,"duration":"1m0s"}]}`
+	door := OpenableDoor{}
+	if err := json.Unmarshal([]byte(data), &door); err != nil {
+		t.Fatalf("unmarshalling door: %v", err)
+	}
+	want := []DoorSequence{{ID: 1001, Duration: Duration(5 * time.Second)}, {ID: 1002, Duration: Duration(time.Minute)}}
+	if door.Name != "Front" || !slices.Equal(door.Sequence, want) {
+		t.Errorf("door = %+v, want the sequence %+v", door, want)
+	}
+	marshalled, err := json.Marshal(door)
+	if err != nil {
+		t.Fatalf("marshalling door: %v", err)
+	}
+	if string(marshalled) != data {
+		t.Errorf("marshalled = %s, want %s", marshalled, data)
+	}
+}
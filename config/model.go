@@ -4,45 +4,187 @@ import (
 	"time"
 )
 
+const (
+	RoleReadOnly  = "readonly"
+	RoleReception = "reception"
+	RoleAdmin     = "admin"
+)
+
+var Roles = []string{RoleReadOnly, RoleReception, RoleAdmin}
+
+const (
+	ResourceAccessLevels = "accesslevels"
+	ResourceDoors        = "doors"
+	ResourceDepartments  = "departments"
+	ResourceUsers        = "users"
+	ResourceEvents       = "events"
+)
+
+var PolledResources = []string{ResourceAccessLevels, ResourceDoors, ResourceDepartments, ResourceUsers, ResourceEvents}
+
+var AuthGroups = []string{"sites", "accesslevels", "departments", "doors", "users", "update", "audit", "stream", "webhooks", "metrics"}
+
 type Config struct {
-	APIPort  int          `yaml:"apiport"`
-	ClientID string       `yaml:"clientid"`
-	Sites    []SiteConfig `yaml:"sites"`
+	APIPort              int          `yaml:"apiport"`
+	BindAddress          string       `yaml:"bindAddress,omitempty"`
+	Socket               string       `yaml:"socket,omitempty"`
+	SocketMode           string       `yaml:"socketMode,omitempty"`
+	TLS                  ServerTLS    `yaml:"tls,omitempty"`
+	ClientCerts          []ClientCert `yaml:"clientCerts,omitempty"`
+	ClientID             Secret       `yaml:"clientid"`
+	APIKeys              []APIKey     `yaml:"apiKeys,omitempty"`
+	AllowUnauthenticated bool         `yaml:"allowUnauthenticated,omitempty"`
+	AuditLog             string       `yaml:"auditLog,omitempty"`
+	Webhooks             []Webhook    `yaml:"webhooks,omitempty"`
+	DeadLetterLog        string       `yaml:"deadLetterLog,omitempty"`
+	Sites                []SiteConfig `yaml:"sites"`
+	// RawSites are the sites as they were written, before ValidateSite filled in their defaults, so saving them
+	// doesn't expand the config or pin today's defaults.
+	RawSites  []SiteConfig `yaml:"-"`
+	RecordDir string       `yaml:"-"`
+	ReplayDir string       `yaml:"-"`
+}
+
+type APIKey struct {
+	Name   string   `yaml:"name"`
+	Key    Secret   `yaml:"key"`
+	Role   string   `yaml:"role"`
+	Sites  []int    `yaml:"sites,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+// ServerTLS configures HTTPS for the API.  Setting ClientCA turns on mutual TLS, client certificates signed by it are
+// verified and can be mapped to identities with ClientCerts.
+type ServerTLS struct {
+	Cert              string `yaml:"cert,omitempty"`
+	Key               string `yaml:"key,omitempty"`
+	ClientCA          string `yaml:"clientCA,omitempty"`
+	RequireClientCert bool   `yaml:"requireClientCert,omitempty"`
+}
+
+// ClientCert grants a role to callers presenting a client certificate with the given subject, either the full
+// distinguished name or just the common name.
+type ClientCert struct {
+	Subject string   `yaml:"subject"`
+	Name    string   `yaml:"name"`
+	Role    string   `yaml:"role"`
+	Sites   []int    `yaml:"sites,omitempty"`
+	Groups  []string `yaml:"groups,omitempty"`
 }
 
 type SiteConfig struct {
-	ID                   int             `yaml:"id"`
-	Username             string          `yaml:"username"`
-	Password             string          `yaml:"password"`
-	Name                 string          `yaml:"name"`
-	IP                   string          `yaml:"ip"`
-	Port                 int             `yaml:"port,omitempty"`
-	Https                bool            `yaml:"http,omitempty"`
-	LocalIDField         string          `yaml:"localIDField,omitempty"`
-	StaffDeptPrefix      string          `yaml:"staffDepartmentPrefix"`
-	CleanerDeptPrefix    string          `yaml:"cleaningDepartmentPrefix"`
-	ContractorDeptPrefix string          `yaml:"contractorDepartmentsPrefix"`
-	VisitorDeptPrefix    string          `yaml:"visitorDepartmentPrefix"`
-	CustomerDeptPrefix   string          `yaml:"customerDepartmentPrefix"`
-	CancelledDeptPrefix  string          `yaml:"cancelledDepartmentPrefix"`
-	MonitoredDoors       []MonitoredDoor `yaml:"monitoredDoors"`
-	OpenableDoors        []OpenableDoor  `yaml:"openableDoors"`
+	ID                   int             `yaml:"id" json:"id"`
+	Username             string          `yaml:"username" json:"username"`
+	Password             Secret          `yaml:"password" json:"password"`
+	Name                 string          `yaml:"name" json:"name"`
+	IP                   string          `yaml:"ip" json:"ip"`
+	Port                 int             `yaml:"port,omitempty" json:"port,omitempty"`
+	Https                bool            `yaml:"https,omitempty" json:"https,omitempty"`
+	LegacyHttps          bool            `yaml:"http,omitempty" json:"http,omitempty"`
+	TLS                  TLS             `yaml:"tls,omitempty" json:"tls,omitempty"`
+	LocalIDField         string          `yaml:"localIDField,omitempty" json:"localIDField,omitempty"`
+	Categories           []Category      `yaml:"categories,omitempty" json:"categories,omitempty"`
+	StaffDeptPrefix      string          `yaml:"staffDepartmentPrefix,omitempty" json:"staffDepartmentPrefix,omitempty"`
+	CleanerDeptPrefix    string          `yaml:"cleaningDepartmentPrefix,omitempty" json:"cleaningDepartmentPrefix,omitempty"`
+	ContractorDeptPrefix string          `yaml:"contractorDepartmentsPrefix,omitempty" json:"contractorDepartmentsPrefix,omitempty"`
+	VisitorDeptPrefix    string          `yaml:"visitorDepartmentPrefix,omitempty" json:"visitorDepartmentPrefix,omitempty"`
+	CustomerDeptPrefix   string          `yaml:"customerDepartmentPrefix,omitempty" json:"customerDepartmentPrefix,omitempty"`
+	CancelledDeptPrefix  string          `yaml:"cancelledDepartmentPrefix,omitempty" json:"cancelledDepartmentPrefix,omitempty"`
+	MonitoredDoors       []MonitoredDoor `yaml:"monitoredDoors" json:"monitoredDoors"`
+	OpenableDoors        []OpenableDoor  `yaml:"openableDoors" json:"openableDoors"`
+	EventBufferSize      int             `yaml:"eventBufferSize,omitempty" json:"eventBufferSize,omitempty"`
+	HeldOpenAfter        Duration        `yaml:"heldOpenAfter,omitempty" json:"heldOpenAfter,omitempty"`
+	Polling              Polling         `yaml:"polling,omitempty" json:"polling,omitempty"`
+	Upstream             Upstream        `yaml:"upstream,omitempty" json:"upstream,omitempty"`
+}
+
+// Category is a named group of users, such as staff or visitors, made up of the users in any matching department.
+// The flags describe how the category's fobs are handled, for clients to act on.
+type Category struct {
+	Name              string            `yaml:"name" json:"name"`
+	Departments       []DepartmentMatch `yaml:"departments,omitempty" json:"departments,omitempty"`
+	Exclude           []DepartmentMatch `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	DeactivateOnLeave bool              `yaml:"deactivateOnLeave,omitempty" json:"deactivateOnLeave,omitempty"`
+	IssuedAtReception bool              `yaml:"issuedAtReception,omitempty" json:"issuedAtReception,omitempty"`
+}
+
+// DepartmentMatch matches a department by exactly one of its name prefix, exact name, a regular expression on its
+// name, or its ID.
+type DepartmentMatch struct {
+	Prefix string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	Exact  string `yaml:"exact,omitempty" json:"exact,omitempty"`
+	Regex  string `yaml:"regex,omitempty" json:"regex,omitempty"`
+	ID     int    `yaml:"id,omitempty" json:"id,omitempty"`
+}
+
+// TLS controls how a site's Net2 certificate is verified.  By default it must be signed by a CA the system trusts.
+type TLS struct {
+	CA          string `yaml:"ca,omitempty" json:"ca,omitempty"`
+	Fingerprint string `yaml:"fingerprint,omitempty" json:"fingerprint,omitempty"`
+	ClientCert  string `yaml:"clientCert,omitempty" json:"clientCert,omitempty"`
+	ClientKey   string `yaml:"clientKey,omitempty" json:"clientKey,omitempty"`
+	MinVersion  string `yaml:"minVersion,omitempty" json:"minVersion,omitempty"`
+	Insecure    bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// Upstream controls how requests to a site's Net2 server are timed out and retried.
+type Upstream struct {
+	Timeout          Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Attempts         int      `yaml:"attempts,omitempty" json:"attempts,omitempty"`
+	RetryDelay       Duration `yaml:"retryDelay,omitempty" json:"retryDelay,omitempty"`
+	BreakerThreshold int      `yaml:"breakerThreshold,omitempty" json:"breakerThreshold,omitempty"`
+	BreakerCooldown  Duration `yaml:"breakerCooldown,omitempty" json:"breakerCooldown,omitempty"`
+}
+
+// Polling controls how often each resource is fetched from Net2.
+type Polling struct {
+	Doors              Duration     `yaml:"doors,omitempty" json:"doors,omitempty"`
+	Users              Duration     `yaml:"users,omitempty" json:"users,omitempty"`
+	Departments        Duration     `yaml:"departments,omitempty" json:"departments,omitempty"`
+	AccessLevels       Duration     `yaml:"accessLevels,omitempty" json:"accessLevels,omitempty"`
+	Events             Duration     `yaml:"events,omitempty" json:"events,omitempty"`
+	Jitter             Duration     `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	MaxBackoff         Duration     `yaml:"maxBackoff,omitempty" json:"maxBackoff,omitempty"`
+	QuietHours         []QuietHours `yaml:"quietHours,omitempty" json:"quietHours,omitempty"`
+	UsersChangedColumn string       `yaml:"usersChangedColumn,omitempty" json:"usersChangedColumn,omitempty"`
+	UsersFullSync      Duration     `yaml:"usersFullSync,omitempty" json:"usersFullSync,omitempty"`
+	PermissionWorkers  int          `yaml:"permissionWorkers,omitempty" json:"permissionWorkers,omitempty"`
+	PermissionTimeout  Duration     `yaml:"permissionTimeout,omitempty" json:"permissionTimeout,omitempty"`
+	PermissionCache    Duration     `yaml:"permissionCache,omitempty" json:"permissionCache,omitempty"`
+}
+
+// QuietHours is a window, starting on a cron schedule, during which polling slows down or stops.
+type QuietHours struct {
+	Start     string   `yaml:"start" json:"start"`
+	Duration  Duration `yaml:"duration" json:"duration"`
+	Interval  Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Resources []string `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+type Webhook struct {
+	Name        string   `yaml:"name"`
+	URL         string   `yaml:"url"`
+	Secret      Secret   `yaml:"secret"`
+	Sites       []int    `yaml:"sites,omitempty"`
+	Events      []string `yaml:"events,omitempty"`
+	MaxAttempts int      `yaml:"maxAttempts,omitempty"`
+	Timeout     Duration `yaml:"timeout,omitempty"`
 }
 
 type MonitoredDoor struct {
-	ID   int    `yaml:"id"`
-	Name string `yaml:"doorName"`
-	Zone string `yaml:"zoneName"`
+	ID   int    `yaml:"id" json:"id"`
+	Name string `yaml:"doorName" json:"doorName"`
+	Zone string `yaml:"zoneName" json:"zoneName"`
 }
 
 type OpenableDoor struct {
-	Name     string         `yaml:"name"`
-	Sequence []DoorSequence `yaml:"sequence"`
+	Name     string         `yaml:"name" json:"name"`
+	Sequence []DoorSequence `yaml:"sequence" json:"sequence"`
 }
 
 type DoorSequence struct {
-	ID       int      `yaml:"id"`
-	Duration Duration `yaml:"duration"`
+	ID       int      `yaml:"id" json:"id"`
+	Duration Duration `yaml:"duration" json:"duration"`
 }
 
 type Duration time.Duration
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	envPrefix       = "${env:"
+	filePrefix      = "file:"
+	encryptedPrefix = "enc:"
+	secretKeySize   = 32
+)
+
+var (
+	ErrNoSecretKey      = errors.New("no secret key configured")
+	ErrInvalidSecretKey = errors.New("the secret key must be 32 random bytes encoded as base64 or hex")
+	ErrSecretReference  = errors.New("file and environment secrets can only be used in the config file")
+)
+
+var (
+	secretKeyLock sync.RWMutex
+	secretKey     []byte
+)
+
+// SetSecretKey sets the key used to decrypt encrypted secrets.  The key is 32 random bytes encoded as base64 or hex,
+// such as the output of `openssl rand -base64 32`, and is used as the AES-256 key as it is.  Passphrases aren't
+// accepted, as a key derived from one could be guessed offline from any encrypted secret.
+func SetSecretKey(key string) error {
+	secretKeyLock.Lock()
+	defer secretKeyLock.Unlock()
+	if key == "" {
+		secretKey = nil
+		return nil
+	}
+	decoded, err := decodeSecretKey(key)
+	if err != nil {
+		return err
+	}
+	secretKey = decoded
+	return nil
+}
+
+func decodeSecretKey(key string) ([]byte, error) {
+	if decoded, err := hex.DecodeString(key); err == nil && len(decoded) == secretKeySize {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(key); err == nil && len(decoded) == secretKeySize {
+		return decoded, nil
+	}
+	return nil, ErrInvalidSecretKey
+}
+
+func getSecretKey() []byte {
+	secretKeyLock.RLock()
+	defer secretKeyLock.RUnlock()
+	return secretKey
+}
+
+// Secret is a config value that can be written directly, or as a reference that is resolved when the config is
+// loaded: `${env:NAME}` reads an environment variable, `file:/path` reads a file, and `enc:...` decrypts a value
+// produced by EncryptSecret.  The reference is kept so saving the config never writes out the resolved value.  Only
+// the config file can refer to files and environment variables, secrets decoded from JSON must be plain or encrypted
+// so API clients can't read them from the host.
+type Secret struct {
+	value     string
+	reference string
+}
+
+// Value returns the resolved secret.
+func (s Secret) Value() string {
+	return s.value
+}
+
+func (s Secret) IsZero() bool {
+	return s.value == "" && s.reference == ""
+}
+
+func (s Secret) raw() string {
+	if s.reference != "" {
+		return s.reference
+	}
+	return s.value
+}
+
+func (s *Secret) set(raw string) error {
+	value, reference, err := resolveSecret(raw)
+	if err != nil {
+		return err
+	}
+	s.value = value
+	s.reference = reference
+	return nil
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.raw(), nil
+}
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	return s.set(value.Value)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.raw())
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if isHostReference(raw) {
+		return ErrSecretReference
+	}
+	return s.set(raw)
+}
+
+func isHostReference(raw string) bool {
+	return (strings.HasPrefix(raw, envPrefix) && strings.HasSuffix(raw, "}")) || strings.HasPrefix(raw, filePrefix)
+}
+
+// resolveSecret returns the value of a secret, and the reference it came from if it isn't a plain value.
+func resolveSecret(raw string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(raw, envPrefix) && strings.HasSuffix(raw, "}"):
+		name := strings.TrimSuffix(strings.TrimPrefix(raw, envPrefix), "}")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, raw, nil
+	case strings.HasPrefix(raw, filePrefix):
+		data, err := os.ReadFile(strings.TrimPrefix(raw, filePrefix))
+		if err != nil {
+			return "", "", fmt.Errorf("unable to read secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), raw, nil
+	case strings.HasPrefix(raw, encryptedPrefix):
+		value, err := decryptSecret(strings.TrimPrefix(raw, encryptedPrefix))
+		if err != nil {
+			return "", "", err
+		}
+		return value, raw, nil
+	default:
+		return raw, "", nil
+	}
+}
+
+// EncryptSecret encrypts a value with the secret key, returning a reference that can be used in the config.
+func EncryptSecret(value string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+	value, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret, check the secret key")
+	}
+	return string(value), nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key := getSecretKey()
+	if key == nil {
+		return nil, ErrNoSecretKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
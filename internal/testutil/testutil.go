@@ -0,0 +1,19 @@
+// Package testutil holds helpers shared by the tests of the other packages.
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+// WaitFor polls condition until it is true, failing the test if that takes longer than five seconds.
+func WaitFor(t testing.TB, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
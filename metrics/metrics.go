@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const namespace = "net2"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken to sync a resource from Net2.",
+	}, []string{"site", "resource"})
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_total",
+		Help:      "Number of syncs of a resource from Net2, by result.",
+	}, []string{"site", "resource", "result"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests made to Net2, by status code.",
+	}, []string{"site", "method", "path", "code"})
+	upstreamReauth = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_reauth_total",
+		Help:      "Number of times Net2 rejected a token and the proxy re-authenticated.",
+	}, []string{"site"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of requests to the proxy's API, by route pattern.",
+	}, []string{"method", "route", "code"})
+
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		syncDuration,
+		syncTotal,
+		upstreamDuration,
+		upstreamReauth,
+		httpDuration,
+	)
+}
+
+func ObserveSync(siteID int, resource string, start time.Time, err error) {
+	site := strconv.Itoa(siteID)
+	syncDuration.WithLabelValues(site, resource).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	syncTotal.WithLabelValues(site, resource, result).Inc()
+}
+
+// ObserveUpstream records a request to Net2, IDs in the path are replaced so each endpoint is a single series.  A
+// status code of zero means the request failed without a response.
+func ObserveUpstream(siteID int, method string, path string, status int, start time.Time) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	upstreamDuration.WithLabelValues(strconv.Itoa(siteID), method, normalisePath(path), code).Observe(time.Since(start).Seconds())
+}
+
+// normalisePath replaces every numeric segment of a path with {id}.
+func normalisePath(path string) string {
+	segments := strings.Split(path, "/")
+	for index := range segments {
+		if numericSegment.MatchString(segments[index]) {
+			segments[index] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func ObserveReauth(siteID int) {
+	upstreamReauth.WithLabelValues(strconv.Itoa(siteID)).Inc()
+}
+
+func ObserveHTTP(method string, route string, status int, start time.Time) {
+	httpDuration.WithLabelValues(method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+}
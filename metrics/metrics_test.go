@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalisePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/v1/doors", want: "/api/v1/doors"},
+		{path: "/api/v1/users/12", want: "/api/v1/users/{id}"},
+		{path: "/sites/1/users/2", want: "/sites/{id}/users/{id}"},
+		{path: "/api/v1/doors/1/2/", want: "/api/v1/doors/{id}/{id}/"},
+		{path: "/api/v1/users/12ab", want: "/api/v1/users/12ab"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if got := normalisePath(test.path); got != test.want {
+				t.Errorf("normalisePath(%s) = %s, want %s", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestObserveUpstreamUsesOneSeriesPerEndpoint(t *testing.T) {
+	ObserveUpstream(99, "GET", "/sites/1/users/2", 200, time.Now())
+	ObserveUpstream(99, "GET", "/sites/3/users/4", 200, time.Now())
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	paths := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "net2_upstream_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["site"] == "99" {
+				paths[labels["path"]] += metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if len(paths) != 1 || paths["/sites/{id}/users/{id}"] != 2 {
+		t.Errorf("paths = %v, want both requests under /sites/{id}/users/{id}", paths)
+	}
+}
@@ -0,0 +1,60 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// changedAtFormat is the format of the watermark used to fetch changed users.
+const changedAtFormat = "2006-01-02T15:04:05"
+
+var ErrNotFound = errors.New("not found")
+
+// UserQuery selects active users.  If ChangedColumn is set each record's ChangedAt holds that column's value, and
+// if ChangedSince is also set only users changed at or after it are returned.
+type UserQuery struct {
+	LocalIDColumn string
+	UserID        int
+	ChangedColumn string
+	ChangedSince  string
+}
+
+type Backend interface {
+	QueryUsers(ctx context.Context, query UserQuery) ([]*UserRecord, error)
+	ActiveUserIDs(ctx context.Context) ([]int, error)
+	UserPermissions(ctx context.Context, userID int) (*Permission, error)
+	UserPicture(ctx context.Context, userID int) ([]byte, error)
+	CustomFields(ctx context.Context) ([]*CustomFieldDefinition, error)
+	Doors(ctx context.Context) ([]*Door, error)
+	DeviceStatus(ctx context.Context) (map[int]int, error)
+	Departments(ctx context.Context) ([]*Department, error)
+	AccessLevels(ctx context.Context) ([]*AccessLevel, error)
+	Areas(ctx context.Context) ([]*Area, error)
+	Events(ctx context.Context, afterID int64, limit int) ([]*EventRecord, error)
+	OpenDoor(ctx context.Context, doorID uint64) error
+	CloseDoor(ctx context.Context, doorID uint64) error
+	OpenDoorRelay(ctx context.Context, doorID uint64, relay string, openTime int) error
+	ResetAntiPassback(ctx context.Context, userID int) error
+	UpdateUser(ctx context.Context, userID int, info map[string]interface{}) error
+	SetUserDepartment(ctx context.Context, userID int, department *Department) error
+	SetUserPermissions(ctx context.Context, userID int, permissions Permission) error
+	SetUserPicture(ctx context.Context, userID int, picture []byte) error
+	CreateUser(ctx context.Context, info map[string]interface{}) (int, error)
+	DeleteUser(ctx context.Context, userID int) error
+	TokenUsers(ctx context.Context, token int64) ([]int, error)
+}
+
+type UpstreamStatus struct {
+	Reachable   bool      `json:"reachable"`
+	LastContact time.Time `json:"lastContact"`
+	LastError   string    `json:"lastError,omitempty"`
+	TokenValid  bool      `json:"tokenValid"`
+	TokenExpiry time.Time `json:"tokenExpiry"`
+	CircuitOpen bool      `json:"circuitOpen"`
+}
+
+// StatusReporter is implemented by backends that can report on their connection to Net2.
+type StatusReporter interface {
+	UpstreamStatus() UpstreamStatus
+}
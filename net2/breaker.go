@@ -0,0 +1,64 @@
+package net2
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("net2 server unavailable")
+
+// circuitBreaker stops requests to a Net2 server after too many consecutive failures.  Once the cooldown has passed a
+// single request is let through, if it succeeds the breaker closes again, otherwise it stays open for another
+// cooldown.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+func (c *circuitBreaker) allow() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failures < c.threshold {
+		return nil
+	}
+	if c.trial || time.Since(c.openedAt) < c.cooldown {
+		return ErrCircuitOpen
+	}
+	c.trial = true
+	return nil
+}
+
+func (c *circuitBreaker) success() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trial = false
+	c.failures = 0
+}
+
+func (c *circuitBreaker) failure() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trial = false
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// release gives up a request's slot without counting it either way, for requests the caller cancelled.
+func (c *circuitBreaker) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trial = false
+}
+
+func (c *circuitBreaker) open() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.failures >= c.threshold && (c.trial || time.Since(c.openedAt) < c.cooldown)
+}
@@ -0,0 +1,222 @@
+package net2
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ChangeDoorStatus      = "door.status"
+	ChangeDoorAlarm       = "door.alarm"
+	ChangeDoorHeldOpen    = "door.heldopen"
+	ChangeUserAdded       = "user.added"
+	ChangeUserUpdated     = "user.updated"
+	ChangeUserActivated   = "user.activated"
+	ChangeUserDeactivated = "user.deactivated"
+	ChangeUnknownToken    = "token.unknown"
+	changeBufferSize      = 64
+)
+
+var ChangeTypes = []string{
+	ChangeDoorStatus,
+	ChangeDoorAlarm,
+	ChangeDoorHeldOpen,
+	ChangeUserAdded,
+	ChangeUserUpdated,
+	ChangeUserActivated,
+	ChangeUserDeactivated,
+	ChangeUnknownToken,
+}
+
+type Change struct {
+	ID     uint64      `json:"id"`
+	Type   string      `json:"type"`
+	SiteID int         `json:"siteID"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+type DoorChange struct {
+	Door                Door `json:"door"`
+	PreviousStatusFlag  int  `json:"previousStatusFlag"`
+	PreviousAlarmStatus int  `json:"previousAlarmStatus"`
+}
+
+type HeldOpenChange struct {
+	Door      Door      `json:"door"`
+	OpenSince time.Time `json:"openSince"`
+}
+
+type UserChange struct {
+	User    User     `json:"user"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+type ChangeBus struct {
+	lock        sync.Mutex
+	lastID      uint64
+	history     []Change
+	historySize int
+	subscribers map[chan Change]struct{}
+}
+
+func NewChangeBus(historySize int) *ChangeBus {
+	return &ChangeBus{
+		history:     make([]Change, 0, historySize),
+		historySize: historySize,
+		subscribers: make(map[chan Change]struct{}),
+	}
+}
+
+func (b *ChangeBus) Publish(siteID int, changeType string, data interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastID++
+	change := Change{
+		ID:     b.lastID,
+		Type:   changeType,
+		SiteID: siteID,
+		Time:   time.Now(),
+		Data:   data,
+	}
+	if len(b.history) == b.historySize {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, change)
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- change:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+func (b *ChangeBus) Subscribe(lastID uint64) (chan Change, []Change) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	backlog := make([]Change, 0)
+	if lastID > 0 {
+		for index := range b.history {
+			if b.history[index].ID > lastID {
+				backlog = append(backlog, b.history[index])
+			}
+		}
+	}
+	subscriber := make(chan Change, changeBufferSize)
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber, backlog
+}
+
+func (b *ChangeBus) Unsubscribe(subscriber chan Change) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subscribers[subscriber]; ok {
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+func (s *Site) publish(changeType string, data interface{}) {
+	if s.changes == nil {
+		return
+	}
+	s.changes.Publish(s.SiteID, changeType, data)
+}
+
+func (s *Site) publishDoorChanges(previous map[uint64]*Door, current map[uint64]*Door) {
+	s.publishHeldOpenDoors(current)
+	if len(previous) == 0 {
+		return
+	}
+	for id, door := range current {
+		old, ok := previous[id]
+		if !ok || (old.StatusFlag == door.StatusFlag && old.AlarmStatus == door.AlarmStatus) {
+			continue
+		}
+		change := DoorChange{
+			Door:                *door,
+			PreviousStatusFlag:  old.StatusFlag,
+			PreviousAlarmStatus: old.AlarmStatus,
+		}
+		s.publish(ChangeDoorStatus, change)
+		if old.AlarmStatus == 0 && door.AlarmStatus != 0 {
+			s.publish(ChangeDoorAlarm, change)
+		}
+	}
+}
+
+func (s *Site) publishHeldOpenDoors(current map[uint64]*Door) {
+	now := time.Now()
+	for id, door := range current {
+		if !door.IsOpen() {
+			delete(s.openSince, id)
+			delete(s.heldOpen, id)
+			continue
+		}
+		since, ok := s.openSince[id]
+		if !ok {
+			s.openSince[id] = now
+			continue
+		}
+		if !s.heldOpen[id] && now.Sub(since) >= time.Duration(s.getConfig().HeldOpenAfter) {
+			s.heldOpen[id] = true
+			s.publish(ChangeDoorHeldOpen, HeldOpenChange{Door: *door, OpenSince: since})
+		}
+	}
+}
+
+func (s *Site) publishAllUserChanges(previous map[int]*User, current map[int]*User) {
+	for id, user := range current {
+		s.publishUserChanges(previous[id], user)
+	}
+	for id, user := range previous {
+		if _, ok := current[id]; !ok {
+			s.publishUserChanges(user, nil)
+		}
+	}
+}
+
+// publishUserChanges publishes the differences between a user's previous and current records, where either being nil
+// means the user was added, or deleted or made inactive in Net2 and so dropped from the cache.
+func (s *Site) publishUserChanges(previous *User, current *User) {
+	if current == nil {
+		s.publish(ChangeUserDeactivated, UserChange{User: *previous})
+		return
+	}
+	if previous == nil {
+		s.publish(ChangeUserAdded, UserChange{User: *current})
+		return
+	}
+	changed := make([]string, 0)
+	if !previous.Expiry.Equal(current.Expiry) {
+		changed = append(changed, "expiry")
+	}
+	if !slices.Equal(previous.Departments, current.Departments) {
+		changed = append(changed, "department")
+	}
+	if !slices.Equal(previous.AccessLevels, current.AccessLevels) {
+		changed = append(changed, "accessLevels")
+	}
+	if previous.LastKnownLocation != current.LastKnownLocation {
+		changed = append(changed, "location")
+	}
+	if len(changed) == 0 {
+		return
+	}
+	s.publish(ChangeUserUpdated, UserChange{User: *current, Changed: changed})
+	now := time.Now()
+	wasActive := isActiveAt(previous, now)
+	isActive := isActiveAt(current, now)
+	if !wasActive && isActive {
+		s.publish(ChangeUserActivated, UserChange{User: *current})
+	} else if wasActive && !isActive {
+		s.publish(ChangeUserDeactivated, UserChange{User: *current})
+	}
+}
+
+func isActiveAt(user *User, now time.Time) bool {
+	return user.Expiry.IsZero() || user.Expiry.After(now)
+}
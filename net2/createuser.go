@@ -0,0 +1,192 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidNewUser is returned, wrapped, when a new user refers to something the site doesn't have.
+var ErrInvalidNewUser = errors.New("invalid user")
+
+// UserCreatedError is returned when Net2 created a user, but they couldn't be fully set up or reloaded afterwards.
+type UserCreatedError struct {
+	UserID int
+	Err    error
+}
+
+func (e *UserCreatedError) Error() string {
+	return fmt.Sprintf("user %d was created but %v", e.UserID, e.Err)
+}
+
+func (e *UserCreatedError) Unwrap() error {
+	return e.Err
+}
+
+// NewUser is a user to create.  CustomFields are keyed by the field's name, and LocalID is written to the site's
+// local ID field.  A zero Expiry never expires, and a zero Activate activates the user straight away.
+type NewUser struct {
+	FirstName    string
+	LastName     string
+	DepartmentID int
+	AccessLevels []int
+	Activate     time.Time
+	Expiry       time.Time
+	PIN          string
+	LocalID      string
+	CustomFields map[string]string
+	Picture      []byte
+}
+
+// CreateUser creates a user, then sets their department, access levels and picture, and returns them once they've
+// been added to the cache.  Everything is checked before the user is created, but if one of the later steps fails
+// the user will exist without it, and a UserCreatedError with their ID is returned.
+func (s *Site) CreateUser(ctx context.Context, user NewUser) (*User, error) {
+	state := s.snapshot()
+	var department *Department
+	if user.DepartmentID != 0 {
+		var ok bool
+		if department, ok = state.departments[user.DepartmentID]; !ok {
+			return nil, fmt.Errorf("%w: department not found: %d", ErrInvalidNewUser, user.DepartmentID)
+		}
+	}
+	for _, id := range user.AccessLevels {
+		if _, ok := state.accessLevels[id]; !ok {
+			return nil, fmt.Errorf("%w: access level not found: %d", ErrInvalidNewUser, id)
+		}
+	}
+	customFields, err := s.customFieldValues(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{
+		"FirstName":    user.FirstName,
+		"LastName":     user.LastName,
+		"ActivateDate": user.Activate,
+	}
+	if user.Activate.IsZero() {
+		info["ActivateDate"] = time.Now()
+	}
+	if !user.Expiry.IsZero() {
+		info["ExpiryDate"] = user.Expiry
+	}
+	if user.PIN != "" {
+		info["Pin"] = user.PIN
+	}
+	if len(customFields) > 0 {
+		info["CustomFields"] = customFields
+	}
+	userID, err := s.backend.CreateUser(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info().Int("UserID", userID).Msg("Created user")
+	if err = s.setupNewUser(ctx, userID, department, user); err != nil {
+		_ = s.UpdateUser(ctx, userID)
+		return nil, &UserCreatedError{UserID: userID, Err: err}
+	}
+	if err = s.UpdateUser(ctx, userID); err != nil {
+		return nil, &UserCreatedError{UserID: userID, Err: err}
+	}
+	created := s.GetUser(userID)
+	if created == nil {
+		return nil, &UserCreatedError{UserID: userID, Err: ErrNotFound}
+	}
+	return created, nil
+}
+
+func (s *Site) setupNewUser(ctx context.Context, userID int, department *Department, user NewUser) error {
+	if department != nil {
+		if err := s.backend.SetUserDepartment(ctx, userID, department); err != nil {
+			return err
+		}
+	}
+	if len(user.AccessLevels) > 0 {
+		s.forgetPermissions(userID)
+		permissions := Permission{AccessLevels: user.AccessLevels, IndividualPermissions: []AccessLevel{}}
+		if err := s.backend.SetUserPermissions(ctx, userID, permissions); err != nil {
+			return err
+		}
+	}
+	if len(user.Picture) > 0 {
+		if err := s.backend.SetUserPicture(ctx, userID, user.Picture); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// customFieldValues looks up the IDs of the new user's custom fields, including their local ID.
+func (s *Site) customFieldValues(ctx context.Context, user NewUser) ([]UserCustomField, error) {
+	if len(user.CustomFields) == 0 && user.LocalID == "" {
+		return nil, nil
+	}
+	if user.LocalID != "" && s.localIDFieldName == "" {
+		return nil, fmt.Errorf("%w: the site has no local ID field", ErrInvalidNewUser)
+	}
+	definitions, err := s.backend.CustomFields(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int, len(definitions))
+	for _, definition := range definitions {
+		if definition != nil {
+			ids[definition.Name] = definition.ID
+		}
+	}
+	values := make([]UserCustomField, 0, len(user.CustomFields)+1)
+	for name, value := range user.CustomFields {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: custom field not found: %s", ErrInvalidNewUser, name)
+		}
+		if name == s.localIDFieldName && user.LocalID != "" {
+			continue
+		}
+		values = append(values, UserCustomField{ID: id, Value: value})
+	}
+	if user.LocalID != "" {
+		id, ok := ids[s.localIDFieldName]
+		if !ok {
+			return nil, fmt.Errorf("%w: custom field not found: %s", ErrInvalidNewUser, s.localIDFieldName)
+		}
+		values = append(values, UserCustomField{ID: id, Value: user.LocalID})
+	}
+	return values, nil
+}
+
+// DeleteUser deletes a user from Net2 and removes them from the cache, returning the user as they were.
+func (s *Site) DeleteUser(ctx context.Context, userID int) (*User, error) {
+	user := s.GetUser(userID)
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	s.forgetPermissions(userID)
+	if err := s.backend.DeleteUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	s.logger.Info().Int("UserID", userID).Msg("Deleted user")
+	if err := s.UpdateUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ArchiveUser keeps a user in Net2 for their history, but expires them and removes their access levels.
+func (s *Site) ArchiveUser(ctx context.Context, userID int) (*User, error) {
+	if s.GetUser(userID) == nil {
+		return nil, ErrNotFound
+	}
+	if err := s.DeactivateUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := s.UpdateUserAccessLevels(ctx, userID, []int{}); err != nil {
+		return nil, err
+	}
+	archived := s.GetUser(userID)
+	if archived == nil {
+		return nil, ErrNotFound
+	}
+	return archived, nil
+}
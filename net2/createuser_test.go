@@ -0,0 +1,88 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSiteCreateUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        NewUser
+		wantErr     error
+		wantPartial bool
+	}{
+		{
+			name: "created",
+			user: NewUser{FirstName: "Alan", LastName: "Turing", DepartmentID: 1, AccessLevels: []int{2}, LocalID: "1004"},
+		},
+		{
+			name:    "unknown department",
+			user:    NewUser{FirstName: "Alan", LastName: "Turing", DepartmentID: 9},
+			wantErr: ErrInvalidNewUser,
+		},
+		{
+			name:    "unknown access level",
+			user:    NewUser{FirstName: "Alan", LastName: "Turing", AccessLevels: []int{9}},
+			wantErr: ErrInvalidNewUser,
+		},
+		{
+			name:    "unknown custom field",
+			user:    NewUser{FirstName: "Alan", LastName: "Turing", CustomFields: map[string]string{"Shoe Size": "9"}},
+			wantErr: ErrInvalidNewUser,
+		},
+		{
+			name:        "setup fails after the user is created",
+			user:        NewUser{FirstName: "Alan", LastName: "Turing", LocalID: "1004", Picture: []byte("picture")},
+			wantPartial: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newTestBackend()
+			backend.SetPictureError(errors.New("picture rejected"))
+			site := newTestSite(t, backend)
+			user, err := site.CreateUser(context.Background(), test.user)
+			partial := &UserCreatedError{}
+			switch {
+			case test.wantPartial:
+				if !errors.As(err, &partial) {
+					t.Fatalf("error = %v, want a UserCreatedError", err)
+				}
+				if created := site.GetUser(partial.UserID); created == nil || created.LocalID != "1004" {
+					t.Errorf("partially created user = %+v", created)
+				}
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("error = %v, want %v", err, test.wantErr)
+				}
+				if got := len(site.GetUsers()); got != 3 {
+					t.Errorf("users = %d, want 3", got)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("creating user: %v", err)
+				}
+				if user.ID != 4 || user.LocalID != "1004" || user.Departments[0].ID != 1 {
+					t.Errorf("user = %+v", user)
+				}
+			}
+		})
+	}
+}
+
+func TestSiteDeleteUser(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	ctx := context.Background()
+	deleted, err := site.DeleteUser(ctx, 2)
+	if err != nil {
+		t.Fatalf("deleting user: %v", err)
+	}
+	if deleted.ID != 2 || site.GetUser(2) != nil {
+		t.Errorf("deleted = %+v, still cached = %t", deleted, site.GetUser(2) != nil)
+	}
+	if _, err = site.DeleteUser(ctx, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting again = %v, want %v", err, ErrNotFound)
+	}
+}
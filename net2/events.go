@@ -0,0 +1,129 @@
+package net2
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EventTypeKnown   = "known"
+	EventTypeUnknown = "unknown"
+	eventBatchSize   = 500
+)
+
+type eventRing struct {
+	lock   sync.RWMutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func newEventRing(capacity int) *eventRing {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &eventRing{events: make([]Event, capacity)}
+}
+
+func (r *eventRing) add(events ...Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for index := range events {
+		r.events[r.next] = events[index]
+		r.next = (r.next + 1) % len(r.events)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+}
+
+func (r *eventRing) list(match func(event *Event) bool) []Event {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var ordered []Event
+	if r.full {
+		ordered = append(ordered, r.events[r.next:]...)
+	}
+	ordered = append(ordered, r.events[:r.next]...)
+	result := make([]Event, 0)
+	for index := range ordered {
+		if match(&ordered[index]) {
+			result = append(result, ordered[index])
+		}
+	}
+	return result
+}
+
+func (s *Site) GetEvents(from time.Time, to time.Time, eventType string) []Event {
+	return s.events.list(func(event *Event) bool {
+		if !from.IsZero() && event.Date.Before(from) {
+			return false
+		}
+		if !to.IsZero() && event.Date.After(to) {
+			return false
+		}
+		switch eventType {
+		case EventTypeKnown:
+			return event.Known
+		case EventTypeUnknown:
+			return !event.Known
+		}
+		return true
+	})
+}
+
+func (s *Site) GetUnknownTokens() []Event {
+	return s.GetEvents(time.Time{}, time.Time{}, EventTypeUnknown)
+}
+
+func (s *Site) UpdateEvents(ctx context.Context) error {
+	data, err := s.backend.Events(ctx, s.lastEventID, eventBatchSize)
+	if err != nil {
+		return err
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].ID < data[j].ID
+	})
+	events := make([]Event, 0, len(data))
+	for index := range data {
+		if data[index].ID > s.lastEventID {
+			s.lastEventID = data[index].ID
+		}
+		if data[index].UserID == 0 && data[index].Token == 0 {
+			continue
+		}
+		eventDate, err := time.ParseInLocation("2006-01-02T15:04:05", data[index].Date, time.Local)
+		if err != nil {
+			log.Debug().Err(err).Str("Site", s.Name).Int64("Event", data[index].ID).Msg("Discarding event with invalid date")
+			continue
+		}
+		event := Event{
+			ID:          data[index].ID,
+			Date:        eventDate,
+			Type:        data[index].Type,
+			Description: data[index].Description,
+			Location:    data[index].Location,
+			Token:       data[index].Token,
+			UserID:      data[index].UserID,
+			Known:       data[index].UserID != 0,
+		}
+		if event.Known {
+			event.UserName = data[index].FirstName + " " + data[index].Surname
+		}
+		events = append(events, event)
+	}
+	s.events.add(events...)
+	// The first poll loads the existing history, which would otherwise be published as new unknown tokens.
+	if s.eventsSeeded {
+		for index := range events {
+			if !events[index].Known {
+				s.publish(ChangeUnknownToken, events[index])
+			}
+		}
+	}
+	s.eventsSeeded = true
+	return nil
+}
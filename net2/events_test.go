@@ -0,0 +1,52 @@
+package net2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestUpdateEventsPublishesUnknownTokensAfterSeeding(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []EventRecord
+	}{
+		{name: "no history"},
+		{name: "existing history", history: []EventRecord{{ID: 1, Date: "2025-01-01T09:00:00", Token: 111}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newTestBackend()
+			for _, event := range test.history {
+				backend.AddEvent(event)
+			}
+			logger := zerolog.Nop()
+			site := NewSite(testConfig(t, 1), backend, &logger)
+			site.events = newEventRing(0)
+			site.changes = NewChangeBus(10)
+			changes, _ := site.changes.Subscribe(0)
+			ctx := context.Background()
+			if err := site.UpdateEvents(ctx); err != nil {
+				t.Fatalf("seeding events: %v", err)
+			}
+			backend.AddEvent(EventRecord{ID: 5, Date: "2025-01-01T10:00:00", Token: 222})
+			if err := site.UpdateEvents(ctx); err != nil {
+				t.Fatalf("updating events: %v", err)
+			}
+			select {
+			case change := <-changes:
+				if event, ok := change.Data.(Event); change.Type != ChangeUnknownToken || !ok || event.Token != 222 {
+					t.Errorf("change = %+v", change)
+				}
+			default:
+				t.Fatal("unknown token not published")
+			}
+			select {
+			case change := <-changes:
+				t.Errorf("unexpected change %+v", change)
+			default:
+			}
+		})
+	}
+}
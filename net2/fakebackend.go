@@ -0,0 +1,584 @@
+package net2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeTimeFormat = "2006-01-02T15:04:05"
+
+type FakeCommand struct {
+	Command string
+	DoorID  uint64
+	UserID  int
+	Relay   string
+}
+
+type FakeBackend struct {
+	lock         sync.Mutex
+	err          error
+	pictureErr   error
+	users        map[int]*UserRecord
+	inactive     map[int]bool
+	changed      map[int]time.Time
+	permissions  map[int]*Permission
+	pictures     map[int][]byte
+	customValues map[int]map[int]string
+	tokens       map[int][]int64
+	customFields []*CustomFieldDefinition
+	doors        map[uint64]*Door
+	deviceStatus map[int]int
+	departments  map[int]*Department
+	accessLevels map[int]*AccessLevel
+	areas        map[int]*Area
+	events       []*EventRecord
+	commands     []FakeCommand
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		users:        make(map[int]*UserRecord),
+		inactive:     make(map[int]bool),
+		changed:      make(map[int]time.Time),
+		permissions:  make(map[int]*Permission),
+		pictures:     make(map[int][]byte),
+		customValues: make(map[int]map[int]string),
+		tokens:       make(map[int][]int64),
+		customFields: make([]*CustomFieldDefinition, 0),
+		doors:        make(map[uint64]*Door),
+		deviceStatus: make(map[int]int),
+		departments:  make(map[int]*Department),
+		accessLevels: make(map[int]*AccessLevel),
+		areas:        make(map[int]*Area),
+		events:       make([]*EventRecord, 0),
+		commands:     make([]FakeCommand, 0),
+	}
+}
+
+func (f *FakeBackend) SetError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.err = err
+}
+
+// SetPictureError makes setting users' pictures fail with err, while everything else keeps working.
+func (f *FakeBackend) SetPictureError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pictureErr = err
+}
+
+func (f *FakeBackend) AddUser(user UserRecord) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.users[user.ID] = &user
+	f.changed[user.ID] = time.Now()
+	delete(f.inactive, user.ID)
+}
+
+func (f *FakeBackend) SetUserActive(userID int, active bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inactive[userID] = !active
+	f.changed[userID] = time.Now()
+}
+
+// SetUserChanged sets when a user was last changed, as reported to queries with a changed column.
+func (f *FakeBackend) SetUserChanged(userID int, changed time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.changed[userID] = changed
+}
+
+func (f *FakeBackend) SetPermissions(userID int, permissions Permission) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.permissions[userID] = &permissions
+}
+
+func (f *FakeBackend) SetPicture(userID int, picture []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pictures[userID] = picture
+}
+
+func (f *FakeBackend) AddToken(userID int, token int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens[userID] = append(f.tokens[userID], token)
+}
+
+func (f *FakeBackend) AddCustomField(field CustomFieldDefinition) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.customFields = append(f.customFields, &field)
+}
+
+func (f *FakeBackend) AddDoor(door Door, status int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.doors[door.ID] = &door
+	f.deviceStatus[int(door.ID)] = status
+}
+
+func (f *FakeBackend) SetDoorStatus(doorID uint64, status int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.deviceStatus[int(doorID)] = status
+}
+
+func (f *FakeBackend) AddDepartment(department Department) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.departments[department.ID] = &department
+}
+
+func (f *FakeBackend) AddAccessLevel(accessLevel AccessLevel) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.accessLevels[accessLevel.ID] = &accessLevel
+}
+
+func (f *FakeBackend) AddArea(area Area) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.areas[area.ID] = &area
+}
+
+func (f *FakeBackend) AddEvent(event EventRecord) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.events = append(f.events, &event)
+}
+
+func (f *FakeBackend) Commands() []FakeCommand {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]FakeCommand{}, f.commands...)
+}
+
+func (f *FakeBackend) QueryUsers(_ context.Context, query UserQuery) ([]*UserRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	var since time.Time
+	if query.ChangedColumn != "" && query.ChangedSince != "" {
+		var err error
+		if since, err = time.ParseInLocation(fakeTimeFormat, query.ChangedSince, time.Local); err != nil {
+			return nil, err
+		}
+	}
+	users := make([]*UserRecord, 0)
+	for id, user := range f.users {
+		if f.inactive[id] || (query.UserID != 0 && query.UserID != id) {
+			continue
+		}
+		changed := f.changed[id].Truncate(time.Second)
+		if changed.Before(since) {
+			continue
+		}
+		record := *user
+		var fieldID int
+		if _, err := fmt.Sscanf(query.LocalIDColumn, "Field%d_", &fieldID); err == nil {
+			if value, ok := f.customValues[id][fieldID]; ok {
+				record.LocalID = value
+			}
+		}
+		if query.ChangedColumn != "" {
+			record.ChangedAt = changed.Format(fakeTimeFormat)
+		}
+		users = append(users, &record)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+func (f *FakeBackend) ActiveUserIDs(_ context.Context) ([]int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	ids := make([]int, 0, len(f.users))
+	for id := range f.users {
+		if !f.inactive[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (f *FakeBackend) UserPermissions(_ context.Context, userID int) (*Permission, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	permissions, ok := f.permissions[userID]
+	if !ok {
+		return &Permission{AccessLevels: []int{}, IndividualPermissions: []AccessLevel{}}, nil
+	}
+	copied := *permissions
+	return &copied, nil
+}
+
+func (f *FakeBackend) UserPicture(_ context.Context, userID int) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, ok := f.users[userID]; !ok {
+		return nil, errors.New("user not found")
+	}
+	picture, ok := f.pictures[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return picture, nil
+}
+
+func (f *FakeBackend) CustomFields(_ context.Context) ([]*CustomFieldDefinition, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]*CustomFieldDefinition{}, f.customFields...), nil
+}
+
+func (f *FakeBackend) Doors(_ context.Context) ([]*Door, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	doors := make([]*Door, 0, len(f.doors))
+	for _, door := range f.doors {
+		doors = append(doors, &Door{ID: door.ID, Name: door.Name})
+	}
+	return doors, nil
+}
+
+func (f *FakeBackend) DeviceStatus(_ context.Context) (map[int]int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	status := make(map[int]int, len(f.deviceStatus))
+	for id, flag := range f.deviceStatus {
+		status[id] = flag
+	}
+	return status, nil
+}
+
+func (f *FakeBackend) Departments(_ context.Context) ([]*Department, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	departments := make([]*Department, 0, len(f.departments))
+	for _, department := range f.departments {
+		copied := *department
+		departments = append(departments, &copied)
+	}
+	return departments, nil
+}
+
+func (f *FakeBackend) AccessLevels(_ context.Context) ([]*AccessLevel, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	accessLevels := make([]*AccessLevel, 0, len(f.accessLevels))
+	for _, accessLevel := range f.accessLevels {
+		copied := *accessLevel
+		accessLevels = append(accessLevels, &copied)
+	}
+	return accessLevels, nil
+}
+
+func (f *FakeBackend) Areas(_ context.Context) ([]*Area, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	areas := make([]*Area, 0, len(f.areas))
+	for _, area := range f.areas {
+		copied := *area
+		areas = append(areas, &copied)
+	}
+	return areas, nil
+}
+
+func (f *FakeBackend) Events(_ context.Context, afterID int64, limit int) ([]*EventRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	events := make([]*EventRecord, 0)
+	if afterID == 0 {
+		for index := len(f.events) - 1; index >= 0 && len(events) < limit; index-- {
+			copied := *f.events[index]
+			events = append(events, &copied)
+		}
+		return events, nil
+	}
+	for index := range f.events {
+		if f.events[index].ID > afterID && len(events) < limit {
+			copied := *f.events[index]
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+func (f *FakeBackend) doorCommand(command string, doorID uint64, relay string, open bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if _, ok := f.doors[doorID]; !ok {
+		return fmt.Errorf("unable to %s door", command)
+	}
+	f.commands = append(f.commands, FakeCommand{Command: command, DoorID: doorID, Relay: relay})
+	if open {
+		f.deviceStatus[int(doorID)] |= DoorStatus_DoorOpen
+	} else {
+		f.deviceStatus[int(doorID)] &^= DoorStatus_DoorOpen
+	}
+	return nil
+}
+
+func (f *FakeBackend) OpenDoor(_ context.Context, doorID uint64) error {
+	return f.doorCommand("open", doorID, "", true)
+}
+
+func (f *FakeBackend) CloseDoor(_ context.Context, doorID uint64) error {
+	return f.doorCommand("close", doorID, "", false)
+}
+
+func (f *FakeBackend) OpenDoorRelay(_ context.Context, doorID uint64, relay string, openTime int) error {
+	if err := f.doorCommand("relay", doorID, relay, true); err != nil {
+		return err
+	}
+	time.AfterFunc(time.Duration(openTime)*time.Millisecond, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.deviceStatus[int(doorID)] &^= DoorStatus_DoorOpen
+	})
+	return nil
+}
+
+func (f *FakeBackend) ResetAntiPassback(_ context.Context, userID int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if _, ok := f.users[userID]; !ok {
+		return errors.New("unable to reset anti passback")
+	}
+	f.commands = append(f.commands, FakeCommand{Command: "resetantipassback", UserID: userID})
+	return nil
+}
+
+func (f *FakeBackend) UpdateUser(_ context.Context, userID int, info map[string]interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	user, ok := f.users[userID]
+	if !ok {
+		return errors.New("unable to update user")
+	}
+	if err := f.applyUserInfo(user, info); err != nil {
+		return err
+	}
+	f.changed[userID] = time.Now()
+	return nil
+}
+
+func (f *FakeBackend) CreateUser(_ context.Context, info map[string]interface{}) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	userID := 1
+	for id := range f.users {
+		userID = max(userID, id+1)
+	}
+	guid := make([]byte, 16)
+	_, _ = rand.Read(guid)
+	user := &UserRecord{
+		ID:       userID,
+		UserGUID: fmt.Sprintf("%x-%x-%x-%x-%x", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:]),
+	}
+	if err := f.applyUserInfo(user, info); err != nil || (user.Firstname == "" && user.Surname == "") {
+		delete(f.customValues, userID)
+		return 0, errors.New("unable to create user")
+	}
+	f.users[userID] = user
+	f.changed[userID] = time.Now()
+	return userID, nil
+}
+
+func (f *FakeBackend) DeleteUser(_ context.Context, userID int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if _, ok := f.users[userID]; !ok || f.inactive[userID] {
+		return errors.New("unable to delete user")
+	}
+	f.inactive[userID] = true
+	f.changed[userID] = time.Now()
+	return nil
+}
+
+func (f *FakeBackend) SetUserPicture(_ context.Context, userID int, picture []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.pictureErr != nil {
+		return f.pictureErr
+	}
+	if _, ok := f.users[userID]; !ok {
+		return errors.New("unable to update user picture")
+	}
+	f.pictures[userID] = picture
+	f.changed[userID] = time.Now()
+	return nil
+}
+
+func (f *FakeBackend) TokenUsers(_ context.Context, token int64) ([]int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	ids := make([]int, 0)
+	for id, tokens := range f.tokens {
+		if slices.Contains(tokens, token) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// applyUserInfo sets the fields Net2 accepts when creating or updating a user.
+func (f *FakeBackend) applyUserInfo(user *UserRecord, info map[string]interface{}) error {
+	for key, value := range info {
+		switch key {
+		case "FirstName":
+			user.Firstname = fmt.Sprint(value)
+		case "LastName":
+			user.Surname = fmt.Sprint(value)
+		case "Pin":
+			user.PIN = fmt.Sprint(value)
+		case "ExpiryDate":
+			user.ExpiryDate = fakeTime(value)
+		case "ActivateDate":
+			user.ActivateDate = fakeTime(value)
+		case "CustomFields":
+			fields := make([]UserCustomField, 0)
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(data, &fields); err != nil {
+				return errors.New("invalid custom fields")
+			}
+			if f.customValues[user.ID] == nil {
+				f.customValues[user.ID] = make(map[int]string)
+			}
+			for _, field := range fields {
+				f.customValues[user.ID][field.ID] = field.Value
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) SetUserDepartment(_ context.Context, userID int, department *Department) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	user, ok := f.users[userID]
+	if !ok {
+		return errors.New("unable to update user department")
+	}
+	user.DepartmentID = department.ID
+	user.DepartmentName = department.Name
+	f.changed[userID] = time.Now()
+	return nil
+}
+
+func (f *FakeBackend) SetUserPermissions(_ context.Context, userID int, permissions Permission) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	user, ok := f.users[userID]
+	if !ok {
+		return errors.New("unable to update user access level")
+	}
+	f.permissions[userID] = &permissions
+	names := make([]string, 0)
+	for _, id := range permissions.AccessLevels {
+		if level, ok := f.accessLevels[id]; ok {
+			names = append(names, level.Name)
+		}
+	}
+	switch {
+	case len(names) == 1 && len(permissions.IndividualPermissions) == 0:
+		user.AccessLevelName = names[0]
+	case len(names) == 0 && len(permissions.IndividualPermissions) == 0:
+		user.AccessLevelName = ""
+	default:
+		user.AccessLevelName = "Individual: " + strings.Join(names, ", ")
+	}
+	f.changed[userID] = time.Now()
+	return nil
+}
+
+func fakeTime(value interface{}) string {
+	switch typed := value.(type) {
+	case time.Time:
+		return typed.Format(fakeTimeFormat)
+	case string:
+		if parsed, err := time.Parse(time.RFC3339, typed); err == nil {
+			return parsed.Format(fakeTimeFormat)
+		}
+		return typed
+	}
+	return fmt.Sprint(value)
+}
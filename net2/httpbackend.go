@@ -0,0 +1,543 @@
+package net2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/metrics"
+	"github.com/rs/zerolog"
+	"github.com/samber/lo"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JsonContentType = "application/json"
+	eventColumns    = "EventID, EventDate, EventType, EventDescription, UserID, FirstName, Surname, DeviceName, CardNo"
+	// maxRetryAfter is the longest a request waits when Net2 asks it to slow down, rather than giving up.
+	maxRetryAfter = 10 * time.Second
+)
+
+type httpBackend struct {
+	siteID     int
+	logger     *zerolog.Logger
+	baseURL    string
+	clientID   string
+	username   string
+	password   string
+	transport  http.RoundTripper
+	upstream   config.Upstream
+	breaker    *circuitBreaker
+	clientLock sync.RWMutex
+	httpClient *http.Client
+	statusLock sync.Mutex
+	status     UpstreamStatus
+}
+
+// trackingTokenSource records the outcome of every token request so the backend can report whether it holds a
+// valid token.
+type trackingTokenSource struct {
+	source  oauth2.TokenSource
+	backend *httpBackend
+}
+
+func (t *trackingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := t.source.Token()
+	t.backend.statusLock.Lock()
+	defer t.backend.statusLock.Unlock()
+	if err != nil {
+		t.backend.status.TokenValid = false
+		t.backend.status.LastError = err.Error()
+	} else {
+		t.backend.status.TokenValid = token.Valid()
+		t.backend.status.TokenExpiry = token.Expiry
+	}
+	return token, err
+}
+
+// NewHTTPBackend creates a backend talking to the Net2 server in conf.  If recordDir is set all traffic is written to
+// it, if replayDir is set responses are served from it instead of the network.
+func NewHTTPBackend(conf *config.SiteConfig, clientID string, recordDir string, replayDir string, logger *zerolog.Logger) (Backend, error) {
+	var baseURL string
+	if conf.Https {
+		baseURL = fmt.Sprintf("https://%s:%d", conf.IP, conf.Port)
+	} else {
+		baseURL = fmt.Sprintf("http://%s:%d", conf.IP, conf.Port)
+	}
+	tlsConfig, err := newTLSConfig(&conf.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Https && conf.TLS.Insecure {
+		logger.Warn().Str("Site", conf.Name).Msg("TLS certificate verification is disabled")
+	}
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if replayDir != "" {
+		if transport, err = NewReplayer(replayDir); err != nil {
+			return nil, err
+		}
+	} else if recordDir != "" {
+		if transport, err = NewRecorder(transport, recordDir); err != nil {
+			return nil, err
+		}
+	}
+	backend := &httpBackend{
+		siteID:    conf.ID,
+		logger:    logger,
+		baseURL:   baseURL,
+		clientID:  clientID,
+		username:  conf.Username,
+		password:  conf.Password.Value(),
+		transport: transport,
+		upstream:  conf.Upstream,
+		breaker: &circuitBreaker{
+			threshold: conf.Upstream.BreakerThreshold,
+			cooldown:  time.Duration(conf.Upstream.BreakerCooldown),
+		},
+	}
+	backend.httpClient = backend.getHttpClient()
+	return backend, nil
+}
+
+func (b *httpBackend) getHttpClient() *http.Client {
+	oauthConfig := clientcredentials.Config{
+		ClientID: b.clientID,
+		TokenURL: fmt.Sprintf("%s/api/v1/authorization/tokens", b.baseURL),
+		EndpointParams: url.Values{
+			"username":   {b.username},
+			"password":   {b.password},
+			"grant_type": {"password"},
+			"scope":      {"offline_access"},
+		},
+	}
+	sslcli := &http.Client{Transport: b.transport}
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, sslcli)
+	httpClient := oauth2.NewClient(ctx, &trackingTokenSource{source: oauthConfig.TokenSource(ctx), backend: b})
+	return httpClient
+}
+
+type singleAttemptKey struct{}
+
+// withSingleAttempt returns a context whose requests aren't retried, for callers that would rather fail quickly.
+func withSingleAttempt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, singleAttemptKey{}, true)
+}
+
+// doRequest sends a request to Net2, giving each attempt the site's timeout.  Requests are retried once with a new
+// token if Net2 rejects the current one, and GETs are also retried after network errors, gateway errors and 429s,
+// unless the context was made by withSingleAttempt.  A 429 is retried no sooner than its Retry-After, and not at all
+// if that is longer than maxRetryAfter.  Only network errors and gateway errors count towards the circuit breaker,
+// any other response, including a 429, shows the server is up.  While the breaker is open requests fail straight away
+// with ErrCircuitOpen.
+func (b *httpBackend) doRequest(ctx context.Context, method string, url string, contentType string, body []byte) (*http.Response, error) {
+	if err := b.breaker.allow(); err != nil {
+		return nil, err
+	}
+	attempts := 1
+	if method == http.MethodGet && ctx.Value(singleAttemptKey{}) == nil {
+		attempts = max(b.upstream.Attempts, 1)
+	}
+	var resp *http.Response
+	var err error
+	var retryAfter time.Duration
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := max(time.Duration(b.upstream.RetryDelay)<<(attempt-1), retryAfter)
+			select {
+			case <-ctx.Done():
+				b.breaker.release()
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			b.logger.Debug().Err(err).Str("URL", url).Int("Attempt", attempt+1).Msg("Retrying request")
+		}
+		resp, err = b.attempt(ctx, method, url, contentType, body)
+		if ctx.Err() != nil {
+			b.breaker.release()
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			b.breaker.success()
+			return resp, nil
+		}
+		retryAfter = 0
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			if retryAfter > maxRetryAfter {
+				break
+			}
+		}
+		if err == nil && attempt < attempts-1 {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		b.breaker.success()
+	} else {
+		b.breaker.failure()
+	}
+	return resp, err
+}
+
+// parseRetryAfter returns how long a Retry-After header asks to wait, given either as seconds or as a date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// attempt sends a single request, re-authenticating and trying again if Net2 rejects the token.
+func (b *httpBackend) attempt(ctx context.Context, method string, url string, contentType string, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	for tryReauth := 2; tryReauth > 0; tryReauth-- {
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Duration(b.upstream.Timeout))
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(attemptCtx, method, url, reader)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		b.clientLock.RLock()
+		client := b.httpClient
+		b.clientLock.RUnlock()
+		start := time.Now()
+		resp, err = client.Do(req)
+		if err != nil {
+			cancel()
+			metrics.ObserveUpstream(b.siteID, method, req.URL.Path, 0, start)
+			b.recordContact(err)
+			return nil, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		metrics.ObserveUpstream(b.siteID, method, req.URL.Path, resp.StatusCode, start)
+		b.recordContact(nil)
+		if resp.StatusCode != http.StatusUnauthorized || tryReauth == 1 {
+			break
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		metrics.ObserveReauth(b.siteID)
+		b.statusLock.Lock()
+		b.status.TokenValid = false
+		b.statusLock.Unlock()
+		b.clientLock.Lock()
+		if b.httpClient == client {
+			b.httpClient = b.getHttpClient()
+		}
+		b.clientLock.Unlock()
+	}
+	return resp, nil
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// cancelBody releases a request's timeout once its response has been read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelBody) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (b *httpBackend) recordContact(err error) {
+	b.statusLock.Lock()
+	defer b.statusLock.Unlock()
+	var retrieveError *oauth2.RetrieveError
+	if err != nil && !errors.As(err, &retrieveError) {
+		b.status.Reachable = false
+		b.status.LastError = err.Error()
+		return
+	}
+	b.status.Reachable = true
+	b.status.LastContact = time.Now()
+	b.status.LastError = ""
+	if err != nil {
+		b.status.LastError = err.Error()
+	}
+}
+
+func (b *httpBackend) UpstreamStatus() UpstreamStatus {
+	b.statusLock.Lock()
+	defer b.statusLock.Unlock()
+	status := b.status
+	status.CircuitOpen = b.breaker.open()
+	if status.TokenValid && !status.TokenExpiry.IsZero() && time.Now().After(status.TokenExpiry) {
+		status.TokenValid = false
+	}
+	return status
+}
+
+func (b *httpBackend) getJSON(ctx context.Context, path string, target interface{}, description string) error {
+	resp, err := b.doRequest(ctx, http.MethodGet, fmt.Sprintf("%s%s", b.baseURL, path), JsonContentType, nil)
+	if err != nil {
+		return err
+	}
+	bodyData, _ := io.ReadAll(resp.Body)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		b.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to pull " + description)
+		return errors.New("unable to pull " + description)
+	}
+	return json.Unmarshal(bodyData, target)
+}
+
+func (b *httpBackend) customQuery(ctx context.Context, query string, target interface{}, description string) error {
+	return b.getJSON(ctx, fmt.Sprintf("/api/v1/customquery/querydb?query=%s", url.QueryEscape(query)), target, description)
+}
+
+func (b *httpBackend) send(ctx context.Context, method string, path string, body interface{}, description string, expected ...int) error {
+	return b.sendJSON(ctx, method, path, body, nil, description, expected...)
+}
+
+// sendJSON sends a request with a JSON body, and decodes the response into target if it isn't nil.
+func (b *httpBackend) sendJSON(ctx context.Context, method string, path string, body interface{}, target interface{}, description string, expected ...int) error {
+	var jsonBytes []byte
+	if body != nil {
+		var err error
+		if jsonBytes, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	return b.sendBody(ctx, method, path, JsonContentType, jsonBytes, target, description, expected...)
+}
+
+// sendBody sends a request with a body that's already encoded, and decodes a JSON response into target if it isn't
+// nil.
+func (b *httpBackend) sendBody(ctx context.Context, method string, path string, contentType string, body []byte, target interface{}, description string, expected ...int) error {
+	resp, err := b.doRequest(ctx, method, fmt.Sprintf("%s%s", b.baseURL, path), contentType, body)
+	if err != nil {
+		return err
+	}
+	bodyData, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !lo.Contains(expected, resp.StatusCode) {
+		b.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to " + description)
+		return errors.New("unable to " + description)
+	}
+	if target == nil {
+		return nil
+	}
+	return json.Unmarshal(bodyData, target)
+}
+
+func (b *httpBackend) QueryUsers(ctx context.Context, query UserQuery) ([]*UserRecord, error) {
+	columns := fmt.Sprintf("*, %s as LocalID", query.LocalIDColumn)
+	where := "Active=1"
+	if query.ChangedColumn != "" {
+		columns += fmt.Sprintf(", %s as ChangedAt", query.ChangedColumn)
+		if query.ChangedSince != "" {
+			since, err := time.Parse(changedAtFormat, query.ChangedSince)
+			if err != nil {
+				return nil, fmt.Errorf("invalid changed since time: %w", err)
+			}
+			where += fmt.Sprintf(" AND %s >= '%s'", query.ChangedColumn, since.Format(changedAtFormat))
+		}
+	}
+	if query.UserID != 0 {
+		where = fmt.Sprintf("userID=%d AND %s", query.UserID, where)
+	}
+	sql := fmt.Sprintf("SELECT %s FROM UsersEx WHERE %s", columns, where)
+	data := make([]*UserRecord, 0)
+	if err := b.customQuery(ctx, sql, &data, "users"); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *httpBackend) ActiveUserIDs(ctx context.Context) ([]int, error) {
+	data := make([]*UserRecord, 0)
+	if err := b.customQuery(ctx, "SELECT userID FROM UsersEx WHERE Active=1", &data, "user IDs"); err != nil {
+		return nil, err
+	}
+	return lo.Map(data, func(item *UserRecord, _ int) int {
+		return item.ID
+	}), nil
+}
+
+func (b *httpBackend) UserPermissions(ctx context.Context, userID int) (*Permission, error) {
+	permissions := &Permission{}
+	if err := b.getJSON(ctx, fmt.Sprintf("/api/v1/users/%d/doorpermissionset", userID), permissions, "permissions"); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (b *httpBackend) UserPicture(ctx context.Context, userID int) ([]byte, error) {
+	resp, err := b.doRequest(ctx, http.MethodGet, fmt.Sprintf("%s/api/v1/users/%d/image", b.baseURL, userID), JsonContentType, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("user not found")
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (b *httpBackend) CustomFields(ctx context.Context) ([]*CustomFieldDefinition, error) {
+	fields := make([]*CustomFieldDefinition, 20)
+	if err := b.getJSON(ctx, "/api/v1/users/customfieldnames", &fields, "custom fields"); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func (b *httpBackend) Doors(ctx context.Context) ([]*Door, error) {
+	doors := make([]*Door, 50)
+	if err := b.getJSON(ctx, "/api/v1/doors", &doors, "doors"); err != nil {
+		return nil, err
+	}
+	return doors, nil
+}
+
+func (b *httpBackend) DeviceStatus(ctx context.Context) (map[int]int, error) {
+	data := make([]*deviceSQLQuery, 0)
+	if err := b.customQuery(ctx, "SELECT Address, statusFlag FROM devices", &data, "device status"); err != nil {
+		return nil, err
+	}
+	return lo.Associate(data, func(item *deviceSQLQuery) (int, int) {
+		return item.ID, item.Status
+	}), nil
+}
+
+func (b *httpBackend) Departments(ctx context.Context) ([]*Department, error) {
+	departments := make([]*Department, 50)
+	if err := b.getJSON(ctx, "/api/v1/departments", &departments, "departments"); err != nil {
+		return nil, err
+	}
+	return departments, nil
+}
+
+func (b *httpBackend) AccessLevels(ctx context.Context) ([]*AccessLevel, error) {
+	accessLevels := make([]*AccessLevel, 50)
+	if err := b.getJSON(ctx, "/api/v1/accesslevels", &accessLevels, "access levels"); err != nil {
+		return nil, err
+	}
+	return accessLevels, nil
+}
+
+func (b *httpBackend) Areas(ctx context.Context) ([]*Area, error) {
+	areas := make([]*Area, 50)
+	if err := b.getJSON(ctx, "/api/v1/accesslevels/areas", &areas, "areas"); err != nil {
+		return nil, err
+	}
+	return areas, nil
+}
+
+func (b *httpBackend) Events(ctx context.Context, afterID int64, limit int) ([]*EventRecord, error) {
+	query := fmt.Sprintf("SELECT TOP %d %s FROM EventsEx ORDER BY EventID DESC", limit, eventColumns)
+	if afterID != 0 {
+		query = fmt.Sprintf("SELECT TOP %d %s FROM EventsEx WHERE EventID > %d ORDER BY EventID", limit, eventColumns, afterID)
+	}
+	data := make([]*EventRecord, 0)
+	if err := b.customQuery(ctx, query, &data, "events"); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *httpBackend) OpenDoor(ctx context.Context, doorID uint64) error {
+	return b.send(ctx, http.MethodPost, "/api/v1/commands/door/open", map[string]uint64{"doorId": doorID}, "open door", http.StatusOK)
+}
+
+func (b *httpBackend) CloseDoor(ctx context.Context, doorID uint64) error {
+	return b.send(ctx, http.MethodPost, "/api/v1/commands/door/close", map[string]uint64{"doorId": doorID}, "close door", http.StatusOK)
+}
+
+func (b *httpBackend) OpenDoorRelay(ctx context.Context, doorID uint64, relay string, openTime int) error {
+	return b.send(ctx, http.MethodPost, "/api/v1/commands/door/control", map[string]interface{}{
+		"doorId": doorID,
+		"RelayFunction": map[string]interface{}{
+			"RelayId":       relay,
+			"RelayAction":   "TimedOpen",
+			"RelayOpenTime": openTime,
+		},
+	}, "open door", http.StatusOK)
+}
+
+func (b *httpBackend) ResetAntiPassback(ctx context.Context, userID int) error {
+	return b.send(ctx, http.MethodPost, "/api/v1/commands/antipassback/reset", map[string]int{"userId": userID}, "reset anti passback", http.StatusOK)
+}
+
+func (b *httpBackend) UpdateUser(ctx context.Context, userID int, info map[string]interface{}) error {
+	return b.send(ctx, http.MethodPut, fmt.Sprintf("/api/v1/users/%d", userID), info, "update user", http.StatusOK)
+}
+
+func (b *httpBackend) SetUserDepartment(ctx context.Context, userID int, department *Department) error {
+	return b.send(ctx, http.MethodPut, fmt.Sprintf("/api/v1/users/%d/departments", userID), department, "update user department", http.StatusNoContent)
+}
+
+func (b *httpBackend) SetUserPermissions(ctx context.Context, userID int, permissions Permission) error {
+	return b.send(ctx, http.MethodPut, fmt.Sprintf("/api/v1/users/%d/doorpermissionset", userID), permissions, "update user access level", http.StatusOK, http.StatusNoContent)
+}
+
+// SetUserPicture uploads a picture as the raw image, the same way Net2 returns it from UserPicture.
+func (b *httpBackend) SetUserPicture(ctx context.Context, userID int, picture []byte) error {
+	return b.sendBody(ctx, http.MethodPut, fmt.Sprintf("/api/v1/users/%d/image", userID), http.DetectContentType(picture), picture, nil, "update user picture", http.StatusOK, http.StatusNoContent)
+}
+
+func (b *httpBackend) CreateUser(ctx context.Context, info map[string]interface{}) (int, error) {
+	created := struct {
+		ID int `json:"id"`
+	}{}
+	if err := b.sendJSON(ctx, http.MethodPost, "/api/v1/users", info, &created, "create user", http.StatusOK, http.StatusCreated); err != nil {
+		return 0, err
+	}
+	if created.ID == 0 {
+		return 0, errors.New("unable to create user: no ID returned")
+	}
+	return created.ID, nil
+}
+
+func (b *httpBackend) DeleteUser(ctx context.Context, userID int) error {
+	return b.send(ctx, http.MethodDelete, fmt.Sprintf("/api/v1/users/%d", userID), nil, "delete user", http.StatusOK, http.StatusNoContent)
+}
+
+func (b *httpBackend) TokenUsers(ctx context.Context, token int64) ([]int, error) {
+	data := make([]*tokenSQLQuery, 0)
+	if err := b.customQuery(ctx, fmt.Sprintf("SELECT UserID, CardNo FROM Cards WHERE CardNo=%d", token), &data, "tokens"); err != nil {
+		return nil, err
+	}
+	return lo.Map(data, func(item *tokenSQLQuery, _ int) int {
+		return item.UserID
+	}), nil
+}
@@ -0,0 +1,301 @@
+package net2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+	"github.com/rs/zerolog"
+)
+
+// upstreamServer serves Net2 tokens, and answers every other request with the next status in its list, repeating the
+// last one.  A status of 0 never answers, so the request times out, and 429s are sent with retryAfter if it's set.
+type upstreamServer struct {
+	lock        sync.Mutex
+	statuses    []int
+	retryAfter  string
+	requests    int
+	tokens      int
+	path        string
+	contentType string
+	body        []byte
+}
+
+func (u *upstreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	if r.URL.Path == "/api/v1/authorization/tokens" {
+		u.tokens++
+		u.lock.Unlock()
+		w.Header().Set("Content-Type", JsonContentType)
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+		return
+	}
+	status := u.statuses[min(u.requests, len(u.statuses)-1)]
+	u.requests++
+	u.path = r.URL.Path
+	u.contentType = r.Header.Get("Content-Type")
+	u.body, _ = io.ReadAll(r.Body)
+	retryAfter := u.retryAfter
+	u.lock.Unlock()
+	if status == 0 {
+		<-r.Context().Done()
+		return
+	}
+	if status == http.StatusTooManyRequests && retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	w.WriteHeader(status)
+}
+
+func (u *upstreamServer) counts() (int, int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests, u.tokens
+}
+
+func newUpstreamBackend(t *testing.T, upstream config.Upstream, statuses ...int) (*httpBackend, *upstreamServer) {
+	t.Helper()
+	handler := &upstreamServer{statuses: statuses}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	conf := testConfig(t, 1)
+	conf.IP = host
+	conf.Port, _ = strconv.Atoi(port)
+	conf.Upstream = upstream
+	logger := zerolog.Nop()
+	backend, err := NewHTTPBackend(conf, "client", "", "", &logger)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+	return backend.(*httpBackend), handler
+}
+
+func testUpstream() config.Upstream {
+	return config.Upstream{
+		Timeout:          config.Duration(100 * time.Millisecond),
+		Attempts:         3,
+		RetryDelay:       config.Duration(time.Millisecond),
+		BreakerThreshold: 100,
+		BreakerCooldown:  config.Duration(time.Minute),
+	}
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		ctx      func(context.Context) context.Context
+		statuses []int
+		requests int
+		status   int
+		wantErr  bool
+		failures int
+	}{
+		{name: "success", method: http.MethodGet, statuses: []int{200}, requests: 1, status: 200},
+		{name: "gateway errors are retried", method: http.MethodGet, statuses: []int{503, 502, 200}, requests: 3, status: 200},
+		{name: "too many requests is retried", method: http.MethodGet, statuses: []int{429, 200}, requests: 2, status: 200},
+		{name: "too many requests don't trip the breaker", method: http.MethodGet, statuses: []int{429}, requests: 3, status: 429},
+		{name: "network errors are retried", method: http.MethodGet, statuses: []int{0, 200}, requests: 2, status: 200},
+		{name: "retries run out", method: http.MethodGet, statuses: []int{503}, requests: 3, status: 503, failures: 1},
+		{name: "network errors run out", method: http.MethodGet, statuses: []int{0}, requests: 3, wantErr: true, failures: 1},
+		{name: "client errors aren't retried", method: http.MethodGet, statuses: []int{404, 200}, requests: 1, status: 404},
+		{name: "server errors aren't retried", method: http.MethodGet, statuses: []int{500, 200}, requests: 1, status: 500},
+		{name: "posts aren't retried", method: http.MethodPost, statuses: []int{503, 200}, requests: 1, status: 503, failures: 1},
+		{name: "puts aren't retried", method: http.MethodPut, statuses: []int{0, 200}, requests: 1, wantErr: true, failures: 1},
+		{name: "single attempt", method: http.MethodGet, ctx: withSingleAttempt, statuses: []int{503, 200}, requests: 1, status: 503, failures: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, server := newUpstreamBackend(t, testUpstream(), test.statuses...)
+			ctx := context.Background()
+			if test.ctx != nil {
+				ctx = test.ctx(ctx)
+			}
+			resp, err := backend.doRequest(ctx, test.method, backend.baseURL+"/api/v1/test", "", nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %t", err, test.wantErr)
+			}
+			if err == nil {
+				_ = resp.Body.Close()
+				if resp.StatusCode != test.status {
+					t.Errorf("status = %d, want %d", resp.StatusCode, test.status)
+				}
+			}
+			if requests, _ := server.counts(); requests != test.requests {
+				t.Errorf("requests = %d, want %d", requests, test.requests)
+			}
+			if backend.breaker.failures != test.failures {
+				t.Errorf("breaker failures = %d, want %d", backend.breaker.failures, test.failures)
+			}
+		})
+	}
+}
+
+func TestDoRequestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		requests   int
+		status     int
+		wait       time.Duration
+	}{
+		{name: "seconds", retryAfter: "1", requests: 2, status: 200, wait: time.Second},
+		{name: "date in the past", retryAfter: "Mon, 06 Jan 2025 12:00:00 GMT", requests: 2, status: 200},
+		{name: "too long to wait", retryAfter: "60", requests: 1, status: 429},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, server := newUpstreamBackend(t, testUpstream(), 429, 200)
+			server.lock.Lock()
+			server.retryAfter = test.retryAfter
+			server.lock.Unlock()
+			start := time.Now()
+			resp, err := backend.doRequest(context.Background(), http.MethodGet, backend.baseURL+"/api/v1/test", "", nil)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.status)
+			}
+			if requests, _ := server.counts(); requests != test.requests {
+				t.Errorf("requests = %d, want %d", requests, test.requests)
+			}
+			if elapsed := time.Since(start); elapsed < test.wait {
+				t.Errorf("retried after %s, want at least %s", elapsed, test.wait)
+			}
+			if backend.breaker.failures != 0 {
+				t.Errorf("breaker failures = %d, want 0", backend.breaker.failures)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, time.January, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "5", want: 5 * time.Second},
+		{value: "-5", want: 0},
+		{value: "Mon, 06 Jan 2025 12:00:30 GMT", want: 30 * time.Second},
+		{value: "Mon, 06 Jan 2025 11:59:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := parseRetryAfter(test.value, now); got != test.want {
+				t.Errorf("delay = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDoRequestReauthenticates(t *testing.T) {
+	backend, server := newUpstreamBackend(t, testUpstream(), 401, 200)
+	resp, err := backend.doRequest(context.Background(), http.MethodPost, backend.baseURL+"/api/v1/test", JsonContentType, []byte("{}"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	requests, tokens := server.counts()
+	if resp.StatusCode != http.StatusOK || requests != 2 || tokens != 2 {
+		t.Errorf("status = %d, requests = %d, tokens = %d", resp.StatusCode, requests, tokens)
+	}
+}
+
+func TestSetUserPictureSendsTheImage(t *testing.T) {
+	backend, server := newUpstreamBackend(t, testUpstream(), http.StatusNoContent)
+	if err := backend.SetUserPicture(context.Background(), 4, photoneeded); err != nil {
+		t.Fatalf("setting picture: %v", err)
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.path != "/api/v1/users/4/image" || server.contentType != "image/png" {
+		t.Errorf("path = %s, content type = %s", server.path, server.contentType)
+	}
+	if !bytes.Equal(server.body, photoneeded) {
+		t.Errorf("body is %d bytes, want the %d byte image", len(server.body), len(photoneeded))
+	}
+}
+
+func TestDoRequestBreaker(t *testing.T) {
+	upstream := testUpstream()
+	upstream.Attempts = 1
+	upstream.BreakerThreshold = 2
+	upstream.BreakerCooldown = config.Duration(50 * time.Millisecond)
+	backend, server := newUpstreamBackend(t, upstream, 503, 503, 503, 200)
+	request := func() error {
+		resp, err := backend.doRequest(context.Background(), http.MethodGet, backend.baseURL+"/api/v1/test", "", nil)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	for range 2 {
+		if err := request(); err != nil {
+			t.Fatalf("request before the threshold failed: %v", err)
+		}
+	}
+	if err := request(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if requests, _ := server.counts(); requests != 2 {
+		t.Errorf("requests = %d, want 2 while the breaker is open", requests)
+	}
+	if !backend.UpstreamStatus().CircuitOpen {
+		t.Error("status doesn't report the breaker open")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := request(); err != nil {
+		t.Fatalf("trial request failed: %v", err)
+	}
+	if err := request(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error after a failed trial = %v, want %v", err, ErrCircuitOpen)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := request(); err != nil {
+		t.Fatalf("second trial request failed: %v", err)
+	}
+	if err := request(); err != nil {
+		t.Errorf("request after a successful trial = %v, want the breaker closed", err)
+	}
+	if requests, _ := server.counts(); requests != 5 {
+		t.Errorf("requests = %d, want 5", requests)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, cooldown: 20 * time.Millisecond}
+	breaker.failure()
+	if err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow during the cooldown = %v, want %v", err, ErrCircuitOpen)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow after the cooldown = %v, want a trial", err)
+	}
+	if err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow during a trial = %v, want %v", err, ErrCircuitOpen)
+	}
+	breaker.release()
+	if err := breaker.allow(); err != nil {
+		t.Errorf("allow after a released trial = %v, want another trial", err)
+	}
+	breaker.success()
+	if breaker.open() {
+		t.Error("breaker still open after a successful trial")
+	}
+}
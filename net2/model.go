@@ -1,11 +1,12 @@
 package net2
 
 import (
+	"context"
 	"github.com/go-co-op/gocron"
 	"github.com/greboid/net2/config"
 	"github.com/rs/zerolog"
-	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,24 +23,78 @@ const (
 type Site struct {
 	portalIDField    int
 	logger           *zerolog.Logger
-	httpClient       *http.Client
+	backend          Backend
 	cron             *gocron.Scheduler
-	config           *config.SiteConfig
+	ctx              context.Context
+	cancel           context.CancelFunc
+	config           atomic.Pointer[config.SiteConfig]
 	localIDFieldName string
-	updateLock       sync.Mutex
-	clientID         string
+	accessLevelsLock sync.Mutex
+	doorsLock        sync.Mutex
+	departmentsLock  sync.Mutex
+	usersLock        sync.Mutex
+	commitLock       sync.Mutex
+	state            atomic.Pointer[siteState]
+	events           *eventRing
+	changes          *ChangeBus
+	openSince        map[uint64]time.Time
+	heldOpen         map[uint64]bool
+	lastEventID      int64
+	eventsSeeded     bool
+	userWatermark    string
+	lastFullUserSync time.Time
+	permissionLock   sync.Mutex
+	permissions      map[int]*cachedPermission
+	stopped          atomic.Bool
+	healthLock       sync.Mutex
+	resources        map[string]*ResourceStatus
+	clock            func() time.Time
 	LocalIDField     string                         `json:"-"`
-	AccessLevels     map[int]*AccessLevel           `json:"-"`
-	Departments      map[int]*Department            `json:"-"`
-	Users            map[int]*User                  `json:"-"`
 	Fields           map[int]*CustomFieldDefinition `json:"-"`
 	QuitChan         chan bool                      `json:"-"`
-	BaseURL          string                         `json:"-"`
-	Doors            map[uint64]*Door               `json:"-"`
-	UnknownTokens    []Event                        `json:"-"`
 	SiteID           int                            `json:"ID"`
 	Name             string                         `json:"Name"`
-	LastPolled       time.Time                      `json:"lastPolled"`
+}
+
+type siteState struct {
+	accessLevels map[int]*AccessLevel
+	departments  map[int]*Department
+	users        map[int]*User
+	doors        map[uint64]*Door
+	usersLoaded  bool
+	initialised  bool
+}
+
+const (
+	SiteStateStarting = "starting"
+	SiteStateRunning  = "running"
+	SiteStateDegraded = "degraded"
+	SiteStateFailed   = "failed"
+	SiteStateStopped  = "stopped"
+)
+
+type SiteStatus struct {
+	State      string    `json:"state"`
+	LastPolled time.Time `json:"lastPolled"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+type ResourceStatus struct {
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastFailure         time.Time `json:"lastFailure"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+}
+
+type SiteHealth struct {
+	SiteID     int                       `json:"ID"`
+	Name       string                    `json:"Name"`
+	State      string                    `json:"state"`
+	Ready      bool                      `json:"ready"`
+	LastPolled time.Time                 `json:"lastPolled"`
+	LastError  string                    `json:"lastError,omitempty"`
+	Resources  map[string]ResourceStatus `json:"resources"`
+	Upstream   *UpstreamStatus           `json:"upstream,omitempty"`
 }
 
 type AccessLevel struct {
@@ -98,18 +153,28 @@ type Door struct {
 	AlarmZone   string
 }
 
+func (d *Door) IsOpen() bool {
+	return d.StatusFlag&DoorStatus_DoorOpen == DoorStatus_DoorOpen
+}
+
 type DoorSequenceItem struct {
 	Door uint64        `json:"door"`
 	Time time.Duration `json:"time"`
 }
 
 type Event struct {
-	Date     time.Time `json:"EventDate"`
-	Location string    `json:"where"`
-	Token    int64     `json:"tokenNumber"`
+	ID          int64     `json:"id"`
+	Date        time.Time `json:"EventDate"`
+	Type        int       `json:"eventType"`
+	Description string    `json:"description"`
+	Location    string    `json:"where"`
+	Token       int64     `json:"tokenNumber"`
+	UserID      int       `json:"userID,omitempty"`
+	UserName    string    `json:"userName,omitempty"`
+	Known       bool      `json:"known"`
 }
 
-type userSQLQuery struct {
+type UserRecord struct {
 	UserGUID        string `json:"UserGUID"`
 	ID              int    `json:"userID"`
 	Firstname       string `json:"FirstName"`
@@ -123,6 +188,24 @@ type userSQLQuery struct {
 	DepartmentName  string `json:"DepartmentName"`
 	AccessLevelName string `json:"AccessLevelName"`
 	LocalID         string `json:"LocalID"`
+	ChangedAt       string `json:"ChangedAt,omitempty"`
+}
+
+type EventRecord struct {
+	ID          int64  `json:"EventID"`
+	Date        string `json:"EventDate"`
+	Type        int    `json:"EventType"`
+	Description string `json:"EventDescription"`
+	UserID      int    `json:"UserID"`
+	FirstName   string `json:"FirstName"`
+	Surname     string `json:"Surname"`
+	Location    string `json:"DeviceName"`
+	Token       int64  `json:"CardNo"`
+}
+
+type tokenSQLQuery struct {
+	UserID int   `json:"UserID"`
+	Token  int64 `json:"CardNo"`
 }
 
 type deviceSQLQuery struct {
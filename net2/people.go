@@ -0,0 +1,93 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PersonActionResult is the outcome of a bulk action on one of a person's user records.
+type PersonActionResult struct {
+	SiteID   int    `json:"siteID"`
+	SiteName string `json:"siteName"`
+	UserID   int    `json:"userID"`
+	Success  bool   `json:"success"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Err      error  `json:"-"`
+}
+
+// PersonActionResults is the outcome of a bulk action, including the sites that couldn't be checked for records.
+type PersonActionResults struct {
+	LocalID string               `json:"localID"`
+	Results []PersonActionResult `json:"results"`
+	Failed  []SearchSiteStatus   `json:"failed"`
+}
+
+// ErrSkipped can be returned by a person action to show a record didn't need changing.
+var ErrSkipped = errors.New("skipped")
+
+// FindPerson returns the user records linked to a LocalID on every site allowed by include.
+func (m *SiteManager) FindPerson(ctx context.Context, localID string, include func(siteID int) bool) *SearchResults {
+	return m.SearchUsers(ctx, UserSearch{LocalID: localID}, include)
+}
+
+// ApplyToPerson runs an action against every user record linked to a LocalID, with the sites in parallel, and reports
+// the outcome for each record.
+func (m *SiteManager) ApplyToPerson(ctx context.Context, localID string, include func(siteID int) bool, action func(ctx context.Context, site *Site, userID int) error) *PersonActionResults {
+	person := m.FindPerson(ctx, localID, include)
+	results := &PersonActionResults{
+		LocalID: localID,
+		Results: make([]PersonActionResult, len(person.Results)),
+		Failed:  person.Failed,
+	}
+	wg := sync.WaitGroup{}
+	for index, record := range person.Results {
+		wg.Go(func() {
+			result := PersonActionResult{SiteID: record.SiteID, SiteName: record.SiteName, UserID: record.User.ID}
+			site := m.GetSite(record.SiteID)
+			var err error
+			if site == nil {
+				err = ErrSiteNotFound
+			} else {
+				err = action(ctx, site, record.User.ID)
+			}
+			switch {
+			case errors.Is(err, ErrSkipped):
+				result.Success = true
+				result.Skipped = true
+			case err != nil:
+				result.Error = err.Error()
+				result.Err = err
+			default:
+				result.Success = true
+			}
+			results.Results[index] = result
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// ExtendUserExpiry moves a user's expiry to the given time, unless they already expire later or never expire.
+func (s *Site) ExtendUserExpiry(ctx context.Context, userID int, expiry time.Time) error {
+	user := s.GetUser(userID)
+	if user == nil {
+		return ErrNotFound
+	}
+	if user.Expiry.IsZero() || !user.Expiry.Before(expiry) {
+		return ErrSkipped
+	}
+	return s.UpdateUserInfo(ctx, userID, map[string]interface{}{
+		"ExpiryDate": expiry,
+	})
+}
+
+// Failures reports whether any of the records couldn't be changed.
+func (r *PersonActionResults) Failures() bool {
+	return len(r.Failed) > 0 || slices.ContainsFunc(r.Results, func(result PersonActionResult) bool {
+		return !result.Success
+	})
+}
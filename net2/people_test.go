@@ -0,0 +1,98 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSiteManagerApplyToPerson(t *testing.T) {
+	manager := newReplayManager(t)
+	tests := []struct {
+		name    string
+		localID string
+		include func(siteID int) bool
+		err     error
+		want    []PersonActionResult
+	}{
+		{
+			name:    "every record",
+			localID: "1001",
+			include: func(int) bool { return true },
+			want:    []PersonActionResult{{SiteID: 1, UserID: 1, Success: true}},
+		},
+		{
+			name:    "skipped",
+			localID: "1001",
+			include: func(int) bool { return true },
+			err:     ErrSkipped,
+			want:    []PersonActionResult{{SiteID: 1, UserID: 1, Success: true, Skipped: true}},
+		},
+		{
+			name:    "failed",
+			localID: "1001",
+			include: func(int) bool { return true },
+			err:     errors.New("rejected"),
+			want:    []PersonActionResult{{SiteID: 1, UserID: 1, Error: "rejected"}},
+		},
+		{
+			name:    "sites that aren't included",
+			localID: "1001",
+			include: func(int) bool { return false },
+			want:    []PersonActionResult{},
+		},
+		{
+			name:    "nobody",
+			localID: "9999",
+			include: func(int) bool { return true },
+			want:    []PersonActionResult{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := manager.ApplyToPerson(context.Background(), test.localID, test.include, func(context.Context, *Site, int) error {
+				return test.err
+			})
+			if len(results.Results) != len(test.want) {
+				t.Fatalf("results = %+v, want %+v", results.Results, test.want)
+			}
+			for index, want := range test.want {
+				got := results.Results[index]
+				if got.SiteID != want.SiteID || got.UserID != want.UserID || got.Success != want.Success ||
+					got.Skipped != want.Skipped || got.Error != want.Error {
+					t.Errorf("result = %+v, want %+v", got, want)
+				}
+			}
+			if failures := len(test.want) > 0 && test.want[0].Error != ""; results.Failures() != failures {
+				t.Errorf("failures = %t, want %t", results.Failures(), failures)
+			}
+		})
+	}
+}
+
+func TestSiteExtendUserExpiry(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	ctx := context.Background()
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		userID  int
+		wantErr error
+	}{
+		{name: "expired user is extended", userID: 2},
+		{name: "later expiry is kept", userID: 1, wantErr: ErrSkipped},
+		{name: "never expiring is kept", userID: 3, wantErr: ErrSkipped},
+		{name: "unknown user", userID: 9, wantErr: ErrNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := site.ExtendUserExpiry(ctx, test.userID, expiry); !errors.Is(err, test.wantErr) {
+				t.Errorf("error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+	if got := site.GetUser(2).Expiry; !got.Equal(expiry) {
+		t.Errorf("expiry = %s, want %s", got, expiry)
+	}
+}
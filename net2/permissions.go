@@ -0,0 +1,108 @@
+package net2
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"time"
+)
+
+// cachedPermission is a user's individual permissions as last fetched from Net2, along with the parts of their user
+// record that were current at the time so it can be discarded once they change.
+type cachedPermission struct {
+	accessLevelName string
+	changedAt       string
+	fetched         time.Time
+	permissions     *Permission
+}
+
+// fetchExactAccessLevels looks up the individual permissions of each record, with at most the site's configured
+// number of requests in flight at once, and sets the resulting access levels on the matching user.
+func (s *Site) fetchExactAccessLevels(ctx context.Context, records []*UserRecord, users map[int]*User, levels map[int]*AccessLevel) {
+	if len(records) == 0 {
+		return
+	}
+	polling := s.getConfig().Polling
+	group := new(errgroup.Group)
+	group.SetLimit(max(polling.PermissionWorkers, 1))
+	for index := range records {
+		record := records[index]
+		user := users[record.ID]
+		group.Go(func() error {
+			user.AccessLevels = s.getExactAccessLevel(ctx, record, levels, time.Duration(polling.PermissionTimeout))
+			return nil
+		})
+	}
+	_ = group.Wait()
+}
+
+func (s *Site) getExactAccessLevel(ctx context.Context, data *UserRecord, levels map[int]*AccessLevel, timeout time.Duration) []string {
+	permissions, err := s.userPermissions(ctx, data, timeout)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to get exact permissions")
+		return []string{data.AccessLevelName}
+	}
+	accessLevels := make([]string, 0)
+	for index := range permissions.AccessLevels {
+		if levels[permissions.AccessLevels[index]] != nil {
+			accessLevels = append(accessLevels, levels[permissions.AccessLevels[index]].Name)
+		}
+	}
+	for index := range permissions.IndividualPermissions {
+		if levels[permissions.IndividualPermissions[index].ID] != nil {
+			accessLevels = append(accessLevels, levels[permissions.IndividualPermissions[index].ID].Name)
+		} else {
+			log.Debug().Str("Site", s.Name).Interface("Idv Perm ID", permissions.IndividualPermissions[index].ID).Interface("User", data.Firstname+" "+data.Surname).Msg("Discarding invalid access level")
+		}
+	}
+	return accessLevels
+}
+
+// userPermissions returns the cached permissions for a user if their record hasn't changed and the cache hasn't
+// expired, otherwise fetches them from Net2.
+func (s *Site) userPermissions(ctx context.Context, data *UserRecord, timeout time.Duration) (*Permission, error) {
+	changedAt := normaliseChangedAt(data.ChangedAt)
+	s.permissionLock.Lock()
+	cached, ok := s.permissions[data.ID]
+	s.permissionLock.Unlock()
+	if ok && cached.accessLevelName == data.AccessLevelName && cached.changedAt == changedAt &&
+		s.clock().Sub(cached.fetched) < time.Duration(s.getConfig().Polling.PermissionCache) {
+		return cached.permissions, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	permissions, err := s.backend.UserPermissions(ctx, data.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.permissionLock.Lock()
+	defer s.permissionLock.Unlock()
+	if s.permissions == nil {
+		s.permissions = make(map[int]*cachedPermission)
+	}
+	s.permissions[data.ID] = &cachedPermission{
+		accessLevelName: data.AccessLevelName,
+		changedAt:       changedAt,
+		fetched:         s.clock(),
+		permissions:     permissions,
+	}
+	return permissions, nil
+}
+
+// forgetPermissions drops a user's cached permissions, so they're fetched again after being changed.
+func (s *Site) forgetPermissions(userID int) {
+	s.permissionLock.Lock()
+	defer s.permissionLock.Unlock()
+	delete(s.permissions, userID)
+}
+
+// prunePermissionCache drops cached permissions for anyone not in a complete list of users.
+func (s *Site) prunePermissionCache(users map[int]*User) {
+	s.permissionLock.Lock()
+	defer s.permissionLock.Unlock()
+	for id := range s.permissions {
+		if _, ok := users[id]; !ok {
+			delete(s.permissions, id)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package net2
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+)
+
+// slowPermissions is a fake backend whose permission lookups take a while, or never answer if the delay is 0, and
+// which counts the lookups made and the most in flight at once.
+type slowPermissions struct {
+	*FakeBackend
+	delay       time.Duration
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+	calls       map[int]int
+}
+
+func newSlowPermissions(delay time.Duration) *slowPermissions {
+	return &slowPermissions{FakeBackend: newTestBackend(), delay: delay, calls: make(map[int]int)}
+}
+
+func (b *slowPermissions) UserPermissions(ctx context.Context, userID int) (*Permission, error) {
+	b.lock.Lock()
+	b.calls[userID]++
+	b.inFlight++
+	b.maxInFlight = max(b.maxInFlight, b.inFlight)
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.inFlight--
+		b.lock.Unlock()
+	}()
+	if b.delay == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return b.FakeBackend.UserPermissions(ctx, userID)
+}
+
+func (b *slowPermissions) counts(userID int) (int, int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.calls[userID], b.maxInFlight
+}
+
+func individualRecord(id int) *UserRecord {
+	return &UserRecord{ID: id, AccessLevelName: "Individual: All Hours, Working Hours"}
+}
+
+var testAccessLevels = map[int]*AccessLevel{
+	1: {ID: 1, Name: "All Hours"},
+	2: {ID: 2, Name: "Working Hours"},
+}
+
+func TestFetchExactAccessLevelsWorkers(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		t.Run(strconv.Itoa(workers), func(t *testing.T) {
+			backend := newSlowPermissions(20 * time.Millisecond)
+			records := make([]*UserRecord, 0)
+			users := make(map[int]*User)
+			for id := 1; id <= 8; id++ {
+				backend.SetPermissions(id, Permission{AccessLevels: []int{1, 2}})
+				records = append(records, individualRecord(id))
+				users[id] = &User{ID: id}
+			}
+			now := time.Now()
+			site := newIdleSite(t, backend, func(polling *config.Polling) {
+				polling.PermissionWorkers = workers
+			}, &now)
+			site.fetchExactAccessLevels(context.Background(), records, users, testAccessLevels)
+			if _, inFlight := backend.counts(0); inFlight != workers {
+				t.Errorf("most lookups in flight = %d, want %d", inFlight, workers)
+			}
+			for id, user := range users {
+				if !slices.Equal(user.AccessLevels, []string{"All Hours", "Working Hours"}) {
+					t.Errorf("user %d access levels = %v", id, user.AccessLevels)
+				}
+			}
+		})
+	}
+}
+
+func TestUserPermissionsTimeout(t *testing.T) {
+	backend := newSlowPermissions(0)
+	now := time.Now()
+	site := newIdleSite(t, backend, func(polling *config.Polling) {
+		polling.PermissionWorkers = 2
+		polling.PermissionTimeout = config.Duration(20 * time.Millisecond)
+	}, &now)
+	records := []*UserRecord{individualRecord(1), individualRecord(2), individualRecord(3)}
+	users := map[int]*User{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}}
+	start := time.Now()
+	site.fetchExactAccessLevels(context.Background(), records, users, testAccessLevels)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookups took %s, want each to time out", elapsed)
+	}
+	for id, user := range users {
+		if !slices.Equal(user.AccessLevels, []string{records[0].AccessLevelName}) {
+			t.Errorf("user %d access levels = %v, want the access level name", id, user.AccessLevels)
+		}
+	}
+	if len(site.permissions) != 0 {
+		t.Errorf("cached %d failed lookups", len(site.permissions))
+	}
+}
+
+func TestUserPermissionsCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(site *Site, record *UserRecord, now *time.Time)
+		refetch bool
+	}{
+		{name: "unchanged", change: func(*Site, *UserRecord, *time.Time) {}},
+		{name: "before expiry", change: func(_ *Site, _ *UserRecord, now *time.Time) {
+			*now = now.Add(9 * time.Minute)
+		}},
+		{name: "expired", refetch: true, change: func(_ *Site, _ *UserRecord, now *time.Time) {
+			*now = now.Add(10 * time.Minute)
+		}},
+		{name: "changed within the same second", change: func(_ *Site, record *UserRecord, _ *time.Time) {
+			record.ChangedAt = "2025-01-06T12:00:00.500"
+		}},
+		{name: "record changed", refetch: true, change: func(_ *Site, record *UserRecord, _ *time.Time) {
+			record.ChangedAt = "2025-01-06T12:00:01"
+		}},
+		{name: "access level changed", refetch: true, change: func(_ *Site, record *UserRecord, _ *time.Time) {
+			record.AccessLevelName = "Individual: All Hours"
+		}},
+		{name: "forgotten", refetch: true, change: func(site *Site, record *UserRecord, _ *time.Time) {
+			site.forgetPermissions(record.ID)
+		}},
+		{name: "pruned", refetch: true, change: func(site *Site, _ *UserRecord, _ *time.Time) {
+			site.prunePermissionCache(map[int]*User{2: {ID: 2}})
+		}},
+		{name: "kept by pruning", change: func(site *Site, record *UserRecord, _ *time.Time) {
+			site.prunePermissionCache(map[int]*User{record.ID: {ID: record.ID}})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newSlowPermissions(time.Millisecond)
+			backend.SetPermissions(1, Permission{AccessLevels: []int{1}})
+			now := time.Date(2025, time.January, 6, 12, 0, 0, 0, time.Local)
+			site := newIdleSite(t, backend, func(polling *config.Polling) {
+				polling.PermissionCache = config.Duration(10 * time.Minute)
+			}, &now)
+			record := individualRecord(1)
+			record.ChangedAt = "2025-01-06T12:00:00"
+			if _, err := site.userPermissions(context.Background(), record, time.Second); err != nil {
+				t.Fatalf("first lookup failed: %v", err)
+			}
+			test.change(site, record, &now)
+			if _, err := site.userPermissions(context.Background(), record, time.Second); err != nil {
+				t.Fatalf("second lookup failed: %v", err)
+			}
+			want := 1
+			if test.refetch {
+				want = 2
+			}
+			if calls, _ := backend.counts(1); calls != want {
+				t.Errorf("lookups = %d, want %d", calls, want)
+			}
+		})
+	}
+}
+
+func TestUpdateUserAccessLevelsRefetchesPermissions(t *testing.T) {
+	backend := newSlowPermissions(time.Millisecond)
+	if err := backend.SetUserPermissions(context.Background(), 1, Permission{AccessLevels: []int{1, 2}}); err != nil {
+		t.Fatalf("setting permissions: %v", err)
+	}
+	site := newTestSite(t, backend)
+	if got := site.GetUser(1).AccessLevels; !slices.Equal(got, []string{"All Hours", "Working Hours"}) {
+		t.Fatalf("access levels = %v", got)
+	}
+	calls, _ := backend.counts(1)
+	if err := site.UpdateUser(context.Background(), 1); err != nil {
+		t.Fatalf("updating user: %v", err)
+	}
+	if got, _ := backend.counts(1); got != calls {
+		t.Errorf("lookups after refetching the user = %d, want the cached %d", got, calls)
+	}
+	// Saving the same access levels leaves the user record as it was, so only dropping the cache refetches them.
+	if err := site.UpdateUserAccessLevels(context.Background(), 1, []int{1, 2}); err != nil {
+		t.Fatalf("updating access levels: %v", err)
+	}
+	if got, _ := backend.counts(1); got != calls+1 {
+		t.Errorf("lookups after changing access levels = %d, want %d", got, calls+1)
+	}
+}
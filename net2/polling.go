@@ -0,0 +1,144 @@
+package net2
+
+import (
+	"context"
+	"github.com/greboid/net2/config"
+	"github.com/rs/zerolog/log"
+	"math/rand/v2"
+	"time"
+)
+
+// syncedResources are the resources that make up a full update of a site.
+var syncedResources = []string{config.ResourceAccessLevels, config.ResourceDoors, config.ResourceDepartments, config.ResourceUsers}
+
+type poller struct {
+	resource string
+	update   func(ctx context.Context) error
+	nextRun  time.Time
+	// lastRun and interval are when nextRun was worked out from and the interval it used, so it can be worked out again
+	// if the interval changes.
+	lastRun  time.Time
+	interval time.Duration
+}
+
+// schedule sets when the poller next runs, an interval after from, backed off for any consecutive failures.
+func (s *Site) schedule(p *poller, from time.Time, interval time.Duration, failures int) {
+	p.lastRun = from
+	p.interval = interval
+	p.nextRun = from.Add(s.pollDelay(interval, failures))
+}
+
+// schedulePolling adds a job for each resource that checks every second whether the resource is due to be polled, so
+// changes to the polling config take effect without rescheduling anything.
+func (s *Site) schedulePolling() error {
+	pollers := []*poller{
+		{resource: config.ResourceAccessLevels, update: s.UpdateAccessLevels},
+		{resource: config.ResourceDoors, update: s.UpdateDoors},
+		{resource: config.ResourceDepartments, update: s.UpdateDepartments},
+		{resource: config.ResourceUsers, update: s.UpdateUsers},
+		{resource: config.ResourceEvents, update: s.UpdateEvents},
+	}
+	for index := range pollers {
+		p := pollers[index]
+		_, err := s.cron.Every(time.Second).Tag("poll-" + p.resource).SingletonMode().Do(func() {
+			s.poll(p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Site) poll(p *poller) {
+	if !s.snapshot().initialised || s.stopped.Load() {
+		return
+	}
+	now := s.clock()
+	interval, paused := s.pollInterval(p.resource, now)
+	if paused {
+		return
+	}
+	if !p.nextRun.IsZero() && interval != p.interval {
+		// The polling config or quiet hours have changed the interval since the next run was worked out, so it's due an
+		// interval after the last run at the new interval, not whenever the old one would have been.
+		s.schedule(p, p.lastRun, interval, s.consecutiveFailures(p.resource))
+	}
+	if now.Before(p.nextRun) {
+		return
+	}
+	if p.nextRun.IsZero() && p.resource != config.ResourceEvents {
+		// The initial full update has just fetched everything but events, so wait a full interval before polling again.
+		s.schedule(p, now, interval, 0)
+		return
+	}
+	start := time.Now()
+	err := p.update(s.ctx)
+	s.recordSync(p.resource, start, err)
+	failures := s.consecutiveFailures(p.resource)
+	if err != nil {
+		log.Error().Err(err).Str("Site", s.Name).Str("Resource", p.resource).Int("Failures", failures).Msg("Error polling site")
+	}
+	s.schedule(p, s.clock(), interval, failures)
+}
+
+// pollInterval returns how often a resource should currently be polled, and whether quiet hours have paused it.
+func (s *Site) pollInterval(resource string, now time.Time) (time.Duration, bool) {
+	polling := s.getConfig().Polling
+	interval := polling.Interval(resource)
+	if quietInterval, quiet := polling.Quiet(resource, now); quiet {
+		if quietInterval == 0 {
+			return 0, true
+		}
+		interval = max(interval, quietInterval)
+	}
+	return interval, false
+}
+
+// pollDelay doubles the interval for each consecutive failure up to the configured maximum, then adds a random amount
+// of jitter so sites don't all poll at the same moment.
+func (s *Site) pollDelay(interval time.Duration, failures int) time.Duration {
+	polling := s.getConfig().Polling
+	delay := interval
+	if failures > 0 {
+		ceiling := max(interval, time.Duration(polling.MaxBackoff))
+		for i := 0; i < failures && delay < ceiling; i++ {
+			delay *= 2
+		}
+		delay = min(delay, ceiling)
+	}
+	if jitter := time.Duration(polling.Jitter); jitter > 0 {
+		delay += rand.N(jitter)
+	}
+	return delay
+}
+
+func (s *Site) consecutiveFailures(resource string) int {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	if status, ok := s.resources[resource]; ok {
+		return status.ConsecutiveFailures
+	}
+	return 0
+}
+
+// UpToDate reports whether every resource has been fetched successfully within the last three polling intervals.
+func (s *Site) UpToDate() bool {
+	now := time.Now()
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	for _, resource := range syncedResources {
+		status, ok := s.resources[resource]
+		if !ok || status.LastSuccess.IsZero() {
+			return false
+		}
+		interval, paused := s.pollInterval(resource, now)
+		if paused {
+			continue
+		}
+		if now.Sub(status.LastSuccess) > 3*max(interval, time.Minute) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+)
+
+var pollingStart = time.Date(2025, time.January, 6, 12, 0, 0, 0, time.Local)
+
+// withPolling replaces a site's polling config, rather than changing the validated defaults.
+func withPolling(polling config.Polling) func(*config.Polling) {
+	return func(conf *config.Polling) {
+		*conf = polling
+	}
+}
+
+func TestPollSchedule(t *testing.T) {
+	polling := config.Polling{Users: config.Duration(time.Minute), MaxBackoff: config.Duration(4 * time.Minute)}
+	steps := []struct {
+		at      time.Duration
+		fail    bool
+		polled  bool
+		nextRun time.Duration
+	}{
+		{at: 0, nextRun: time.Minute},
+		{at: 30 * time.Second, nextRun: time.Minute},
+		{at: time.Minute, fail: true, polled: true, nextRun: 3 * time.Minute},
+		{at: 2 * time.Minute, nextRun: 3 * time.Minute},
+		{at: 3 * time.Minute, fail: true, polled: true, nextRun: 7 * time.Minute},
+		{at: 7 * time.Minute, fail: true, polled: true, nextRun: 11 * time.Minute},
+		{at: 11 * time.Minute, fail: true, polled: true, nextRun: 15 * time.Minute},
+		{at: 15 * time.Minute, polled: true, nextRun: 16 * time.Minute},
+	}
+	now := pollingStart
+	site := newIdleSite(t, NewFakeBackend(), withPolling(polling), &now)
+	fail := false
+	polled := false
+	p := &poller{resource: config.ResourceUsers, update: func(context.Context) error {
+		polled = true
+		if fail {
+			return errors.New("unreachable")
+		}
+		return nil
+	}}
+	for _, step := range steps {
+		now = pollingStart.Add(step.at)
+		fail = step.fail
+		polled = false
+		site.poll(p)
+		if polled != step.polled {
+			t.Errorf("at %s: polled = %t, want %t", step.at, polled, step.polled)
+		}
+		if want := pollingStart.Add(step.nextRun); !p.nextRun.Equal(want) {
+			t.Errorf("at %s: next run = %s, want %s", step.at, p.nextRun.Sub(pollingStart), step.nextRun)
+		}
+	}
+}
+
+func TestPollEventsStraightAway(t *testing.T) {
+	now := pollingStart
+	site := newIdleSite(t, NewFakeBackend(), withPolling(config.Polling{Events: config.Duration(10 * time.Second)}), &now)
+	polled := 0
+	p := &poller{resource: config.ResourceEvents, update: func(context.Context) error {
+		polled++
+		return nil
+	}}
+	site.poll(p)
+	if polled != 1 || !p.nextRun.Equal(now.Add(10*time.Second)) {
+		t.Errorf("polled = %d, next run = %s", polled, p.nextRun.Sub(now))
+	}
+}
+
+func TestPollDelayBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		maxBackoff time.Duration
+		failures   int
+		want       time.Duration
+	}{
+		{name: "no failures", interval: time.Minute, maxBackoff: 10 * time.Minute, want: time.Minute},
+		{name: "one failure", interval: time.Minute, maxBackoff: 10 * time.Minute, failures: 1, want: 2 * time.Minute},
+		{name: "three failures", interval: time.Minute, maxBackoff: 10 * time.Minute, failures: 3, want: 8 * time.Minute},
+		{name: "capped", interval: time.Minute, maxBackoff: 10 * time.Minute, failures: 4, want: 10 * time.Minute},
+		{name: "many failures", interval: time.Minute, maxBackoff: 10 * time.Minute, failures: 100, want: 10 * time.Minute},
+		{name: "ceiling below the interval", interval: time.Minute, maxBackoff: 30 * time.Second, failures: 2, want: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := pollingStart
+			site := newIdleSite(t, NewFakeBackend(), withPolling(config.Polling{MaxBackoff: config.Duration(test.maxBackoff)}), &now)
+			if got := site.pollDelay(test.interval, test.failures); got != test.want {
+				t.Errorf("delay = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPollDelayJitter(t *testing.T) {
+	now := pollingStart
+	jitter := 5 * time.Second
+	site := newIdleSite(t, NewFakeBackend(), withPolling(config.Polling{MaxBackoff: config.Duration(time.Hour), Jitter: config.Duration(jitter)}), &now)
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{failures: 0, base: time.Minute},
+		{failures: 2, base: 4 * time.Minute},
+	}
+	for _, test := range tests {
+		seen := make(map[time.Duration]bool)
+		for range 200 {
+			delay := site.pollDelay(time.Minute, test.failures)
+			if delay < test.base || delay >= test.base+jitter {
+				t.Fatalf("delay with %d failures = %s, want in [%s, %s)", test.failures, delay, test.base, test.base+jitter)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("delay with %d failures never varied", test.failures)
+		}
+	}
+}
+
+func TestPollIntervalQuietHours(t *testing.T) {
+	polling := config.Polling{
+		Users:  config.Duration(time.Minute),
+		Doors:  config.Duration(time.Minute),
+		Events: config.Duration(10 * time.Second),
+		QuietHours: []config.QuietHours{
+			{Start: "0 22 * * *", Duration: config.Duration(8 * time.Hour), Interval: config.Duration(15 * time.Minute)},
+			{Start: "0 2 * * *", Duration: config.Duration(time.Hour), Resources: []string{config.ResourceDoors}},
+			{Start: "0 12 * * 0", Duration: config.Duration(time.Hour), Interval: config.Duration(time.Minute), Resources: []string{config.ResourceEvents}},
+		},
+	}
+	day := func(hour int, minute int) time.Time {
+		return time.Date(2025, time.January, 6, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name     string
+		resource string
+		at       time.Time
+		want     time.Duration
+		paused   bool
+	}{
+		{name: "outside quiet hours", resource: config.ResourceUsers, at: day(12, 0), want: time.Minute},
+		{name: "in quiet hours", resource: config.ResourceUsers, at: day(23, 30), want: 15 * time.Minute},
+		{name: "quiet hours after midnight", resource: config.ResourceUsers, at: day(5, 59), want: 15 * time.Minute},
+		{name: "quiet hours ended", resource: config.ResourceUsers, at: day(6, 0), want: time.Minute},
+		{name: "events aren't slowed by default", resource: config.ResourceEvents, at: day(23, 30), want: 10 * time.Second},
+		{name: "paused", resource: config.ResourceDoors, at: day(2, 30), paused: true},
+		{name: "pause only covers its resources", resource: config.ResourceUsers, at: day(2, 30), want: 15 * time.Minute},
+		{name: "window on another day", resource: config.ResourceEvents, at: day(12, 30), want: 10 * time.Second},
+		{name: "window on its day", resource: config.ResourceEvents, at: day(12, 30).AddDate(0, 0, -1), want: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := test.at
+			site := newIdleSite(t, NewFakeBackend(), withPolling(polling), &now)
+			interval, paused := site.pollInterval(test.resource, test.at)
+			if paused != test.paused || interval != test.want {
+				t.Errorf("interval = %s, paused = %t, want %s, %t", interval, paused, test.want, test.paused)
+			}
+		})
+	}
+}
+
+func TestPollPausedByQuietHours(t *testing.T) {
+	polling := config.Polling{
+		Users:      config.Duration(time.Minute),
+		QuietHours: []config.QuietHours{{Start: "0 12 * * *", Duration: config.Duration(time.Hour)}},
+	}
+	now := pollingStart
+	site := newIdleSite(t, NewFakeBackend(), withPolling(polling), &now)
+	polled := false
+	p := &poller{resource: config.ResourceUsers, nextRun: pollingStart.Add(-time.Minute), update: func(context.Context) error {
+		polled = true
+		return nil
+	}}
+	site.poll(p)
+	if polled {
+		t.Error("polled during quiet hours")
+	}
+	now = pollingStart.Add(time.Hour)
+	site.poll(p)
+	if !polled || !p.nextRun.Equal(now.Add(time.Minute)) {
+		t.Errorf("polled = %t, next run = %s after quiet hours", polled, p.nextRun.Sub(now))
+	}
+}
+
+func TestPollIntervalChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    time.Duration
+		to      time.Duration
+		nextRun time.Duration
+	}{
+		{name: "shortened", from: 10 * time.Minute, to: time.Minute, nextRun: time.Minute},
+		{name: "lengthened", from: time.Minute, to: 10 * time.Minute, nextRun: 10 * time.Minute},
+		{name: "unchanged", from: time.Minute, to: time.Minute, nextRun: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := pollingStart
+			site := newIdleSite(t, NewFakeBackend(), withPolling(config.Polling{Users: config.Duration(test.from)}), &now)
+			polls := 0
+			p := &poller{resource: config.ResourceUsers, update: func(context.Context) error {
+				polls++
+				return nil
+			}}
+			site.poll(p)
+			conf := *site.getConfig()
+			conf.Polling.Users = config.Duration(test.to)
+			site.config.Store(&conf)
+			for at := time.Duration(0); at < test.nextRun; at += time.Second {
+				now = pollingStart.Add(at)
+				site.poll(p)
+			}
+			if polls != 0 {
+				t.Errorf("polled %d times before the new interval had passed", polls)
+			}
+			now = pollingStart.Add(test.nextRun)
+			site.poll(p)
+			if polls != 1 {
+				t.Errorf("polled %d times once the new interval had passed, want 1", polls)
+			}
+		})
+	}
+}
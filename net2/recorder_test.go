@@ -0,0 +1,178 @@
+package net2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestScrubForm(t *testing.T) {
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {"admin"},
+		"password":   {"secret"},
+		"client_id":  {"00000000-0000-0000-0000-000000000000"},
+	}
+	scrubbed := scrubForm(form)
+	for field, want := range map[string]string{
+		"grant_type": "password",
+		"username":   scrubbedValue,
+		"password":   scrubbedValue,
+		"client_id":  scrubbedValue,
+	} {
+		if got := scrubbed.Get(field); got != want {
+			t.Errorf("%s = %s, want %s", field, got, want)
+		}
+	}
+}
+
+func TestScrubJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "tokens",
+			body: `{"access_token":"abc","refresh_token":"def","token_type":"bearer"}`,
+			want: `{"access_token":"REDACTED","refresh_token":"REDACTED","token_type":"bearer"}`,
+		},
+		{
+			name: "nested",
+			body: `[{"FirstName":"Ada","Pin":"1234","Login":{"Username":"ada","Password":"x"}}]`,
+			want: `[{"FirstName":"Ada","Login":{"Password":"REDACTED","Username":"REDACTED"},"Pin":"REDACTED"}]`,
+		},
+		{
+			name: "client ID",
+			body: `{"client_id":"00000000-0000-0000-0000-000000000000"}`,
+			want: `{"client_id":"REDACTED"}`,
+		},
+		{
+			name: "large numbers",
+			body: `{"CardNo":12345678901234567}`,
+			want: `{"CardNo":12345678901234567}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(scrubJSON([]byte(test.body))); got != test.want {
+				t.Errorf("scrubbed = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplayedFixtureIsScrubbed(t *testing.T) {
+	interactions, err := loadInteractionFiles("testdata/replay/1")
+	if err != nil {
+		t.Fatalf("loading fixture: %v", err)
+	}
+	for _, interaction := range interactions {
+		for field, values := range interaction.RequestForm {
+			if isScrubbedField(field) && (len(values) != 1 || values[0] != scrubbedValue) {
+				t.Errorf("%s: %s isn't scrubbed", interaction.key(), field)
+			}
+		}
+		for _, body := range []json.RawMessage{interaction.RequestBody, interaction.Body} {
+			if len(body) == 0 {
+				continue
+			}
+			recorded := &bytes.Buffer{}
+			if err = json.Compact(recorded, body); err != nil {
+				t.Fatalf("%s: invalid body: %v", interaction.key(), err)
+			}
+			if string(scrubJSON(body)) != recorded.String() {
+				t.Errorf("%s: body isn't scrubbed", interaction.key())
+			}
+		}
+	}
+}
+
+func TestReplayKeyIgnoresWatermarks(t *testing.T) {
+	tests := []struct {
+		name      string
+		recorded  string
+		requested string
+		same      bool
+	}{
+		{
+			name:      "events after a different ID",
+			recorded:  "SELECT TOP 500 EventID FROM EventsEx WHERE EventID > 2 ORDER BY EventID",
+			requested: "SELECT TOP 500 EventID FROM EventsEx WHERE EventID > 12345 ORDER BY EventID",
+			same:      true,
+		},
+		{
+			name:      "users changed since a different time",
+			recorded:  "SELECT * FROM UsersEx WHERE Active=1 AND LastUpdated >= '2025-01-01T09:00:00'",
+			requested: "SELECT * FROM UsersEx WHERE Active=1 AND LastUpdated >= '2025-06-30T17:45:10'",
+			same:      true,
+		},
+		{
+			name:      "a different user",
+			recorded:  "SELECT * FROM UsersEx WHERE userID=1 AND Active=1",
+			requested: "SELECT * FROM UsersEx WHERE userID=2 AND Active=1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorded := replayKey("GET", "/api/v1/customquery/querydb?query="+url.QueryEscape(test.recorded))
+			requested := replayKey("GET", "/api/v1/customquery/querydb?query="+url.QueryEscape(test.requested))
+			if (recorded == requested) != test.same {
+				t.Errorf("keys %q and %q, want same %t", recorded, requested, test.same)
+			}
+		})
+	}
+}
+
+func TestReplayerServesDeltaQueries(t *testing.T) {
+	replayer, err := NewReplayer("testdata/replay/1")
+	if err != nil {
+		t.Fatalf("loading fixture: %v", err)
+	}
+	query := fmt.Sprintf("SELECT TOP %d %s FROM EventsEx WHERE EventID > %d ORDER BY EventID", eventBatchSize, eventColumns, 7)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/customquery/querydb?query="+url.QueryEscape(query), nil)
+	resp, err := replayer.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("replaying delta query: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestSiteFromReplay(t *testing.T) {
+	logger := zerolog.Nop()
+	backend, err := NewHTTPBackend(testConfig(t, 1), "", "", "testdata/replay/1", &logger)
+	if err != nil {
+		t.Fatalf("creating backend: %v", err)
+	}
+	site := newTestSite(t, backend)
+	users := site.GetUsers()
+	if len(users) != 2 {
+		t.Fatalf("users = %d, want 2", len(users))
+	}
+	if user := site.GetUser(1); user == nil || user.FirstName != "Ada" || user.LocalID != "1001" {
+		t.Errorf("user 1 = %+v", user)
+	}
+	if got := len(site.GetDoors()); got != 2 {
+		t.Errorf("doors = %d, want 2", got)
+	}
+	if got := len(site.GetDepartments()); got != 3 {
+		t.Errorf("departments = %d, want 3", got)
+	}
+	testutil.WaitFor(t, func() bool {
+		return len(site.GetEvents(time.Time{}, time.Time{}, "")) == 2
+	})
+	if known := site.GetEvents(time.Time{}, time.Time{}, EventTypeKnown); len(known) != 1 || known[0].Token != 123456 {
+		t.Errorf("known events = %+v", known)
+	}
+}
@@ -0,0 +1,169 @@
+package net2
+
+import (
+	"context"
+	"github.com/samber/lo"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserSearch finds users by any of their identifiers.  Query matches any of them but the PIN, which has to be asked
+// for on its own, and the other fields must all match when they're set.  Tokens, and numeric queries, are looked up in
+// each site's Net2 tokens table.
+type UserSearch struct {
+	Query   string
+	Name    string
+	LocalID string
+	GUID    string
+	PIN     string
+	Token   int64
+}
+
+func (q *UserSearch) Empty() bool {
+	return q.Query == "" && q.Name == "" && q.LocalID == "" && q.GUID == "" && q.PIN == "" && q.Token == 0
+}
+
+type SearchResult struct {
+	SiteID   int    `json:"siteID"`
+	SiteName string `json:"siteName"`
+	User     *User  `json:"user"`
+}
+
+// SearchSiteStatus describes a site whose results are missing or may be out of date.
+type SearchSiteStatus struct {
+	SiteID     int       `json:"siteID"`
+	SiteName   string    `json:"siteName"`
+	State      string    `json:"state"`
+	LastPolled time.Time `json:"lastPolled"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type SearchResults struct {
+	Results  []SearchResult     `json:"results"`
+	Failed   []SearchSiteStatus `json:"failed"`
+	Degraded []SearchSiteStatus `json:"degraded"`
+	Stale    []SearchSiteStatus `json:"stale"`
+}
+
+// SearchUsers searches the cached users of every site allowed by include in parallel.  Sites that have never loaded
+// their users are reported as failed, sites where a token couldn't be looked up are searched without it but reported
+// as degraded, and sites that aren't up to date are searched but reported as stale.
+func (m *SiteManager) SearchUsers(ctx context.Context, query UserSearch, include func(siteID int) bool) *SearchResults {
+	results := &SearchResults{
+		Results:  make([]SearchResult, 0),
+		Failed:   make([]SearchSiteStatus, 0),
+		Degraded: make([]SearchSiteStatus, 0),
+		Stale:    make([]SearchSiteStatus, 0),
+	}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for id, site := range m.GetSites() {
+		if !include(id) {
+			continue
+		}
+		wg.Go(func() {
+			status := site.Status()
+			siteStatus := SearchSiteStatus{
+				SiteID:     id,
+				SiteName:   site.Name,
+				State:      status.State,
+				LastPolled: status.LastPolled,
+				Error:      status.LastError,
+			}
+			if !site.snapshot().usersLoaded {
+				lock.Lock()
+				defer lock.Unlock()
+				results.Failed = append(results.Failed, siteStatus)
+				return
+			}
+			users, err := site.SearchUsers(ctx, query)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				site.logger.Error().Err(err).Msg("Unable to look up token")
+				degraded := siteStatus
+				degraded.Error = "token lookup failed"
+				results.Degraded = append(results.Degraded, degraded)
+			}
+			if !site.UpToDate() || status.State != SiteStateRunning {
+				results.Stale = append(results.Stale, siteStatus)
+			}
+			for _, user := range users {
+				results.Results = append(results.Results, SearchResult{SiteID: id, SiteName: site.Name, User: user})
+			}
+		})
+	}
+	wg.Wait()
+	slices.SortFunc(results.Results, func(a, b SearchResult) int {
+		if a.SiteID != b.SiteID {
+			return a.SiteID - b.SiteID
+		}
+		return a.User.ID - b.User.ID
+	})
+	bySite := func(a, b SearchSiteStatus) int { return a.SiteID - b.SiteID }
+	slices.SortFunc(results.Failed, bySite)
+	slices.SortFunc(results.Degraded, bySite)
+	slices.SortFunc(results.Stale, bySite)
+	return results
+}
+
+// SearchUsers returns the site's cached users matching a search, ordered by ID.  Any tokens in the search are looked
+// up in Net2 to find who holds them.  If a lookup fails, the users are still searched with nobody holding that token,
+// and the error is returned alongside them.
+func (s *Site) SearchUsers(ctx context.Context, query UserSearch) ([]*User, error) {
+	tokenUsers := make(map[int64][]int)
+	queryToken, _ := strconv.ParseInt(query.Query, 10, 64)
+	var lookupErr error
+	for _, token := range lo.Uniq([]int64{query.Token, queryToken}) {
+		if token == 0 {
+			continue
+		}
+		ids, err := s.backend.TokenUsers(ctx, token)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		tokenUsers[token] = ids
+	}
+	matched := make([]*User, 0)
+	for _, user := range s.snapshot().users {
+		if query.matches(user, tokenUsers) {
+			matched = append(matched, user)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *User) int { return a.ID - b.ID })
+	return matched, lookupErr
+}
+
+func (q *UserSearch) matches(user *User, tokenUsers map[int64][]int) bool {
+	name := strings.ToLower(user.FirstName + " " + user.Surname)
+	hasToken := func(token int64) bool {
+		return token != 0 && slices.Contains(tokenUsers[token], user.ID)
+	}
+	if q.Query != "" {
+		queryToken, _ := strconv.ParseInt(q.Query, 10, 64)
+		if !strings.Contains(name, strings.ToLower(q.Query)) && user.LocalID != q.Query &&
+			!strings.EqualFold(user.GUID, q.Query) && !hasToken(queryToken) {
+			return false
+		}
+	}
+	if q.Name != "" && !strings.Contains(name, strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.LocalID != "" && user.LocalID != q.LocalID {
+		return false
+	}
+	if q.GUID != "" && !strings.EqualFold(user.GUID, q.GUID) {
+		return false
+	}
+	if q.PIN != "" && user.PIN != q.PIN {
+		return false
+	}
+	if q.Token != 0 && !hasToken(q.Token) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestSiteSearchUsers(t *testing.T) {
+	backend := newTestBackend()
+	backend.AddToken(1, 123456)
+	backend.AddToken(3, 987654)
+	site := newTestSite(t, backend)
+	tests := []struct {
+		name  string
+		query UserSearch
+		want  []int
+	}{
+		{name: "name", query: UserSearch{Name: "ada"}, want: []int{1}},
+		{name: "local ID", query: UserSearch{LocalID: "1002"}, want: []int{2}},
+		{name: "guid", query: UserSearch{GUID: "GUID-1003"}, want: []int{3}},
+		{name: "query matches name", query: UserSearch{Query: "lovelace"}, want: []int{1}},
+		{name: "query matches local ID", query: UserSearch{Query: "1003"}, want: []int{3}},
+		{name: "token", query: UserSearch{Token: 987654}, want: []int{3}},
+		{name: "query matches token", query: UserSearch{Query: "123456"}, want: []int{1}},
+		{name: "unknown token", query: UserSearch{Token: 555}, want: []int{}},
+		{name: "fields must all match", query: UserSearch{Name: "ada", Token: 987654}, want: []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, err := site.SearchUsers(context.Background(), test.query)
+			if err != nil {
+				t.Fatalf("searching: %v", err)
+			}
+			got := make([]int, 0, len(users))
+			for _, user := range users {
+				got = append(got, user.ID)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("users = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// failingTokens fails every token lookup.
+type failingTokens struct {
+	*FakeBackend
+}
+
+func (f *failingTokens) TokenUsers(context.Context, int64) ([]int, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestSiteManagerSearchUsersDegradesFailedTokenLookups(t *testing.T) {
+	logger := zerolog.Nop()
+	working := NewSite(testConfig(t, 1), newTestBackend(), &logger)
+	failing := NewSite(testConfig(t, 2), &failingTokens{FakeBackend: newTestBackend()}, &logger)
+	manager := &SiteManager{Logger: &logger}
+	if err := manager.Start(&config.Config{}, []*Site{working, failing}); err != nil {
+		t.Fatalf("unable to start sites: %v", err)
+	}
+	t.Cleanup(manager.Stop)
+	testutil.WaitFor(t, working.Ready)
+	testutil.WaitFor(t, failing.Ready)
+	tests := []struct {
+		name  string
+		query UserSearch
+		sites []int
+	}{
+		{name: "numeric query still matches cached users", query: UserSearch{Query: "1001"}, sites: []int{1, 2}},
+		{name: "token can't be matched", query: UserSearch{Token: 1001}, sites: []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := manager.SearchUsers(context.Background(), test.query, func(int) bool { return true })
+			sites := make([]int, 0, len(results.Results))
+			for _, result := range results.Results {
+				sites = append(sites, result.SiteID)
+			}
+			if !slices.Equal(sites, test.sites) {
+				t.Errorf("results from sites %v, want %v", sites, test.sites)
+			}
+			if len(results.Failed) != 0 {
+				t.Errorf("failed = %+v, want none", results.Failed)
+			}
+			if len(results.Degraded) != 1 || results.Degraded[0].SiteID != 2 || results.Degraded[0].Error != "token lookup failed" {
+				t.Errorf("degraded = %+v", results.Degraded)
+			}
+		})
+	}
+}
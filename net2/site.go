@@ -1,102 +1,248 @@
 package net2
 
 import (
-	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-co-op/gocron"
 	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/metrics"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/lo"
-	"io"
-	"net/http"
-	"net/url"
+	"maps"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	JsonContentType = "application/json"
-)
-
 //go:embed photoneeded.png
 var photoneeded []byte
 
 //go:embed blank.gif
 var blank []byte
 
+const (
+	ScopeAll    = "all"
+	ScopeActive = "active"
+	ScopeToday  = "today"
+)
+
+// startTimeout is how long starting a site waits for Net2 before carrying on without it.
+const startTimeout = 5 * time.Second
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrInvalidScope     = errors.New("scope must be all, active or today")
+)
+
 func (s *Site) Start() error {
-	s.Users = make(map[int]*User, 0)
-	s.Departments = make(map[int]*Department)
-	s.AccessLevels = make(map[int]*AccessLevel)
-	s.Doors = make(map[uint64]*Door)
-	s.LocalIDField = s.getLocalFieldName()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.state.Store(&siteState{
+		accessLevels: make(map[int]*AccessLevel),
+		departments:  make(map[int]*Department),
+		users:        make(map[int]*User),
+		doors:        make(map[uint64]*Door),
+	})
+	s.openSince = make(map[uint64]time.Time)
+	s.heldOpen = make(map[uint64]bool)
+	// Sites are started while the manager holds its lock, so an unreachable server mustn't hold it for every retry.
+	startCtx, cancel := context.WithTimeout(withSingleAttempt(s.ctx), startTimeout)
+	s.LocalIDField = s.getLocalFieldName(startCtx)
+	cancel()
 	if s.cron == nil {
 		s.cron = gocron.NewScheduler(time.Now().Location())
 	}
-	_, err := s.cron.Every("1m").Tag("siteupdate").Do(func() {
-		s.UpdateAll()
+	s.events = newEventRing(s.getConfig().EventBufferSize)
+	_, err := s.cron.Every(1).Day().LimitRunsTo(1).Tag("siteupdate").Do(func() {
+		s.UpdateAll(s.ctx)
 	})
+	if err != nil {
+		return err
+	}
+	if err = s.schedulePolling(); err != nil {
+		return err
+	}
 	s.cron.StartAsync()
-	return err
+	return nil
 }
 
 func (s *Site) Stop() {
-	s.cron.Stop()
+	s.stopped.Store(true)
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.cron != nil {
+		s.cron.Stop()
+	}
 }
 
-func (s *Site) GetUser(userID int) *User {
-	return s.Users[userID]
+func (s *Site) getConfig() *config.SiteConfig {
+	return s.config.Load()
 }
 
-func (s *Site) GetUsers() map[int]*User {
-	return s.Users
+func (s *Site) snapshot() *siteState {
+	if state := s.state.Load(); state != nil {
+		return state
+	}
+	return &siteState{}
 }
 
-func (s *Site) GetUserPicture(userID int) ([]byte, error) {
-	resp, err := s.doGet(fmt.Sprintf("%s/api/v1/users/%d/image", s.BaseURL, userID))
-	if err != nil {
-		return nil, err
+func (s *Site) commit(update func(next *siteState)) (*siteState, *siteState) {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	previous := s.snapshot()
+	next := *previous
+	update(&next)
+	s.state.Store(&next)
+	return previous, &next
+}
+
+func (s *Site) MarshalJSON() ([]byte, error) {
+	status := s.Status()
+	return json.Marshal(struct {
+		SiteID     int       `json:"ID"`
+		Name       string    `json:"Name"`
+		State      string    `json:"state"`
+		LastPolled time.Time `json:"lastPolled"`
+		LastError  string    `json:"lastError,omitempty"`
+	}{
+		SiteID:     s.SiteID,
+		Name:       s.Name,
+		State:      status.State,
+		LastPolled: status.LastPolled,
+		LastError:  status.LastError,
+	})
+}
+
+// LastPolled returns the time by which every resource had been fetched successfully, or the zero time if any of them
+// hasn't been.
+func (s *Site) LastPolled() time.Time {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	var lastPolled time.Time
+	for _, resource := range syncedResources {
+		status, ok := s.resources[resource]
+		if !ok || status.LastSuccess.IsZero() {
+			return time.Time{}
+		}
+		if lastPolled.IsZero() || status.LastSuccess.Before(lastPolled) {
+			lastPolled = status.LastSuccess
+		}
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		return photoneeded, nil
+	return lastPolled
+}
+
+// Ready reports whether the site has finished its first full update and every resource has since been fetched
+// successfully, so its caches aren't empty.
+func (s *Site) Ready() bool {
+	return s.snapshot().initialised && !s.LastPolled().IsZero()
+}
+
+// Health reports the site's status, the outcome of the last sync of each resource, and the state of its connection
+// to Net2 if the backend can report it.
+func (s *Site) Health() SiteHealth {
+	status := s.Status()
+	health := SiteHealth{
+		SiteID:     s.SiteID,
+		Name:       s.Name,
+		State:      status.State,
+		Ready:      s.Ready(),
+		LastPolled: status.LastPolled,
+		LastError:  status.LastError,
+		Resources:  make(map[string]ResourceStatus),
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("user not found")
+	s.healthLock.Lock()
+	for resource, resourceStatus := range s.resources {
+		health.Resources[resource] = *resourceStatus
 	}
-	body, err := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	return body, nil
+	s.healthLock.Unlock()
+	if reporter, ok := s.backend.(StatusReporter); ok {
+		upstream := reporter.UpstreamStatus()
+		health.Upstream = &upstream
+	}
+	return health
 }
 
-func (s *Site) GetUserPictureByLocalID(localID int) ([]byte, error) {
-	var localIDString = strconv.Itoa(localID)
-	var userIDs = lo.Values(lo.PickBy(s.Users, func(_ int, user *User) bool {
-		return user.LocalID == localIDString
-	}))
-	if len(userIDs) != 1 {
-		return nil, errors.New("user not found")
+func (s *Site) recordSync(resource string, start time.Time, err error) {
+	metrics.ObserveSync(s.SiteID, resource, start, err)
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	if s.resources == nil {
+		s.resources = make(map[string]*ResourceStatus)
+	}
+	status, ok := s.resources[resource]
+	if !ok {
+		status = &ResourceStatus{}
+		s.resources[resource] = status
 	}
-	resp, err := s.doGet(fmt.Sprintf("%s/api/v1/users/%d/image", s.BaseURL, userIDs[0].ID))
 	if err != nil {
-		return nil, err
+		status.LastFailure = time.Now()
+		status.LastError = err.Error()
+		status.ConsecutiveFailures++
+	} else {
+		status.LastSuccess = time.Now()
+		status.ConsecutiveFailures = 0
+	}
+}
+
+// Status reports whether the site has completed its first sync, and whether the most recent poll of any resource
+// failed.
+func (s *Site) Status() SiteStatus {
+	status := SiteStatus{LastPolled: s.LastPolled(), LastError: s.lastError()}
+	switch {
+	case s.stopped.Load():
+		status.State = SiteStateStopped
+	case !s.snapshot().initialised:
+		status.State = SiteStateStarting
+	case status.LastPolled.IsZero():
+		status.State = SiteStateFailed
+	case status.LastError != "":
+		status.State = SiteStateDegraded
+	default:
+		status.State = SiteStateRunning
+	}
+	return status
+}
+
+func (s *Site) lastError() string {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	var errs []string
+	for _, resource := range config.PolledResources {
+		if status, ok := s.resources[resource]; ok && status.ConsecutiveFailures > 0 {
+			errs = append(errs, resource+": "+status.LastError)
+		}
 	}
-	if resp.StatusCode == http.StatusNotFound {
+	return strings.Join(errs, "\n")
+}
+
+func (s *Site) GetUser(userID int) *User {
+	return s.snapshot().users[userID]
+}
+
+func (s *Site) GetUsers() map[int]*User {
+	return s.snapshot().users
+}
+
+func (s *Site) GetUserPicture(ctx context.Context, userID int) ([]byte, error) {
+	picture, err := s.backend.UserPicture(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
 		return photoneeded, nil
 	}
-	if resp.StatusCode != http.StatusOK {
+	return picture, err
+}
+
+func (s *Site) GetUserPictureByLocalID(ctx context.Context, localID int) ([]byte, error) {
+	var localIDString = strconv.Itoa(localID)
+	var userIDs = lo.Values(lo.PickBy(s.snapshot().users, func(_ int, user *User) bool {
+		return user.LocalID == localIDString
+	}))
+	if len(userIDs) != 1 {
 		return nil, errors.New("user not found")
 	}
-	body, err := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	return body, nil
+	return s.GetUserPicture(ctx, userIDs[0].ID)
 }
 
 func (s *Site) GetBlankPicture() ([]byte, error) {
@@ -104,7 +250,7 @@ func (s *Site) GetBlankPicture() ([]byte, error) {
 }
 
 func (s *Site) GetUsersInDepartment(departmentMatch func(test Department) bool, userMatch func(test *User) bool) map[int]*User {
-	return lo.PickBy(s.Users, func(_ int, user *User) bool {
+	return lo.PickBy(s.snapshot().users, func(_ int, user *User) bool {
 		return lo.CountBy(user.Departments, func(department Department) bool {
 			return departmentMatch(department)
 		}) > 0 && userMatch(user)
@@ -125,68 +271,29 @@ func (s *Site) GetTodaysActiveUsersInDepartment(match func(test Department) bool
 	return s.GetUsersInDepartment(match, func(test *User) bool { return test.LastUpdated.After(midnight) })
 }
 
-func (s *Site) GetCancelledUsers() interface{} {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CancelledDeptPrefix) }, func(test *User) bool { return true })
-}
-
-func (s *Site) GetActiveStaffToday() map[int]*User {
-	return s.GetTodaysActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.StaffDeptPrefix) })
-}
-
-func (s *Site) GetActiveStaff() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.StaffDeptPrefix) })
-}
-
-func (s *Site) GetStaff() map[int]*User {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.StaffDeptPrefix) }, func(test *User) bool { return true })
-}
-
-func (s *Site) GetActiveVisitorsToday() map[int]*User {
-	return s.GetTodaysActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.VisitorDeptPrefix) })
-}
-
-func (s *Site) GetActiveVisitors() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.VisitorDeptPrefix) })
-}
-
-func (s *Site) GetVisitors() map[int]*User {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.VisitorDeptPrefix) }, func(test *User) bool { return true })
-}
-
-func (s *Site) GetActiveContractorsToday() map[int]*User {
-	return s.GetTodaysActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.ContractorDeptPrefix) })
-}
-
-func (s *Site) GetActiveContractors() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.ContractorDeptPrefix) })
-}
-
-func (s *Site) GetContractors() map[int]*User {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.ContractorDeptPrefix) }, func(test *User) bool { return true })
-}
-
-func (s *Site) GetActiveCleanersToday() map[int]*User {
-	return s.GetTodaysActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CleanerDeptPrefix) })
-}
-
-func (s *Site) GetActiveCleaners() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CleanerDeptPrefix) })
-}
-
-func (s *Site) GetCleaners() map[int]*User {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CleanerDeptPrefix) }, func(test *User) bool { return true })
-}
-
-func (s *Site) GetActiveCustomersToday() map[int]*User {
-	return s.GetTodaysActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CustomerDeptPrefix) })
-}
-
-func (s *Site) GetActiveCustomers() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CustomerDeptPrefix) })
+// GetCategories returns the user categories configured for the site.
+func (s *Site) GetCategories() []config.Category {
+	return s.getConfig().Categories
 }
 
-func (s *Site) GetCustomers() map[int]*User {
-	return s.GetUsersInDepartment(func(test Department) bool { return strings.HasPrefix(test.Name, s.config.CustomerDeptPrefix) }, func(test *User) bool { return true })
+// GetCategoryUsers returns the users in a category, limited to those who haven't expired for ScopeActive, or who have
+// been updated today for ScopeToday.
+func (s *Site) GetCategoryUsers(name string, scope string) (map[int]*User, error) {
+	category, ok := s.getConfig().FindCategory(name)
+	if !ok {
+		return nil, ErrCategoryNotFound
+	}
+	match := func(test Department) bool { return category.Matches(test.ID, test.Name) }
+	switch scope {
+	case ScopeAll, "":
+		return s.GetUsersInDepartment(match, func(test *User) bool { return true }), nil
+	case ScopeActive:
+		return s.GetActiveUsersInDepartment(match), nil
+	case ScopeToday:
+		return s.GetTodaysActiveUsersInDepartment(match), nil
+	default:
+		return nil, ErrInvalidScope
+	}
 }
 
 func (s *Site) GetActiveUsersToday() map[int]*User {
@@ -197,256 +304,158 @@ func (s *Site) GetActiveUsers() map[int]*User {
 	return s.GetActiveUsersInDepartment(func(test Department) bool { return true })
 }
 
-func (s *Site) GetActiveNonStaff() map[int]*User {
-	return s.GetActiveUsersInDepartment(func(test Department) bool {
-		return !strings.HasPrefix(test.Name, s.config.StaffDeptPrefix)
-	})
-}
-
 func (s *Site) GetDoors() map[uint64]*Door {
-	return s.Doors
+	return s.snapshot().doors
 }
 
 func (s *Site) GetMonitoredDoors() map[uint64]*Door {
-	doors := lo.PickBy(s.Doors, func(_ uint64, door *Door) bool {
-		return lo.CountBy(s.config.MonitoredDoors, func(monitoredDoor config.MonitoredDoor) bool {
-			return uint64(monitoredDoor.ID) == door.ID
-		}) > 0
-	})
-	lo.ForEach(s.config.MonitoredDoors, func(item config.MonitoredDoor, index int) {
-		doors[uint64(item.ID)].Name = item.Name
+	current := s.snapshot().doors
+	doors := make(map[uint64]*Door)
+	lo.ForEach(s.getConfig().MonitoredDoors, func(item config.MonitoredDoor, index int) {
+		if door, ok := current[uint64(item.ID)]; ok {
+			monitored := *door
+			monitored.Name = item.Name
+			doors[monitored.ID] = &monitored
+		}
 	})
 	return doors
 }
 
 func (s *Site) GetOpenableDoors() map[string][]config.DoorSequence {
-	return lo.SliceToMap(s.config.OpenableDoors, func(item config.OpenableDoor) (string, []config.DoorSequence) {
+	return lo.SliceToMap(s.getConfig().OpenableDoors, func(item config.OpenableDoor) (string, []config.DoorSequence) {
 		return item.Name, item.Sequence
 	})
 }
 
 func (s *Site) GetDoor(doorID uint64) *Door {
-	return s.Doors[doorID]
+	return s.snapshot().doors[doorID]
 }
 
-func (s *Site) OpenDoor(doorID uint64) error {
-	jsonBytes, _ := json.Marshal(map[string]uint64{"doorId": doorID})
-	_, ok := s.Doors[doorID]
+func (s *Site) OpenDoor(ctx context.Context, doorID uint64) error {
+	_, ok := s.snapshot().doors[doorID]
 	if !ok {
 		return errors.New("invalid door")
 	}
-	resp, err := s.doPost(fmt.Sprintf("%s/api/v1/commands/door/open", s.BaseURL), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		log.Error().Int("Status", resp.StatusCode).Msg("Unable to close door")
-		return errors.New("unable to open door")
-	}
-	return nil
+	return s.backend.OpenDoor(ctx, doorID)
 }
 
-func (s *Site) OpenDoorWithRelay(doorID uint64, secondRelay bool) error {
+func (s *Site) OpenDoorWithRelay(ctx context.Context, doorID uint64, secondRelay bool) error {
 	var relay string
 	if secondRelay {
 		relay = "Relay2"
 	} else {
 		relay = "Relay1"
 	}
-	jsonBytes, _ := json.Marshal(map[string]interface{}{
-		"doorId": doorID,
-		"RelayFunction": map[string]interface{}{
-			"RelayId":       relay,
-			"RelayAction":   "TimedOpen",
-			"RelayOpenTime": 1000,
-		},
-	})
-	_, ok := s.Doors[doorID]
+	_, ok := s.snapshot().doors[doorID]
 	if !ok {
 		return errors.New("invalid door")
 	}
-	resp, err := s.doPost(fmt.Sprintf("%s/api/v1/commands/door/control", s.BaseURL), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		log.Error().Int("Status", resp.StatusCode).Msg("Unable to close door")
-		return errors.New("unable to open door")
-	}
-	return nil
+	return s.backend.OpenDoorRelay(ctx, doorID, relay, 1000)
 }
 
-func (s *Site) CloseDoor(doorID uint64) error {
-	jsonBytes, _ := json.Marshal(map[string]uint64{"doorId": doorID})
-	_, ok := s.Doors[doorID]
+func (s *Site) CloseDoor(ctx context.Context, doorID uint64) error {
+	_, ok := s.snapshot().doors[doorID]
 	if !ok {
 		return errors.New("invalid door")
 	}
-	resp, err := s.doPost(fmt.Sprintf("%s/api/v1/commands/door/close", s.BaseURL), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		log.Error().Int("Status", resp.StatusCode).Msg("Unable to close door")
-		return errors.New("unable to close door")
-	}
-	return nil
+	return s.backend.CloseDoor(ctx, doorID)
 }
 
 func (s *Site) GetAccessLevels() map[int]*AccessLevel {
-	return s.AccessLevels
+	return s.snapshot().accessLevels
 }
 
 func (s *Site) GetDepartments() map[int]*Department {
-	return s.Departments
-}
-
-func (s *Site) doRequest(method string, url string, body io.Reader) (*http.Response, error) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
-	for tryReauth := 2; tryReauth > 0; tryReauth-- {
-		req, err = http.NewRequest(method, url, body)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Content-Type", JsonContentType)
-		resp, err = s.httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != http.StatusUnauthorized {
-			break
-		}
-		s.httpClient = getHttpClient(s.clientID, s.config.Username, s.config.Password, s.BaseURL)
-	}
-	return resp, err
-}
-
-func (s *Site) doPost(url string, body io.Reader) (*http.Response, error) {
-	return s.doRequest(http.MethodPost, url, body)
-}
-
-func (s *Site) doPut(url string, body io.Reader) (*http.Response, error) {
-	return s.doRequest(http.MethodPut, url, body)
+	return s.snapshot().departments
 }
 
-func (s *Site) doGet(url string) (*http.Response, error) {
-	return s.doRequest(http.MethodGet, url, nil)
-}
-
-func (s *Site) ResetAntiPassback(userID int) error {
-	jsonBytes, _ := json.Marshal(map[string]int{"userId": userID})
-	resp, err := s.doPost(fmt.Sprintf("%s/api/v1/commands/antipassback/reset", s.BaseURL), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return errors.New("unable to reset anti passback")
-	}
-	return nil
+func (s *Site) ResetAntiPassback(ctx context.Context, userID int) error {
+	return s.backend.ResetAntiPassback(ctx, userID)
 }
 
-func (s *Site) ActivateUser(userID int) error {
-	return s.UpdateUserInfo(userID, map[string]interface{}{
+func (s *Site) ActivateUser(ctx context.Context, userID int) error {
+	return s.UpdateUserInfo(ctx, userID, map[string]interface{}{
 		"ExpiryDate": GetTomorrow(),
 	})
 }
 
-func (s *Site) DeactivateUser(userID int) error {
+func (s *Site) DeactivateUser(ctx context.Context, userID int) error {
 	now := time.Now()
 	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 23, 59, 59, 0, time.Local)
-	return s.UpdateUserInfo(userID, map[string]interface{}{
+	return s.UpdateUserInfo(ctx, userID, map[string]interface{}{
 		"ExpiryDate": yesterday,
 	})
 }
 
-func (s *Site) UpdateUserInfo(userID int, info map[string]interface{}) error {
+func (s *Site) UpdateUserInfo(ctx context.Context, userID int, info map[string]interface{}) error {
 	info["Id"] = userID
 	if _, ok := info["ExpiryDate"]; !ok {
-		info["ExpiryDate"] = s.Users[userID].Expiry
-	}
-	jsonBytes, err := json.Marshal(info)
-	if err != nil {
-		return err
+		user := s.GetUser(userID)
+		if user == nil {
+			return errors.New("user not found")
+		}
+		info["ExpiryDate"] = user.Expiry
 	}
-	resp, err := s.doPut(fmt.Sprintf("%s/api/v1/users/%d", s.BaseURL, userID), bytes.NewReader(jsonBytes))
-	if err != nil {
+	if err := s.backend.UpdateUser(ctx, userID, info); err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		s.logger.Error().Int("Status", resp.StatusCode).Msg("Unable to update user")
-		return errors.New("unable to update user info")
-	}
-	return s.UpdateUser(userID)
+	return s.UpdateUser(ctx, userID)
 }
 
-func (s *Site) ChangeUserDepartment(userID, departmentID int) error {
-	newDepartment, ok := s.Departments[departmentID]
+func (s *Site) ChangeUserDepartment(ctx context.Context, userID, departmentID int) error {
+	newDepartment, ok := s.snapshot().departments[departmentID]
 	if !ok {
 		return fmt.Errorf("department not found: %d", departmentID)
 	}
-	jsonBytes, err := json.Marshal(newDepartment)
-	if err != nil {
+	if err := s.backend.SetUserDepartment(ctx, userID, newDepartment); err != nil {
 		return err
 	}
-	resp, err := s.doPut(fmt.Sprintf("%s/api/v1/users/%d/departments", s.BaseURL, userID), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 204 {
-		s.logger.Error().Err(err).Msg("Unable to update user info")
-		return errors.New("unable to update user info")
-	}
-	return s.UpdateUser(userID)
+	return s.UpdateUser(ctx, userID)
 }
 
-func (s *Site) UpdateUserAccessLevels(userID int, accesslevels []int) error {
+func (s *Site) UpdateUserAccessLevels(ctx context.Context, userID int, accesslevels []int) error {
 	info := Permission{
 		AccessLevels:          accesslevels,
 		IndividualPermissions: []AccessLevel{},
 	}
-	jsonBytes, err := json.Marshal(info)
-	if err != nil {
-		return err
-	}
-	resp, err := s.doPut(fmt.Sprintf("%s/api/v1/users/%d/doorpermissionset", s.BaseURL, userID), bytes.NewReader(jsonBytes))
-	if err != nil {
+	s.forgetPermissions(userID)
+	if err := s.backend.SetUserPermissions(ctx, userID, info); err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		s.logger.Error().Int("Status", resp.StatusCode).Msg("Unable to update user access level")
-		return errors.New("unable to update user info")
-	}
-	return s.UpdateUser(userID)
+	return s.UpdateUser(ctx, userID)
 }
 
-func (s *Site) UpdateUserAccessLevel(userID int, accesslevel int) error {
+func (s *Site) UpdateUserAccessLevel(ctx context.Context, userID int, accesslevel int) error {
 	var newAccessLevel []int
 	if accesslevel == -1 {
 		newAccessLevel = []int{0}
 	} else {
 		newAccessLevel = []int{accesslevel}
 	}
-	return s.UpdateUserAccessLevels(userID, newAccessLevel)
+	return s.UpdateUserAccessLevels(ctx, userID, newAccessLevel)
 }
 
-func (s *Site) SetUserAccessLevel(userID int, accesslevel int) error {
+func (s *Site) SetUserAccessLevel(ctx context.Context, userID int, accesslevel int) error {
 	newLevels := []int{accesslevel}
-	return s.UpdateUserAccessLevels(userID, newLevels)
+	return s.UpdateUserAccessLevels(ctx, userID, newLevels)
 }
 
 func (s *Site) getAccessLevelIDByName(levelName string) int {
-	for id := range s.AccessLevels {
-		if s.AccessLevels[id].Name == levelName {
-			return s.AccessLevels[id].ID
+	accessLevels := s.snapshot().accessLevels
+	for id := range accessLevels {
+		if accessLevels[id].Name == levelName {
+			return accessLevels[id].ID
 		}
 	}
 	return -1
 }
 
-func (s *Site) RemoveUserAccessLevel(userID int, accesslevel int) error {
-	existingLevelNames := s.Users[userID].AccessLevels
+func (s *Site) RemoveUserAccessLevel(ctx context.Context, userID int, accesslevel int) error {
+	user := s.GetUser(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	existingLevelNames := user.AccessLevels
 	newLevels := make([]int, 0)
 	for index := range existingLevelNames {
 		key := s.getAccessLevelIDByName(existingLevelNames[index])
@@ -454,31 +463,42 @@ func (s *Site) RemoveUserAccessLevel(userID int, accesslevel int) error {
 			newLevels = append(newLevels, key)
 		}
 	}
-	return s.UpdateUserAccessLevels(userID, newLevels)
+	return s.UpdateUserAccessLevels(ctx, userID, newLevels)
 }
 
-func (s *Site) AddUserAccessLevel(userID int, accesslevel int) error {
-	existingLevelNames := s.Users[userID].AccessLevels
+func (s *Site) AddUserAccessLevel(ctx context.Context, userID int, accesslevel int) error {
+	user := s.GetUser(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	existingLevelNames := user.AccessLevels
 	newLevels := make([]int, 0)
 	for index := range existingLevelNames {
 		newLevels = append(newLevels, s.getAccessLevelIDByName(existingLevelNames[index]))
 	}
 	newLevels = append(newLevels, accesslevel)
-	return s.UpdateUserAccessLevels(userID, newLevels)
+	return s.UpdateUserAccessLevels(ctx, userID, newLevels)
 }
 
-func (s *Site) SequenceDoor(items ...DoorSequenceItem) {
+func (s *Site) SequenceDoor(ctx context.Context, items ...DoorSequenceItem) error {
+	var errs []error
 	for _, value := range items {
-		err := s.OpenDoor(value.Door)
+		err := s.OpenDoor(ctx, value.Door)
 		if err != nil {
 			log.Error().Err(err).Interface("Doors", items).Msg("Unable to open door in sequence")
+			errs = append(errs, fmt.Errorf("door %d: %w", value.Door, err))
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(append(errs, ctx.Err())...)
+		case <-time.After(value.Time):
 		}
-		time.Sleep(value.Time)
 	}
+	return errors.Join(errs...)
 }
 
-func (s *Site) UpdateUserNameAndExpiryAndAccessLevel(userid int, firstname string, surname string, expiry time.Time, level int) error {
-	err := s.UpdateUserInfo(userid, map[string]interface{}{
+func (s *Site) UpdateUserNameAndExpiryAndAccessLevel(ctx context.Context, userid int, firstname string, surname string, expiry time.Time, level int) error {
+	err := s.UpdateUserInfo(ctx, userid, map[string]interface{}{
 		"FirstName":  firstname,
 		"LastName":   surname,
 		"ExpiryDate": expiry,
@@ -486,81 +506,111 @@ func (s *Site) UpdateUserNameAndExpiryAndAccessLevel(userid int, firstname strin
 	if err != nil {
 		return err
 	}
-	err = s.UpdateUserAccessLevel(userid, level)
+	err = s.UpdateUserAccessLevel(ctx, userid, level)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *Site) UpdateAll() {
+// UpdateAll fetches every resource and commits them together.  It holds every resource's lock, always taken in the
+// same order, so a poller can't commit newer data that this would then overwrite.
+func (s *Site) UpdateAll(ctx context.Context) {
 	log.Debug().Str("Site", s.Name).Msg("Starting full update")
-	s.updateLock.Lock()
-	defer s.updateLock.Unlock()
-	var err error
+	s.accessLevelsLock.Lock()
+	defer s.accessLevelsLock.Unlock()
+	s.doorsLock.Lock()
+	defer s.doorsLock.Unlock()
+	s.departmentsLock.Lock()
+	defer s.departmentsLock.Unlock()
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
 	start := time.Now()
-	complete := true
-	err = s.UpdateAccessLevels()
+	var errs []error
+	stepStart := time.Now()
+	accessLevels, err := s.fetchAccessLevels(ctx)
+	s.recordSync(config.ResourceAccessLevels, stepStart, err)
 	if err != nil {
-		complete = false
+		errs = append(errs, err)
 		log.Error().Err(err).Str("Site", s.Name).Msg("Error updating access levels")
 	} else {
 		log.Debug().Str("Site", s.Name).Msg("Updated access levels")
 	}
-	err = s.UpdateDoors()
+	stepStart = time.Now()
+	doors, err := s.fetchDoors(ctx)
+	s.recordSync(config.ResourceDoors, stepStart, err)
 	if err != nil {
-		complete = false
+		errs = append(errs, err)
 		log.Error().Err(err).Str("Site", s.Name).Msg("Error updating doors")
 	} else {
 		log.Debug().Str("Site", s.Name).Msg("Updated doors")
 	}
-	err = s.UpdateDepartments()
+	stepStart = time.Now()
+	departments, err := s.fetchDepartments(ctx)
+	s.recordSync(config.ResourceDepartments, stepStart, err)
 	if err != nil {
-		complete = false
+		errs = append(errs, err)
 		log.Error().Err(err).Str("Site", s.Name).Msg("Error updating departments")
 	} else {
 		log.Debug().Str("Site", s.Name).Msg("Updated departments")
 	}
-	err = s.UpdateUsers()
+	userAccessLevels := accessLevels
+	if userAccessLevels == nil {
+		userAccessLevels = s.snapshot().accessLevels
+	}
+	stepStart = time.Now()
+	users, watermark, err := s.fetchUsers(ctx, s.userQuery(""), userAccessLevels)
+	s.recordSync(config.ResourceUsers, stepStart, err)
 	if err != nil {
-		complete = false
+		errs = append(errs, err)
 		log.Error().Err(err).Str("Site", s.Name).Msg("Error updating users")
 	} else {
 		log.Debug().Str("Site", s.Name).Msg("Updated users")
+		s.userWatermark = watermark
+		s.lastFullUserSync = s.clock()
 	}
+	previous, next := s.commit(func(next *siteState) {
+		next.initialised = true
+		if accessLevels != nil {
+			next.accessLevels = accessLevels
+		}
+		if doors != nil {
+			next.doors = doors
+		}
+		if departments != nil {
+			next.departments = departments
+		}
+		if users != nil {
+			next.users = users
+			next.usersLoaded = true
+		}
+	})
+	if doors != nil {
+		s.publishDoorChanges(previous.doors, next.doors)
+	}
+	if users != nil && previous.usersLoaded {
+		s.publishAllUserChanges(previous.users, next.users)
+	}
+	metrics.ObserveSync(s.SiteID, "all", start, errors.Join(errs...))
 	total := time.Now().Sub(start).Milliseconds()
-	if !complete {
+	if len(errs) > 0 {
 		log.Info().Str("Site", s.Name).Int64("Total (ms)", total).Msg("Full update Failed")
 	} else {
 		log.Debug().Str("Site", s.Name).Int64("Total (ms)", total).Msg("Full update completed")
-		s.LastPolled = time.Now()
 	}
 }
 
-func (s *Site) getLocalFieldName() string {
-	resp, err := s.doGet(fmt.Sprintf("%s%s", s.BaseURL, "/api/v1/users/customfieldnames"))
+func (s *Site) getLocalFieldName(ctx context.Context) string {
+	fields, err := s.backend.CustomFields(ctx)
 	if err != nil {
-		return ""
-	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to get custom fields")
-		return ""
-	}
-	fields := make([]*CustomFieldDefinition, 20)
-	err = json.Unmarshal(bodyData, &fields)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to unmarshall custom fields")
+		log.Error().Err(err).Str("Site", s.Name).Msg("Unable to get custom fields")
 		return ""
 	}
 	if s.localIDFieldName == "" {
 		return ""
 	}
 	for index := range fields {
-		if fields[index].Name == s.localIDFieldName {
+		if fields[index] != nil && fields[index].Name == s.localIDFieldName {
 			if fields[index].ID == 1 || fields[index].ID == 2 {
 				return fmt.Sprintf("%s%d_%s", "Field", fields[index].ID, "100")
 			} else if fields[index].ID == 6 || fields[index].ID == 7 {
@@ -575,131 +625,121 @@ func (s *Site) getLocalFieldName() string {
 	return ""
 }
 
-func (s *Site) UpdateUser(userID int) error {
-	return s.updateUsersWithData(fmt.Sprintf("SELECT *, %s as LocalID FROM UsersEx WHERE userID=%d AND Active=1", s.LocalIDField, userID))
-}
-
-func (s *Site) UpdateUsers() error {
-	return s.updateUsersWithData(fmt.Sprintf("SELECT *, %s as LocalID FROM UsersEx WHERE Active=1", s.LocalIDField))
-}
-
-func (s *Site) updateUsersWithData(query string) error {
-	resp, err := s.doGet(fmt.Sprintf("%s/api/v1/customquery/querydb?query=%s", s.BaseURL, url.QueryEscape(query)))
+// UpdateUser refetches a single user.  It takes the users lock, so a full sync that fetched its users before this
+// change can't commit over it afterwards.
+func (s *Site) UpdateUser(ctx context.Context, userID int) error {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+	users, _, err := s.fetchUsers(ctx, UserQuery{LocalIDColumn: s.LocalIDField, UserID: userID}, s.snapshot().accessLevels)
 	if err != nil {
 		return err
 	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to pull users")
-		return errors.New("unable to update user info")
+	previous, _ := s.commit(func(next *siteState) {
+		updated := maps.Clone(next.users)
+		if user, ok := users[userID]; ok {
+			updated[userID] = user
+		} else {
+			delete(updated, userID)
+		}
+		next.users = updated
+	})
+	if previous.usersLoaded && (previous.users[userID] != nil || users[userID] != nil) {
+		s.publishUserChanges(previous.users[userID], users[userID])
+	}
+	return nil
+}
+
+// UpdateUsers fetches the users that have changed since the last sync if the site has a changed column configured,
+// or all users if it doesn't or a full sync is due.
+func (s *Site) UpdateUsers(ctx context.Context) error {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+	if s.fullUserSyncDue() {
+		return s.syncAllUsers(ctx)
 	}
-	data := make([]*userSQLQuery, 0)
-	err = json.Unmarshal(bodyData, &data)
+	return s.syncChangedUsers(ctx)
+}
+
+// fetchUsers returns the users matching the query, along with the latest changed time of any of them if the query
+// asked for it.
+func (s *Site) fetchUsers(ctx context.Context, query UserQuery, accessLevels map[int]*AccessLevel) (map[int]*User, string, error) {
+	data, err := s.backend.QueryUsers(ctx, query)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
+	users := make(map[int]*User, len(data))
+	individual := make([]*UserRecord, 0)
+	watermark := query.ChangedSince
 	for id := range data {
-		userID := data[id].ID
-		if _, ok := s.Users[userID]; !ok {
-			s.Users[userID] = &User{}
+		if changed := normaliseChangedAt(data[id].ChangedAt); changed > watermark {
+			watermark = changed
 		}
-		s.Users[userID].ID = data[id].ID
+		user := &User{}
+		user.ID = data[id].ID
 		if updatedTime, err := time.ParseInLocation("2006-01-02T15:04:05", data[id].ActivateDate, time.Local); err == nil {
-			s.Users[userID].Activated = updatedTime
+			user.Activated = updatedTime
 		} else {
-			s.Users[userID].Activated, _ = time.Parse(""+
+			user.Activated, _ = time.Parse(""+
 				"2006-01-02", "0001-01-01")
 		}
 		if updatedTime, err := time.ParseInLocation("2006-01-02T15:04:05", data[id].ExpiryDate, time.Local); err == nil {
-			s.Users[userID].Expiry = updatedTime
+			user.Expiry = updatedTime
 		} else {
-			s.Users[userID].Expiry, _ = time.Parse("2006-01-02", "0001-01-01")
+			user.Expiry, _ = time.Parse("2006-01-02", "0001-01-01")
 		}
-		s.Users[userID].FirstName = data[id].Firstname
-		s.Users[userID].Surname = data[id].Surname
-		s.Users[userID].PIN = data[id].PIN
-		s.Users[userID].GUID = data[id].UserGUID
+		user.FirstName = data[id].Firstname
+		user.Surname = data[id].Surname
+		user.PIN = data[id].PIN
+		user.GUID = data[id].UserGUID
 		if updatedTime, err := time.ParseInLocation("2006-01-02T15:04:05", data[id].LastAccessTime, time.Local); err == nil {
-			s.Users[userID].LastUpdated = updatedTime
+			user.LastUpdated = updatedTime
 		} else {
-			s.Users[userID].LastUpdated, _ = time.Parse("2006-01-02", "0001-01-01")
+			user.LastUpdated, _ = time.Parse("2006-01-02", "0001-01-01")
 		}
-		s.Users[userID].LastKnownLocation = data[id].LastLocation
-		s.Users[userID].Departments = []Department{{ID: data[id].DepartmentID, Name: data[id].DepartmentName}}
+		user.LastKnownLocation = data[id].LastLocation
+		user.Departments = []Department{{ID: data[id].DepartmentID, Name: data[id].DepartmentName}}
 		if strings.HasPrefix(data[id].AccessLevelName, "Individual: ") {
-			s.Users[userID].AccessLevels = s.getExactAccessLevel(data[id])
+			individual = append(individual, data[id])
 		} else {
-			s.Users[userID].AccessLevels = []string{data[id].AccessLevelName}
+			user.AccessLevels = []string{data[id].AccessLevelName}
 		}
-		s.Users[userID].LocalID = data[id].LocalID
-	}
-	return nil
-}
-
-func (s *Site) getExactAccessLevel(data *userSQLQuery) []string {
-	resp, err := s.doGet(fmt.Sprintf("%s%s%d%s", s.BaseURL, "/api/v1/users/", data.ID, "/doorpermissionset"))
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to get exact permissions")
-		return []string{data.AccessLevelName}
-	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to get permissions")
-		return []string{data.AccessLevelName}
-	}
-	permissions := Permission{}
-	err = json.Unmarshal(bodyData, &permissions)
-	if err != nil {
-		return []string{data.AccessLevelName}
+		user.LocalID = data[id].LocalID
+		users[user.ID] = user
 	}
-	accessLevels := make([]string, 0)
-	for index := range permissions.AccessLevels {
-		accessLevels = append(accessLevels, s.AccessLevels[permissions.AccessLevels[index]].Name)
+	s.fetchExactAccessLevels(ctx, individual, users, accessLevels)
+	if query.UserID == 0 && query.ChangedSince == "" {
+		s.prunePermissionCache(users)
 	}
-	for index := range permissions.IndividualPermissions {
-		if s.AccessLevels[permissions.IndividualPermissions[index].ID] != nil {
-			accessLevels = append(accessLevels, s.AccessLevels[permissions.IndividualPermissions[index].ID].Name)
-		} else {
-			log.Debug().Str("Site", s.Name).Interface("Idv Perm ID", permissions.IndividualPermissions[index].ID).Interface("User", data.Firstname+" "+data.Surname).Msg("Discarding invalid access level")
-		}
-	}
-	return accessLevels
+	return users, watermark, nil
 }
 
-func (s *Site) UpdateAccessLevels() error {
-	levels, err := s.updateLevels()
+func (s *Site) UpdateAccessLevels(ctx context.Context) error {
+	s.accessLevelsLock.Lock()
+	defer s.accessLevelsLock.Unlock()
+	accessLevels, err := s.fetchAccessLevels(ctx)
 	if err != nil {
 		return err
 	}
-	areas, err := s.updateAreas()
-	if err != nil {
-		return err
-	}
-	s.AccessLevels = lo.Assign(levels, areas)
+	s.commit(func(next *siteState) {
+		next.accessLevels = accessLevels
+	})
 	return nil
 }
 
-func (s *Site) updateLevels() (map[int]*AccessLevel, error) {
-	resp, err := s.doGet(fmt.Sprintf("%s%s", s.BaseURL, "/api/v1/accesslevels"))
+func (s *Site) fetchAccessLevels(ctx context.Context) (map[int]*AccessLevel, error) {
+	levels, err := s.updateLevels(ctx)
 	if err != nil {
 		return nil, err
 	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to pull access levels")
-		return nil, errors.New("unable to pull access levels")
+	areas, err := s.updateAreas(ctx)
+	if err != nil {
+		return nil, err
 	}
-	accesslevels := make([]*AccessLevel, 50)
-	err = json.Unmarshal(bodyData, &accesslevels)
+	return lo.Assign(levels, areas), nil
+}
+
+func (s *Site) updateLevels(ctx context.Context) (map[int]*AccessLevel, error) {
+	accesslevels, err := s.backend.AccessLevels(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -708,118 +748,73 @@ func (s *Site) updateLevels() (map[int]*AccessLevel, error) {
 	}), nil
 }
 
-func (s *Site) updateAreas() (map[int]*AccessLevel, error) {
-	resp, err := s.doGet(fmt.Sprintf("%s%s", s.BaseURL, "/api/v1/accesslevels/areas"))
+func (s *Site) updateAreas(ctx context.Context) (map[int]*AccessLevel, error) {
+	areas, err := s.backend.Areas(ctx)
 	if err != nil {
 		return nil, err
 	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to pull access levels")
-		return nil, errors.New("unable to pull access levels")
-	}
-	accesslevels := make([]*Area, 50)
-	err = json.Unmarshal(bodyData, &accesslevels)
+	return lo.SliceToMap[*Area, int, *AccessLevel](areas, func(item *Area) (int, *AccessLevel) {
+		return 10000 + item.ID, &AccessLevel{ID: 10000 + item.ID, Name: "Idv: " + item.Name}
+	}), nil
+}
+
+func (s *Site) UpdateDoors(ctx context.Context) error {
+	s.doorsLock.Lock()
+	defer s.doorsLock.Unlock()
+	doors, err := s.fetchDoors(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	moo := lo.SliceToMap[*Area, int, *AccessLevel](accesslevels, func(item *Area) (int, *AccessLevel) {
-		return 10000 + item.ID, &AccessLevel{ID: 10000 + item.ID, Name: "Idv: " + item.Name}
+	previous, next := s.commit(func(next *siteState) {
+		next.doors = doors
 	})
-	return moo, nil
+	s.publishDoorChanges(previous.doors, next.doors)
+	return nil
 }
 
-func (s *Site) UpdateDoors() error {
-	doors, err := s.getDoors()
+func (s *Site) fetchDoors(ctx context.Context) (map[uint64]*Door, error) {
+	doors, err := s.backend.Doors(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	doorStatus, err := s.getDoorStatus()
+	doorStatus, err := s.backend.DeviceStatus(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s.Doors = lo.SliceToMap(doors, func(item *Door) (uint64, *Door) {
+	doorMap := lo.SliceToMap(doors, func(item *Door) (uint64, *Door) {
 		item.StatusFlag = doorStatus[int(item.ID)]
 		item.AlarmStatus = item.StatusFlag & DoorStatus_IntruderAlarm
 		return item.ID, item
 	})
-	lo.ForEach(s.config.MonitoredDoors, func(item config.MonitoredDoor, index int) {
-		if val, ok := s.Doors[uint64(item.ID)]; ok {
+	lo.ForEach(s.getConfig().MonitoredDoors, func(item config.MonitoredDoor, index int) {
+		if val, ok := doorMap[uint64(item.ID)]; ok {
 			val.AlarmZone = item.Zone
 		}
 	})
-	return nil
+	return doorMap, nil
 }
 
-func (s *Site) getDoors() ([]*Door, error) {
-	resp, err := s.doGet(fmt.Sprintf("%s/api/v1/doors", s.BaseURL))
-	if err != nil {
-		return nil, err
-	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to pull doors")
-		return nil, errors.New("unable to pull doors")
-	}
-	doorSlice := make([]*Door, 50)
-	err = json.Unmarshal(bodyData, &doorSlice)
+func (s *Site) UpdateDepartments(ctx context.Context) error {
+	s.departmentsLock.Lock()
+	defer s.departmentsLock.Unlock()
+	departments, err := s.fetchDepartments(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return doorSlice, nil
+	s.commit(func(next *siteState) {
+		next.departments = departments
+	})
+	return nil
 }
 
-func (s *Site) getDoorStatus() (map[int]int, error) {
-	query := "SELECT Address, statusFlag FROM devices"
-	resp, err := s.doGet(fmt.Sprintf("%s/api/v1/customquery/querydb?query=%s", s.BaseURL, url.QueryEscape(query)))
+func (s *Site) fetchDepartments(ctx context.Context) (map[int]*Department, error) {
+	departments, err := s.backend.Departments(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("unable to pull device status'")
-	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	sqlMap := make([]*deviceSQLQuery, 0)
-	err = json.Unmarshal(bodyData, &sqlMap)
-	if err != nil {
-		return nil, err
-	}
-	return lo.Associate(sqlMap, func(item *deviceSQLQuery) (int, int) {
-		return item.ID, item.Status
-	}), nil
-}
-
-func (s *Site) UpdateDepartments() error {
-	resp, err := s.doGet(fmt.Sprintf("%s%s", s.BaseURL, "/api/v1/departments"))
-	if err != nil {
-		return err
-	}
-	bodyData, _ := io.ReadAll(resp.Body)
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-	if resp.StatusCode != http.StatusOK {
-		s.logger.Error().Int("Status", resp.StatusCode).Str("URL", resp.Request.URL.String()).Msg("Unable to update doors")
-		return errors.New("unable to update doors")
-	}
-	departments := make([]*Department, 50)
-	err = json.Unmarshal(bodyData, &departments)
-	if err != nil {
-		return err
-	}
-	s.Departments = lo.SliceToMap(departments, func(item *Department) (int, *Department) {
+	return lo.SliceToMap(departments, func(item *Department) (int, *Department) {
 		return item.ID, item
-	})
-	return nil
+	}), nil
 }
 
 func GetTomorrow() time.Time {
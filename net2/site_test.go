@@ -0,0 +1,280 @@
+package net2
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const testSiteConfig = `
+id: 1
+name: Test
+username: admin
+password: password
+ip: 127.0.0.1
+localIDField: Staff Number
+categories:
+  - name: staff
+    departments:
+      - prefix: "Staff"
+  - name: visitors
+    departments:
+      - prefix: "Visitor"
+`
+
+// newTestBackend returns a fake with two departments, two access levels, two doors and three users.
+func newTestBackend() *FakeBackend {
+	backend := NewFakeBackend()
+	backend.AddCustomField(CustomFieldDefinition{ID: 14, Name: "Staff Number"})
+	backend.AddDepartment(Department{ID: 1, Name: "Staff - Engineering"})
+	backend.AddDepartment(Department{ID: 2, Name: "Visitor - Guests"})
+	backend.AddAccessLevel(AccessLevel{ID: 1, Name: "All Hours"})
+	backend.AddAccessLevel(AccessLevel{ID: 2, Name: "Working Hours"})
+	backend.AddDoor(Door{ID: 1001, Name: "Front Door"}, 0)
+	backend.AddDoor(Door{ID: 1002, Name: "Goods Entrance"}, 0)
+	backend.AddUser(testUser(1, "Ada", "Lovelace", "1001", 1, "2099-12-31T23:59:59"))
+	backend.AddUser(testUser(2, "Charles", "Babbage", "1002", 2, "2024-06-30T23:59:59"))
+	backend.AddUser(testUser(3, "Grace", "Hopper", "1003", 1, ""))
+	return backend
+}
+
+func testUser(id int, firstName string, surname string, localID string, department int, expiry string) UserRecord {
+	departments := map[int]string{1: "Staff - Engineering", 2: "Visitor - Guests"}
+	return UserRecord{
+		ID:              id,
+		UserGUID:        "guid-" + localID,
+		Firstname:       firstName,
+		Surname:         surname,
+		ActivateDate:    "2024-01-01T00:00:00",
+		ExpiryDate:      expiry,
+		DepartmentID:    department,
+		DepartmentName:  departments[department],
+		AccessLevelName: "All Hours",
+		LocalID:         localID,
+	}
+}
+
+func testConfig(t *testing.T, id int) *config.SiteConfig {
+	t.Helper()
+	conf := &config.SiteConfig{}
+	if err := yaml.Unmarshal([]byte(testSiteConfig), conf); err != nil {
+		t.Fatalf("unable to parse site config: %v", err)
+	}
+	conf.ID = id
+	if err := config.ValidateSite(conf); err != nil {
+		t.Fatalf("invalid site config: %v", err)
+	}
+	return conf
+}
+
+// newTestSite starts a site over the backend and waits for its initial update.
+func newTestSite(t *testing.T, backend Backend) *Site {
+	t.Helper()
+	logger := zerolog.Nop()
+	site := NewSite(testConfig(t, 1), backend, &logger)
+	if err := site.Start(); err != nil {
+		t.Fatalf("unable to start site: %v", err)
+	}
+	t.Cleanup(site.Stop)
+	testutil.WaitFor(t, site.Ready)
+	return site
+}
+
+// newIdleSite returns an initialised site over the backend that isn't running, with its polling config changed by
+// polling if it isn't nil, and a clock that reads now.
+func newIdleSite(t *testing.T, backend Backend, polling func(*config.Polling), now *time.Time) *Site {
+	t.Helper()
+	conf := testConfig(t, 1)
+	if polling != nil {
+		polling(&conf.Polling)
+	}
+	logger := zerolog.Nop()
+	site := NewSite(conf, backend, &logger)
+	site.ctx = context.Background()
+	site.state.Store(&siteState{initialised: true})
+	site.clock = func() time.Time {
+		return *now
+	}
+	return site
+}
+
+func TestSiteLoadsEverything(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	if got := len(site.GetUsers()); got != 3 {
+		t.Errorf("users = %d, want 3", got)
+	}
+	if got := len(site.GetDoors()); got != 2 {
+		t.Errorf("doors = %d, want 2", got)
+	}
+	if got := len(site.GetDepartments()); got != 2 {
+		t.Errorf("departments = %d, want 2", got)
+	}
+	user := site.GetUser(1)
+	if user == nil {
+		t.Fatal("user 1 not loaded")
+	}
+	if user.FirstName != "Ada" || user.LocalID != "1001" || user.Departments[0].ID != 1 {
+		t.Errorf("user 1 = %+v", user)
+	}
+}
+
+// TestSiteConcurrentUpdatesAndReads is meant to be run with -race, it updates the site from several goroutines while
+// others read from it.
+func TestSiteConcurrentUpdatesAndReads(t *testing.T) {
+	backend := newTestBackend()
+	site := newTestSite(t, backend)
+	ctx := context.Background()
+	stop := make(chan struct{})
+	readers := sync.WaitGroup{}
+	for range 4 {
+		readers.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, user := range site.GetUsers() {
+					_ = user.FirstName + user.LocalID
+				}
+				for _, door := range site.GetDoors() {
+					_ = door.IsOpen()
+				}
+				_ = site.GetUser(1)
+			}
+		})
+	}
+	writers := sync.WaitGroup{}
+	writers.Go(func() {
+		for range 20 {
+			site.UpdateAll(ctx)
+		}
+	})
+	writers.Go(func() {
+		for index := range 50 {
+			backend.SetDoorStatus(1001, index%2)
+			if err := site.UpdateDoors(ctx); err != nil {
+				t.Errorf("updating doors: %v", err)
+			}
+		}
+	})
+	writers.Go(func() {
+		for range 50 {
+			if err := site.UpdateUser(ctx, 1); err != nil {
+				t.Errorf("updating user: %v", err)
+			}
+			if err := site.UpdateUsers(ctx); err != nil {
+				t.Errorf("updating users: %v", err)
+			}
+		}
+	})
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	if got := len(site.GetUsers()); got != 3 {
+		t.Errorf("users = %d, want 3", got)
+	}
+}
+
+// blockingBackend holds the next full user query after it has fetched its data, until released.
+type blockingBackend struct {
+	*FakeBackend
+	lock    sync.Mutex
+	armed   bool
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) arm() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.armed = true
+	b.fetched = make(chan struct{})
+	b.release = make(chan struct{})
+}
+
+func (b *blockingBackend) QueryUsers(ctx context.Context, query UserQuery) ([]*UserRecord, error) {
+	users, err := b.FakeBackend.QueryUsers(ctx, query)
+	b.lock.Lock()
+	block := b.armed && query.UserID == 0
+	if block {
+		b.armed = false
+	}
+	b.lock.Unlock()
+	if block {
+		close(b.fetched)
+		<-b.release
+	}
+	return users, err
+}
+
+func TestSiteUpdateUserIsNotOverwrittenByFullSync(t *testing.T) {
+	backend := &blockingBackend{FakeBackend: newTestBackend()}
+	site := newTestSite(t, backend)
+	ctx := context.Background()
+	backend.arm()
+	done := sync.WaitGroup{}
+	done.Go(func() {
+		if err := site.UpdateUsers(ctx); err != nil {
+			t.Errorf("updating users: %v", err)
+		}
+	})
+	<-backend.fetched
+	backend.AddUser(testUser(1, "Augusta", "Lovelace", "1001", 1, "2099-12-31T23:59:59"))
+	done.Go(func() {
+		if err := site.UpdateUser(ctx, 1); err != nil {
+			t.Errorf("updating user: %v", err)
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	done.Wait()
+	if got := site.GetUser(1).FirstName; got != "Augusta" {
+		t.Errorf("first name = %s, want Augusta", got)
+	}
+}
+
+func userIDs(users map[int]*User) []int {
+	return slices.Sorted(maps.Keys(users))
+}
+
+func TestSiteGetCategoryUsers(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	tests := []struct {
+		category string
+		scope    string
+		want     []int
+		wantErr  error
+	}{
+		{category: "staff", scope: ScopeAll, want: []int{1, 3}},
+		{category: "staff", scope: "", want: []int{1, 3}},
+		{category: "visitors", scope: ScopeAll, want: []int{2}},
+		{category: "visitors", scope: ScopeActive, want: []int{}},
+		{category: "staff", scope: ScopeActive, want: []int{1, 3}},
+		{category: "contractors", scope: ScopeAll, wantErr: ErrCategoryNotFound},
+		{category: "staff", scope: "yesterday", wantErr: ErrInvalidScope},
+	}
+	for _, test := range tests {
+		t.Run(test.category+"/"+test.scope, func(t *testing.T) {
+			users, err := site.GetCategoryUsers(test.category, test.scope)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				return
+			}
+			if got := userIDs(users); !slices.Equal(got, test.want) {
+				t.Errorf("users = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -2,78 +2,90 @@ package net2
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/greboid/net2/config"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/samber/lo"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
-	"net/http"
-	"net/url"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
 
-func GetSites(conf *config.Config, logger *zerolog.Logger) []*Site {
+func GetSites(conf *config.Config, logger *zerolog.Logger) ([]*Site, error) {
 	sites := make([]*Site, 0, len(conf.Sites))
 	for index := range conf.Sites {
-		var baseURL string
-		if conf.Sites[index].Https {
-			baseURL = fmt.Sprintf("https://%s:%d", conf.Sites[index].IP, conf.Sites[index].Port)
-		} else {
-			baseURL = fmt.Sprintf("http://%s:%d", conf.Sites[index].IP, conf.Sites[index].Port)
+		site, err := newHTTPSite(conf, &conf.Sites[index], logger)
+		if err != nil {
+			return nil, err
 		}
-		sites = append(sites, &Site{
-			config:           &conf.Sites[index],
-			httpClient:       getHttpClient(conf.ClientID, conf.Sites[index].Username, conf.Sites[index].Password, baseURL),
-			clientID:         conf.ClientID,
-			QuitChan:         make(chan bool),
-			BaseURL:          baseURL,
-			SiteID:           conf.Sites[index].ID,
-			Name:             conf.Sites[index].Name,
-			LastPolled:       time.Time{},
-			localIDFieldName: conf.Sites[index].LocalIDField,
-			logger:           logger,
-		})
-	}
-	return sites
-}
-
-func getHttpClient(clientID string, username string, password string, baseURL string) *http.Client {
-	oauthConfig := clientcredentials.Config{
-		ClientID: clientID,
-		TokenURL: fmt.Sprintf("%s/api/v1/authorization/tokens", baseURL),
-		EndpointParams: url.Values{
-			"username":   {username},
-			"password":   {password},
-			"grant_type": {"password"},
-			"scope":      {"offline_access"},
-		},
-	}
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	sslcli := &http.Client{Transport: tr}
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, sslcli)
-	httpClient := oauth2.NewClient(ctx, oauthConfig.TokenSource(ctx))
-	return httpClient
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+func newHTTPSite(conf *config.Config, siteConf *config.SiteConfig, logger *zerolog.Logger) (*Site, error) {
+	var recordDir, replayDir string
+	if conf.RecordDir != "" {
+		recordDir = filepath.Join(conf.RecordDir, strconv.Itoa(siteConf.ID))
+	}
+	if conf.ReplayDir != "" {
+		replayDir = filepath.Join(conf.ReplayDir, strconv.Itoa(siteConf.ID))
+	}
+	backend, err := NewHTTPBackend(siteConf, conf.ClientID.Value(), recordDir, replayDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backend for site %s: %w", siteConf.Name, err)
+	}
+	return NewSite(siteConf, backend, logger), nil
+}
+
+func NewSite(conf *config.SiteConfig, backend Backend, logger *zerolog.Logger) *Site {
+	site := &Site{
+		backend:          backend,
+		QuitChan:         make(chan bool),
+		SiteID:           conf.ID,
+		Name:             conf.Name,
+		localIDFieldName: conf.LocalIDField,
+		logger:           logger,
+		clock:            time.Now,
+	}
+	site.config.Store(conf)
+	return site
 }
 
+var (
+	ErrSiteExists   = errors.New("site already exists")
+	ErrSiteNotFound = errors.New("site not found")
+)
+
 type SiteManager struct {
-	started bool
-	sites   map[int]*Site
-	Logger  *zerolog.Logger
+	lock            sync.RWMutex
+	reconfigureLock sync.Mutex
+	started         bool
+	sites           map[int]*Site
+	config          *config.Config
+	Logger          *zerolog.Logger
+	Changes         *ChangeBus
+	ConfigFile      string
 }
 
-func (m *SiteManager) Start(sites []*Site) error {
+func (m *SiteManager) Start(conf *config.Config, sites []*Site) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.started {
 		return nil
 	}
+	m.config = conf
+	if m.Changes == nil {
+		m.Changes = NewChangeBus(1000)
+	}
 	m.sites = lo.SliceToMap(sites, func(item *Site) (int, *Site) {
+		item.changes = m.Changes
 		return item.SiteID, item
 	})
 	log.Info().Msg("Starting sites")
@@ -93,6 +105,8 @@ func (m *SiteManager) Start(sites []*Site) error {
 }
 
 func (m *SiteManager) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if !m.started {
 		return
 	}
@@ -103,6 +117,8 @@ func (m *SiteManager) Stop() {
 }
 
 func (m *SiteManager) GetSite(id int) *Site {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	if !m.started {
 		return nil
 	}
@@ -110,27 +126,31 @@ func (m *SiteManager) GetSite(id int) *Site {
 }
 
 func (m *SiteManager) GetSites() map[int]*Site {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	if !m.started {
 		return nil
 	}
-	return m.sites
+	return maps.Clone(m.sites)
 }
 
 func (m *SiteManager) Count() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 	if !m.started {
 		return 0
 	}
 	return len(m.sites)
 }
 
-func (m *SiteManager) UpdateAll() {
+func (m *SiteManager) UpdateAll(ctx context.Context) {
 	start := time.Now()
 	log.Debug().Msg("Update all sites started")
 	wg := new(sync.WaitGroup)
-	for _, site := range m.sites {
+	for _, site := range m.GetSites() {
 		wg.Add(1)
 		go func(s *Site, wg *sync.WaitGroup) {
-			s.UpdateAll()
+			s.UpdateAll(ctx)
 			wg.Done()
 		}(site, wg)
 	}
@@ -138,3 +158,195 @@ func (m *SiteManager) UpdateAll() {
 	total := time.Now().Sub(start).Milliseconds()
 	log.Debug().Int64("Total (ms)", total).Msg("Update all sites finished")
 }
+
+// Config returns the config the sites are currently running with.
+func (m *SiteManager) Config() *config.Config {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.config
+}
+
+// AddSite starts a new site and saves it to the config file.
+func (m *SiteManager) AddSite(site config.SiteConfig) error {
+	return m.editConfig(func(conf *config.Config) error {
+		if lo.ContainsBy(conf.RawSites, func(item config.SiteConfig) bool { return item.ID == site.ID }) {
+			return ErrSiteExists
+		}
+		conf.RawSites = append(conf.RawSites, site)
+		return nil
+	})
+}
+
+// UpdateSite replaces the config of an existing site and saves it to the config file.
+func (m *SiteManager) UpdateSite(site config.SiteConfig) error {
+	return m.editConfig(func(conf *config.Config) error {
+		_, index, found := lo.FindIndexOf(conf.RawSites, func(item config.SiteConfig) bool { return item.ID == site.ID })
+		if !found {
+			return ErrSiteNotFound
+		}
+		conf.RawSites[index] = site
+		return nil
+	})
+}
+
+// RemoveSite stops a site and removes it from the config file.
+func (m *SiteManager) RemoveSite(id int) error {
+	return m.editConfig(func(conf *config.Config) error {
+		_, index, found := lo.FindIndexOf(conf.RawSites, func(item config.SiteConfig) bool { return item.ID == id })
+		if !found {
+			return ErrSiteNotFound
+		}
+		conf.RawSites = append(conf.RawSites[:index], conf.RawSites[index+1:]...)
+		return nil
+	})
+}
+
+// SiteConfig returns a copy of a site's config as it was written, without the defaults filled in.
+func (m *SiteManager) SiteConfig(id int) (config.SiteConfig, bool) {
+	conf := m.Config()
+	if conf == nil {
+		return config.SiteConfig{}, false
+	}
+	return lo.Find(rawSites(conf), func(item config.SiteConfig) bool { return item.ID == id })
+}
+
+// rawSites returns the sites as they were written.  Configs that weren't loaded from a file don't have them, so their
+// sites are used as they are.
+func rawSites(conf *config.Config) []config.SiteConfig {
+	if conf.RawSites == nil {
+		return conf.Sites
+	}
+	return conf.RawSites
+}
+
+func (m *SiteManager) editConfig(edit func(conf *config.Config) error) error {
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	current := m.Config()
+	if current == nil {
+		return errors.New("sites not started")
+	}
+	next := *current
+	next.RawSites = slices.Clone(rawSites(current))
+	if err := edit(&next); err != nil {
+		return err
+	}
+	// The edits are made to the raw sites, which are what's saved, and the running sites are a validated copy.
+	next.Sites = slices.Clone(next.RawSites)
+	for index := range next.Sites {
+		if err := config.ValidateSite(&next.Sites[index]); err != nil {
+			return err
+		}
+	}
+	// The file is saved first, so the running sites are never changed in a way that would be lost on restart.  If
+	// the new sites then fail to start, the file is put back as it was.
+	if m.ConfigFile != "" {
+		if err := config.SaveSites(m.ConfigFile, next.RawSites); err != nil {
+			return fmt.Errorf("unable to save sites: %w", err)
+		}
+	}
+	if err := m.reconfigure(&next); err != nil {
+		if m.ConfigFile != "" {
+			if restoreErr := config.SaveSites(m.ConfigFile, rawSites(current)); restoreErr != nil {
+				return errors.Join(err, fmt.Errorf("unable to restore saved sites: %w", restoreErr))
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Reconfigure applies a new config to the running sites.  Sites no longer in the config are stopped, new sites are
+// started, and sites whose connection details, name or local ID field have changed are replaced.  Any other changes
+// are applied in place, keeping the site's caches and schedules.  Every new or replaced site is started before
+// anything is changed, and if any of them fail the running sites and config are left as they were.
+func (m *SiteManager) Reconfigure(conf *config.Config) error {
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	return m.reconfigure(conf)
+}
+
+func (m *SiteManager) reconfigure(conf *config.Config) error {
+	current := m.GetSites()
+	if current == nil {
+		return errors.New("sites not started")
+	}
+	var errs []error
+	replacements := make(map[int]*Site)
+	inPlace := make(map[*Site]*config.SiteConfig)
+	// Every backend logs in with the client ID, so changing it restarts every site.
+	clientIDChanged := conf.ClientID != m.Config().ClientID
+	for index := range conf.Sites {
+		siteConf := &conf.Sites[index]
+		existing, ok := current[siteConf.ID]
+		if ok && !clientIDChanged && !requiresRestart(existing.getConfig(), siteConf) {
+			if !reflect.DeepEqual(existing.getConfig(), siteConf) {
+				inPlace[existing] = siteConf
+			}
+			continue
+		}
+		site, err := newHTTPSite(conf, siteConf, m.Logger)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		site.changes = m.Changes
+		if err = site.Start(); err != nil {
+			site.Stop()
+			errs = append(errs, fmt.Errorf("unable to start site %s: %w", siteConf.Name, err))
+			continue
+		}
+		replacements[siteConf.ID] = site
+	}
+	if len(errs) > 0 {
+		for _, site := range replacements {
+			site.Stop()
+		}
+		return errors.Join(errs...)
+	}
+	wanted := lo.SliceToMap(conf.Sites, func(item config.SiteConfig) (int, bool) {
+		return item.ID, true
+	})
+	stopped := make([]*Site, 0)
+	m.lock.Lock()
+	for site, siteConf := range inPlace {
+		log.Info().Str("Site", siteConf.Name).Msg("Reconfiguring site")
+		site.config.Store(siteConf)
+	}
+	for id, site := range m.sites {
+		if !wanted[id] {
+			log.Info().Str("Site", site.Name).Msg("Removing site")
+			stopped = append(stopped, site)
+			delete(m.sites, id)
+		}
+	}
+	for id, site := range replacements {
+		if existing, ok := m.sites[id]; ok {
+			log.Info().Str("Site", site.Name).Msg("Restarting site")
+			stopped = append(stopped, existing)
+		} else {
+			log.Info().Str("Site", site.Name).Msg("Adding site")
+		}
+		m.sites[id] = site
+	}
+	m.config = conf
+	m.lock.Unlock()
+	for _, site := range stopped {
+		site.Stop()
+	}
+	return nil
+}
+
+func requiresRestart(current *config.SiteConfig, next *config.SiteConfig) bool {
+	return current.IP != next.IP ||
+		current.Port != next.Port ||
+		current.Https != next.Https ||
+		current.TLS != next.TLS ||
+		current.Username != next.Username ||
+		current.Password != next.Password ||
+		current.Name != next.Name ||
+		current.LocalIDField != next.LocalIDField ||
+		current.EventBufferSize != next.EventBufferSize ||
+		current.Polling.UsersChangedColumn != next.Polling.UsersChangedColumn ||
+		current.Upstream != next.Upstream
+}
@@ -0,0 +1,284 @@
+package net2
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/rs/zerolog"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// newReplayManager starts a manager with site 1 replaying testdata/replay/1, new sites created by reconfiguring it
+// replay the same directory under their own ID.
+func newReplayManager(t *testing.T) *SiteManager {
+	t.Helper()
+	logger := zerolog.Nop()
+	conf := &config.Config{ReplayDir: "testdata/replay", Sites: []config.SiteConfig{*testConfig(t, 1)}}
+	sites, err := GetSites(conf, &logger)
+	if err != nil {
+		t.Fatalf("creating sites: %v", err)
+	}
+	manager := &SiteManager{Logger: &logger}
+	if err = manager.Start(conf, sites); err != nil {
+		t.Fatalf("starting sites: %v", err)
+	}
+	t.Cleanup(manager.Stop)
+	testutil.WaitFor(t, manager.GetSite(1).Ready)
+	return manager
+}
+
+func TestSiteManagerReconfigure(t *testing.T) {
+	tests := []struct {
+		name      string
+		edit      func(conf *config.Config)
+		wantErr   bool
+		wantSites []int
+		restarted bool
+		wantName  string
+	}{
+		{
+			name:      "unchanged",
+			edit:      func(conf *config.Config) {},
+			wantSites: []int{1},
+			wantName:  "Test",
+		},
+		{
+			name: "changes applied in place",
+			edit: func(conf *config.Config) {
+				conf.Sites[0].Categories = append(conf.Sites[0].Categories, config.Category{Name: "everyone"})
+			},
+			wantSites: []int{1},
+			wantName:  "Test",
+		},
+		{
+			name:      "renaming restarts the site",
+			edit:      func(conf *config.Config) { conf.Sites[0].Name = "Renamed" },
+			wantSites: []int{1},
+			restarted: true,
+			wantName:  "Renamed",
+		},
+		{
+			name: "changing the client ID restarts the site",
+			edit: func(conf *config.Config) {
+				_ = yaml.Unmarshal([]byte("other-client"), &conf.ClientID)
+			},
+			wantSites: []int{1},
+			restarted: true,
+			wantName:  "Test",
+		},
+		{
+			name: "adding a site",
+			edit: func(conf *config.Config) {
+				site := conf.Sites[0]
+				site.ID = 2
+				conf.Sites = append(conf.Sites, site)
+			},
+			wantSites: []int{1, 2},
+			wantName:  "Test",
+		},
+		{
+			name:      "removing a site",
+			edit:      func(conf *config.Config) { conf.Sites = nil },
+			wantSites: []int{},
+		},
+		{
+			name: "a failed site leaves everything as it was",
+			edit: func(conf *config.Config) {
+				conf.Sites[0].Name = "Renamed"
+				conf.Sites[0].Categories = nil
+				site := conf.Sites[0]
+				site.ID = 2
+				site.TLS.CA = "testdata/missing.pem"
+				conf.Sites = append(conf.Sites, site)
+			},
+			wantErr:   true,
+			wantSites: []int{1},
+			wantName:  "Test",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manager := newReplayManager(t)
+			original := manager.GetSite(1)
+			before := manager.Config()
+			next := *before
+			next.Sites = slices.Clone(before.Sites)
+			test.edit(&next)
+			err := manager.Reconfigure(&next)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %t", err, test.wantErr)
+			}
+			ids := make([]int, 0)
+			for id := range manager.GetSites() {
+				ids = append(ids, id)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, test.wantSites) {
+				t.Errorf("sites = %v, want %v", ids, test.wantSites)
+			}
+			if test.wantErr && manager.Config() != before {
+				t.Error("config changed after a failed reconfigure")
+			}
+			site := manager.GetSite(1)
+			if site == nil {
+				return
+			}
+			if restarted := site != original; restarted != test.restarted {
+				t.Errorf("restarted = %t, want %t", restarted, test.restarted)
+			}
+			if site.Name != test.wantName {
+				t.Errorf("name = %s, want %s", site.Name, test.wantName)
+			}
+			want := next.Sites[0].Categories
+			if test.wantErr {
+				want = before.Sites[0].Categories
+			}
+			if got := site.GetCategories(); len(got) != len(want) {
+				t.Errorf("categories = %d, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestSiteManagerEditConfig(t *testing.T) {
+	manager := newReplayManager(t)
+	added := *testConfig(t, 2)
+	if err := manager.AddSite(added); err != nil {
+		t.Fatalf("adding site: %v", err)
+	}
+	if err := manager.AddSite(added); err != ErrSiteExists {
+		t.Errorf("adding the site again = %v, want %v", err, ErrSiteExists)
+	}
+	added.Name = "Second"
+	if err := manager.UpdateSite(added); err != nil {
+		t.Fatalf("updating site: %v", err)
+	}
+	if conf, ok := manager.SiteConfig(2); !ok || conf.Name != "Second" {
+		t.Errorf("site config = %+v", conf)
+	}
+	if site := manager.GetSite(2); site == nil || site.Name != "Second" {
+		t.Errorf("site 2 = %v", site)
+	}
+	if err := manager.RemoveSite(2); err != nil {
+		t.Fatalf("removing site: %v", err)
+	}
+	if err := manager.RemoveSite(2); err != ErrSiteNotFound {
+		t.Errorf("removing the site again = %v, want %v", err, ErrSiteNotFound)
+	}
+	if manager.Count() != 1 {
+		t.Errorf("sites = %d, want 1", manager.Count())
+	}
+}
+
+func TestSiteManagerEditConfigOnlySavesSites(t *testing.T) {
+	manager := newReplayManager(t)
+	manager.ConfigFile = filepath.Join(t.TempDir(), "config.yml")
+	// The file has been edited by hand since the manager's config was loaded.
+	edited := "# Proxy config\nclientid: client\napiport: 9000 # moved\nsites: []\n"
+	if err := os.WriteFile(manager.ConfigFile, []byte(edited), 0o600); err != nil {
+		t.Fatalf("editing config: %v", err)
+	}
+	if err := manager.AddSite(*testConfig(t, 2)); err != nil {
+		t.Fatalf("adding site: %v", err)
+	}
+	data, err := os.ReadFile(manager.ConfigFile)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "# Proxy config\nclientid: client\napiport: 9000 # moved\nsites:\n") {
+		t.Errorf("config = %s", data)
+	}
+	saved := &config.Config{}
+	if err = yaml.Unmarshal(data, saved); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	ids := lo.Map(saved.Sites, func(site config.SiteConfig, _ int) int { return site.ID })
+	if !slices.Equal(ids, []int{1, 2}) {
+		t.Errorf("saved sites = %v, want [1 2]", ids)
+	}
+}
+
+func TestSiteManagerEditConfigSavesSitesWithoutDefaults(t *testing.T) {
+	manager := newReplayManager(t)
+	manager.ConfigFile = filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(manager.ConfigFile, []byte("clientid: client\nsites: []\n"), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	site := config.SiteConfig{}
+	if err := yaml.Unmarshal([]byte(testSiteConfig), &site); err != nil {
+		t.Fatalf("parsing site: %v", err)
+	}
+	site.ID = 2
+	if err := manager.AddSite(site); err != nil {
+		t.Fatalf("adding site: %v", err)
+	}
+	if got := manager.GetSite(2).getConfig(); got.Port != 8080 || got.Polling.Users == 0 || got.Upstream.Attempts == 0 {
+		t.Errorf("running site config = %+v, want defaults filled in", got)
+	}
+	if raw, ok := manager.SiteConfig(2); !ok || raw.Port != 0 || raw.Polling.Users != 0 {
+		t.Errorf("site config = %+v, want it as it was added", raw)
+	}
+	data, err := os.ReadFile(manager.ConfigFile)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	saved := struct {
+		Sites []map[string]interface{} `yaml:"sites"`
+	}{}
+	if err = yaml.Unmarshal(data, &saved); err != nil || len(saved.Sites) != 2 {
+		t.Fatalf("invalid config %v: %s", err, data)
+	}
+	for _, field := range []string{"port", "tls", "heldOpenAfter", "polling", "upstream"} {
+		if _, ok := saved.Sites[1][field]; ok {
+			t.Errorf("saved site has default %s: %v", field, saved.Sites[1])
+		}
+	}
+}
+
+func TestSiteManagerEditConfigSaveFailure(t *testing.T) {
+	manager := newReplayManager(t)
+	manager.ConfigFile = filepath.Join(t.TempDir(), "missing", "config.yml")
+	if err := manager.AddSite(*testConfig(t, 2)); err == nil {
+		t.Fatal("added a site that couldn't be saved")
+	}
+	if manager.GetSite(2) != nil || manager.Count() != 1 {
+		t.Errorf("running sites = %d, want the site that couldn't be saved left out", manager.Count())
+	}
+	if _, ok := manager.SiteConfig(2); ok {
+		t.Error("config has the site that couldn't be saved")
+	}
+}
+
+func TestSiteManagerEditConfigRestoresFileOnFailure(t *testing.T) {
+	manager := newReplayManager(t)
+	manager.ConfigFile = filepath.Join(t.TempDir(), "config.yml")
+	original := "clientid: client\nsites: []\n"
+	if err := os.WriteFile(manager.ConfigFile, []byte(original), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	site := *testConfig(t, 2)
+	site.TLS.CA = "testdata/missing.pem"
+	if err := manager.AddSite(site); err == nil {
+		t.Fatal("added a site that couldn't start")
+	}
+	data, err := os.ReadFile(manager.ConfigFile)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	saved := &config.Config{}
+	if err = yaml.Unmarshal(data, saved); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	if ids := lo.Map(saved.Sites, func(site config.SiteConfig, _ int) int { return site.ID }); !slices.Equal(ids, []int{1}) {
+		t.Errorf("saved sites = %v, want only the running site", ids)
+	}
+	if manager.GetSite(2) != nil {
+		t.Error("site that couldn't start is running")
+	}
+}
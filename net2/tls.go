@@ -0,0 +1,64 @@
+package net2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/greboid/net2/config"
+	"os"
+)
+
+// newTLSConfig builds the client TLS config for a site.  Certificates are verified against the system roots, or the
+// configured CA bundle, unless a fingerprint is pinned, in which case the server's certificate must match it exactly
+// whoever signed it.
+func newTLSConfig(conf *config.TLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: config.TLSVersions[conf.MinVersion],
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if conf.CA != "" {
+		pem, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tls ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in tls ca " + conf.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	switch {
+	case conf.Insecure:
+		tlsConfig.InsecureSkipVerify = true
+	case conf.Fingerprint != "":
+		fingerprint, err := config.ParseFingerprint(conf.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// Chain verification is skipped so self-signed certificates can be pinned, the fingerprint check replaces it.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("net2 server sent no certificate")
+			}
+			actual := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(actual[:], fingerprint) {
+				return fmt.Errorf("net2 certificate fingerprint %x doesn't match the pinned fingerprint", actual)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
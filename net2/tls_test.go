@@ -0,0 +1,190 @@
+package net2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+)
+
+// writeClientCert writes a self-signed client certificate and its key, returning their paths and the certificate.
+func writeClientCert(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "net2proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := writePEM(t, filepath.Join(dir, "client.pem"), "CERTIFICATE", der)
+	keyFile := writePEM(t, filepath.Join(dir, "client.key"), "PRIVATE KEY", keyDER)
+	cert, _ := x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) string {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path
+}
+
+// tlsGet makes a request to the server with the client TLS config built for the site.
+func tlsGet(t *testing.T, conf *config.TLS, url string) error {
+	t.Helper()
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("building tls config: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestNewTLSConfigVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := fmt.Sprintf("%x", sum)
+	colons := strings.ToUpper(fmt.Sprintf("% x", sum[:]))
+	colons = strings.ReplaceAll(colons, " ", ":")
+	otherSum := sha256.Sum256([]byte("another certificate"))
+	ca := writePEM(t, filepath.Join(t.TempDir(), "ca.pem"), "CERTIFICATE", server.Certificate().Raw)
+	_, _, otherCert := writeClientCert(t)
+	otherCA := writePEM(t, filepath.Join(t.TempDir(), "other.pem"), "CERTIFICATE", otherCert.Raw)
+	tests := []struct {
+		name    string
+		conf    config.TLS
+		wantErr string
+	}{
+		{name: "system roots", wantErr: "certificate signed by unknown authority"},
+		{name: "ca", conf: config.TLS{CA: ca}},
+		{name: "other ca", conf: config.TLS{CA: otherCA}, wantErr: "certificate signed by unknown authority"},
+		{name: "fingerprint", conf: config.TLS{Fingerprint: fingerprint}},
+		{name: "fingerprint with colons", conf: config.TLS{Fingerprint: colons}},
+		{name: "fingerprint skips the chain", conf: config.TLS{Fingerprint: fingerprint, CA: otherCA}},
+		{name: "mismatched fingerprint", conf: config.TLS{Fingerprint: fmt.Sprintf("%x", otherSum)}, wantErr: "doesn't match the pinned fingerprint"},
+		{name: "mismatched fingerprint with the right ca", conf: config.TLS{Fingerprint: fmt.Sprintf("%x", otherSum), CA: ca}, wantErr: "doesn't match the pinned fingerprint"},
+		{name: "insecure", conf: config.TLS{Insecure: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := tlsGet(t, &test.conf, server.URL)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("request failed: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigClientCert(t *testing.T) {
+	certFile, keyFile, cert := writeClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	if err := tlsGet(t, &config.TLS{Insecure: true, ClientCert: certFile, ClientKey: keyFile}, server.URL); err != nil {
+		t.Errorf("request with a client certificate failed: %v", err)
+	}
+	if err := tlsGet(t, &config.TLS{Insecure: true}, server.URL); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+}
+
+func TestNewTLSConfigMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	tests := []struct {
+		minVersion string
+		want       uint16
+		wantErr    bool
+	}{
+		{minVersion: "", want: tls.VersionTLS12},
+		{minVersion: "1.0", want: tls.VersionTLS10},
+		{minVersion: "1.1", want: tls.VersionTLS11},
+		{minVersion: "1.2", want: tls.VersionTLS12},
+		{minVersion: "1.3", want: tls.VersionTLS13, wantErr: true},
+		{minVersion: "1.4", want: tls.VersionTLS12},
+	}
+	for _, test := range tests {
+		t.Run(test.minVersion, func(t *testing.T) {
+			conf := &config.TLS{MinVersion: test.minVersion, Insecure: true}
+			tlsConfig, err := newTLSConfig(conf)
+			if err != nil {
+				t.Fatalf("building tls config: %v", err)
+			}
+			if tlsConfig.MinVersion != test.want {
+				t.Errorf("min version = %x, want %x", tlsConfig.MinVersion, test.want)
+			}
+			if err = tlsGet(t, conf, server.URL); (err != nil) != test.wantErr {
+				t.Errorf("request to a TLS 1.2 server: error = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	certFile, keyFile, _ := writeClientCert(t)
+	tests := []struct {
+		name string
+		conf config.TLS
+	}{
+		{name: "missing ca", conf: config.TLS{CA: certFile + ".missing"}},
+		{name: "ca without certificates", conf: config.TLS{CA: keyFile}},
+		{name: "missing client key", conf: config.TLS{ClientCert: certFile, ClientKey: keyFile + ".missing"}},
+		{name: "mismatched client key", conf: config.TLS{ClientCert: keyFile, ClientKey: certFile}},
+		{name: "invalid fingerprint", conf: config.TLS{Fingerprint: "not hex"}},
+		{name: "short fingerprint", conf: config.TLS{Fingerprint: "abcdef"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newTLSConfig(&test.conf); err == nil {
+				t.Error("built a tls config")
+			}
+		})
+	}
+}
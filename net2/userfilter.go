@@ -0,0 +1,189 @@
+package net2
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSort   = errors.New("sort must be one of id, firstName, lastName, name, localID, expiry, lastSeen or location")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// sortTimeFormat is fixed width so formatted times sort in the same order as the times themselves.
+const sortTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var userSortKeys = map[string]func(user *User) string{
+	"id":        func(user *User) string { return "" },
+	"firstName": func(user *User) string { return strings.ToLower(user.FirstName) },
+	"lastName":  func(user *User) string { return strings.ToLower(user.Surname) },
+	"name":      func(user *User) string { return strings.ToLower(user.Surname + "\x00" + user.FirstName) },
+	"localID":   func(user *User) string { return user.LocalID },
+	"expiry":    func(user *User) string { return sortTime(user.Expiry) },
+	"lastSeen":  func(user *User) string { return sortTime(user.LastUpdated) },
+	"location":  func(user *User) string { return strings.ToLower(user.LastKnownLocation) },
+}
+
+// UserFilter selects, orders and pages a list of users.  Zero values don't filter.  Sort is one of the keys in
+// userSortKeys, prefixed with "-" for descending order, and ties are broken by user ID.  Either Offset or Cursor can
+// be used to page through the results.
+type UserFilter struct {
+	Name          string
+	LocalID       string
+	DepartmentID  int
+	AccessLevel   string
+	ExpiresBefore time.Time
+	ExpiresAfter  time.Time
+	SeenBefore    time.Time
+	SeenAfter     time.Time
+	Location      string
+	Sort          string
+	Offset        int
+	Limit         int
+	Cursor        string
+}
+
+// UserPage is one page of filtered users, with the total number that matched the filter.
+type UserPage struct {
+	Total      int     `json:"total"`
+	Offset     int     `json:"offset"`
+	Users      []*User `json:"users"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"i"`
+}
+
+// Matches reports whether a user passes the filter.  Users that never expire count as expiring after any time, and
+// users that have never been seen don't match either seen filter.
+func (f *UserFilter) Matches(user *User) bool {
+	if f.Name != "" {
+		name := strings.ToLower(user.FirstName + " " + user.Surname)
+		if !strings.Contains(name, strings.ToLower(f.Name)) {
+			return false
+		}
+	}
+	if f.LocalID != "" && user.LocalID != f.LocalID {
+		return false
+	}
+	if f.DepartmentID != 0 && !slices.ContainsFunc(user.Departments, func(department Department) bool {
+		return department.ID == f.DepartmentID
+	}) {
+		return false
+	}
+	if f.AccessLevel != "" && !slices.ContainsFunc(user.AccessLevels, func(level string) bool {
+		return strings.EqualFold(level, f.AccessLevel)
+	}) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && (user.Expiry.IsZero() || !user.Expiry.Before(f.ExpiresBefore)) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && !user.Expiry.IsZero() && !user.Expiry.After(f.ExpiresAfter) {
+		return false
+	}
+	if !f.SeenBefore.IsZero() && (user.LastUpdated.IsZero() || !user.LastUpdated.Before(f.SeenBefore)) {
+		return false
+	}
+	if !f.SeenAfter.IsZero() && !user.LastUpdated.After(f.SeenAfter) {
+		return false
+	}
+	if f.Location != "" && !strings.Contains(strings.ToLower(user.LastKnownLocation), strings.ToLower(f.Location)) {
+		return false
+	}
+	return true
+}
+
+// Apply filters and sorts users, and returns the requested page.
+func (f *UserFilter) Apply(users map[int]*User) (*UserPage, error) {
+	sortName := strings.TrimPrefix(f.Sort, "-")
+	if sortName == "" {
+		sortName = "id"
+	}
+	key, ok := userSortKeys[sortName]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+	descending := strings.HasPrefix(f.Sort, "-")
+	compare := func(value string, id int, user *User) int {
+		result := cmp.Or(strings.Compare(value, key(user)), cmp.Compare(id, user.ID))
+		if descending {
+			return -result
+		}
+		return result
+	}
+	matched := make([]*User, 0)
+	for _, user := range users {
+		if f.Matches(user) {
+			matched = append(matched, user)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *User) int {
+		return compare(key(a), a.ID, b)
+	})
+	start := max(f.Offset, 0)
+	if f.Cursor != "" {
+		cursor, err := decodeCursor(f.Cursor)
+		if err != nil || cursor.Sort != f.sortOrDefault() {
+			return nil, ErrInvalidCursor
+		}
+		start, _ = slices.BinarySearchFunc(matched, cursor, func(user *User, target userCursor) int {
+			if compare(target.Value, target.ID, user) >= 0 {
+				return -1
+			}
+			return 1
+		})
+	}
+	start = min(start, len(matched))
+	end := len(matched)
+	if f.Limit > 0 {
+		end = min(start+f.Limit, len(matched))
+	}
+	page := &UserPage{
+		Total:  len(matched),
+		Offset: start,
+		Users:  matched[start:end],
+	}
+	if end < len(matched) && end > 0 {
+		last := matched[end-1]
+		page.NextCursor = encodeCursor(userCursor{Sort: f.sortOrDefault(), Value: key(last), ID: last.ID})
+	}
+	return page, nil
+}
+
+func (f *UserFilter) sortOrDefault() string {
+	if f.Sort == "" {
+		return "id"
+	}
+	return f.Sort
+}
+
+func sortTime(value time.Time) string {
+	if value.IsZero() {
+		return ""
+	}
+	return value.UTC().Format(sortTimeFormat)
+}
+
+func encodeCursor(cursor userCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (userCursor, error) {
+	cursor := userCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
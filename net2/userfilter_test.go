@@ -0,0 +1,83 @@
+package net2
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUserFilterApply(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   []int
+		total  int
+	}{
+		{name: "everyone", filter: UserFilter{}, want: []int{1, 2, 3}, total: 3},
+		{name: "name", filter: UserFilter{Name: "bab"}, want: []int{2}, total: 1},
+		{name: "local ID", filter: UserFilter{LocalID: "1003"}, want: []int{3}, total: 1},
+		{name: "department", filter: UserFilter{DepartmentID: 1}, want: []int{1, 3}, total: 2},
+		{
+			name:   "expires before excludes users who never expire",
+			filter: UserFilter{ExpiresBefore: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)},
+			want:   []int{1, 2},
+			total:  2,
+		},
+		{
+			name:   "expires after includes users who never expire",
+			filter: UserFilter{ExpiresAfter: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+			want:   []int{1, 3},
+			total:  2,
+		},
+		{name: "sorted by first name", filter: UserFilter{Sort: "firstName"}, want: []int{1, 2, 3}, total: 3},
+		{name: "sorted by last name descending", filter: UserFilter{Sort: "-lastName"}, want: []int{1, 3, 2}, total: 3},
+		{name: "limit", filter: UserFilter{Limit: 2}, want: []int{1, 2}, total: 3},
+		{name: "offset", filter: UserFilter{Offset: 2}, want: []int{3}, total: 3},
+		{name: "offset past the end", filter: UserFilter{Offset: 5}, want: []int{}, total: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page, err := test.filter.Apply(site.GetUsers())
+			if err != nil {
+				t.Fatalf("applying filter: %v", err)
+			}
+			got := make([]int, 0, len(page.Users))
+			for _, user := range page.Users {
+				got = append(got, user.ID)
+			}
+			if !slices.Equal(got, test.want) || page.Total != test.total {
+				t.Errorf("users = %v of %d, want %v of %d", got, page.Total, test.want, test.total)
+			}
+		})
+	}
+}
+
+func TestUserFilterCursor(t *testing.T) {
+	site := newTestSite(t, newTestBackend())
+	filter := UserFilter{Sort: "-firstName", Limit: 2}
+	seen := make([]int, 0)
+	for range 3 {
+		page, err := filter.Apply(site.GetUsers())
+		if err != nil {
+			t.Fatalf("applying filter: %v", err)
+		}
+		for _, user := range page.Users {
+			seen = append(seen, user.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if want := []int{3, 2, 1}; !slices.Equal(seen, want) {
+		t.Errorf("users = %v, want %v", seen, want)
+	}
+	if _, err := (&UserFilter{Sort: "id", Cursor: filter.Cursor}).Apply(site.GetUsers()); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor from another sort = %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, err := (&UserFilter{Sort: "height"}).Apply(site.GetUsers()); !errors.Is(err, ErrInvalidSort) {
+		t.Errorf("unknown sort = %v, want %v", err, ErrInvalidSort)
+	}
+}
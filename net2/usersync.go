@@ -0,0 +1,113 @@
+package net2
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// maxMissingUsers is the most active users that can be missing from the cache, without having been returned as
+// changed, before a delta sync gives up and runs a full sync instead.
+const maxMissingUsers = 50
+
+func (s *Site) userQuery(since string) UserQuery {
+	return UserQuery{
+		LocalIDColumn: s.LocalIDField,
+		ChangedColumn: s.getConfig().Polling.UsersChangedColumn,
+		ChangedSince:  since,
+	}
+}
+
+func (s *Site) fullUserSyncDue() bool {
+	polling := s.getConfig().Polling
+	return polling.UsersChangedColumn == "" ||
+		s.userWatermark == "" ||
+		!s.snapshot().usersLoaded ||
+		s.clock().Sub(s.lastFullUserSync) >= time.Duration(polling.UsersFullSync)
+}
+
+func (s *Site) syncAllUsers(ctx context.Context) error {
+	users, watermark, err := s.fetchUsers(ctx, s.userQuery(""), s.snapshot().accessLevels)
+	if err != nil {
+		return err
+	}
+	s.userWatermark = watermark
+	s.lastFullUserSync = s.clock()
+	s.replaceUsers(users)
+	return nil
+}
+
+// syncChangedUsers fetches the users changed since the last sync, and the IDs of every active user so users that
+// have been deleted or deactivated are dropped.  Active users that aren't cached and weren't returned as changed are
+// fetched individually.
+func (s *Site) syncChangedUsers(ctx context.Context) error {
+	accessLevels := s.snapshot().accessLevels
+	activeIDs, err := s.backend.ActiveUserIDs(ctx)
+	if err != nil {
+		return err
+	}
+	changed, watermark, err := s.fetchUsers(ctx, s.userQuery(s.userWatermark), accessLevels)
+	if err != nil {
+		return err
+	}
+	current := s.snapshot().users
+	users := make(map[int]*User, len(activeIDs))
+	var missing []int
+	for _, id := range activeIDs {
+		if user, ok := current[id]; ok {
+			users[id] = user
+		} else if _, ok = changed[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > maxMissingUsers {
+		log.Debug().Str("Site", s.Name).Int("Missing", len(missing)).Msg("Too many uncached users, running a full sync")
+		return s.syncAllUsers(ctx)
+	}
+	for _, id := range missing {
+		fetched, _, err := s.fetchUsers(ctx, UserQuery{LocalIDColumn: s.LocalIDField, UserID: id}, accessLevels)
+		if err != nil {
+			return err
+		}
+		if user, ok := fetched[id]; ok {
+			users[id] = user
+		}
+	}
+	for id, user := range changed {
+		users[id] = user
+	}
+	removed := 0
+	for id := range current {
+		if _, ok := users[id]; !ok {
+			removed++
+		}
+	}
+	s.userWatermark = watermark
+	s.replaceUsers(users)
+	log.Debug().Str("Site", s.Name).Int("Changed", len(changed)).Int("Fetched", len(missing)).Int("Removed", removed).
+		Msg("Updated changed users")
+	return nil
+}
+
+func (s *Site) replaceUsers(users map[int]*User) {
+	previous, next := s.commit(func(next *siteState) {
+		next.users = users
+		next.usersLoaded = true
+	})
+	if previous.usersLoaded {
+		s.publishAllUserChanges(previous.users, next.users)
+	}
+}
+
+// normaliseChangedAt trims a changed time returned by Net2 to whole seconds, so watermarks can be compared as
+// strings.  Values that aren't times are ignored.
+func normaliseChangedAt(value string) string {
+	if len(value) < len(changedAtFormat) {
+		return ""
+	}
+	value = value[:len(changedAtFormat)]
+	if _, err := time.Parse(changedAtFormat, value); err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,256 @@
+package net2
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+)
+
+var syncStart = time.Date(2025, time.January, 6, 12, 0, 0, 0, time.Local)
+
+// queryRecorder records the user queries made to a fake backend.
+type queryRecorder struct {
+	*FakeBackend
+	lock    sync.Mutex
+	queries []UserQuery
+}
+
+func (q *queryRecorder) QueryUsers(ctx context.Context, query UserQuery) ([]*UserRecord, error) {
+	q.lock.Lock()
+	q.queries = append(q.queries, query)
+	q.lock.Unlock()
+	return q.FakeBackend.QueryUsers(ctx, query)
+}
+
+// take returns the kinds of query made since it was last called: "full", "delta" or the ID of a single user.
+func (q *queryRecorder) take() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	kinds := make([]string, 0, len(q.queries))
+	for _, query := range q.queries {
+		switch {
+		case query.UserID != 0:
+			kinds = append(kinds, fmt.Sprintf("user %d", query.UserID))
+		case query.ChangedSince != "":
+			kinds = append(kinds, "delta")
+		default:
+			kinds = append(kinds, "full")
+		}
+	}
+	q.queries = nil
+	return kinds
+}
+
+// newSyncSite returns a site that syncs changed users, with a clock that reads now, whose users were all last changed
+// an hour before the sync starts.  The users are synced once, and the returned channel receives the changes published
+// after that.
+func newSyncSite(t *testing.T, now *time.Time) (*Site, *queryRecorder, chan Change) {
+	t.Helper()
+	backend := &queryRecorder{FakeBackend: newTestBackend()}
+	for _, id := range []int{1, 2, 3} {
+		backend.SetUserChanged(id, syncStart.Add(-time.Hour))
+	}
+	site := newIdleSite(t, backend, func(polling *config.Polling) {
+		polling.UsersChangedColumn = "LastUpdated"
+	}, now)
+	site.changes = NewChangeBus(100)
+	changes, _ := site.changes.Subscribe(0)
+	t.Cleanup(func() {
+		site.changes.Unsubscribe(changes)
+	})
+	if err := site.UpdateUsers(context.Background()); err != nil {
+		t.Fatalf("initial sync failed: %v", err)
+	}
+	if kinds := backend.take(); !slices.Equal(kinds, []string{"full"}) {
+		t.Fatalf("initial queries = %v, want a full sync", kinds)
+	}
+	return site, backend, changes
+}
+
+// publishedUsers returns the IDs of the users that changes have been published for, in the order they were published.
+func publishedUsers(changes chan Change) []int {
+	ids := make([]int, 0)
+	for {
+		select {
+		case change := <-changes:
+			ids = append(ids, change.Data.(UserChange).User.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestUpdateUsersDeltaBoundary(t *testing.T) {
+	now := syncStart
+	site, backend, changes := newSyncSite(t, &now)
+	watermark := syncStart.Add(-time.Hour).Format(changedAtFormat)
+	if site.userWatermark != watermark {
+		t.Fatalf("watermark = %s, want %s", site.userWatermark, watermark)
+	}
+	// User 3 moves department later in the same second as the watermark, so only a query that includes the boundary
+	// finds it, and users 1 and 2 are returned again without having changed.
+	backend.AddUser(testUser(3, "Grace", "Hopper", "1003", 2, ""))
+	backend.SetUserChanged(3, syncStart.Add(-time.Hour+500*time.Millisecond))
+	now = now.Add(time.Minute)
+	if err := site.UpdateUsers(context.Background()); err != nil {
+		t.Fatalf("delta sync failed: %v", err)
+	}
+	if kinds := backend.take(); !slices.Equal(kinds, []string{"delta"}) {
+		t.Errorf("queries = %v, want a delta", kinds)
+	}
+	if got := len(site.GetUsers()); got != 3 {
+		t.Errorf("users = %d, want 3", got)
+	}
+	if got := site.GetUser(3).Departments[0].ID; got != 2 {
+		t.Errorf("user 3 department = %d, want 2", got)
+	}
+	if ids := publishedUsers(changes); !slices.Equal(ids, []int{3}) {
+		t.Errorf("changes published for users %v, want only user 3", ids)
+	}
+	if site.userWatermark != watermark {
+		t.Errorf("watermark = %s, want it unchanged at %s", site.userWatermark, watermark)
+	}
+	now = now.Add(time.Minute)
+	if err := site.UpdateUsers(context.Background()); err != nil {
+		t.Fatalf("second delta sync failed: %v", err)
+	}
+	if ids := publishedUsers(changes); len(ids) != 0 {
+		t.Errorf("changes published for users %v when nothing changed", ids)
+	}
+	backend.SetUserChanged(2, syncStart)
+	now = now.Add(time.Minute)
+	if err := site.UpdateUsers(context.Background()); err != nil {
+		t.Fatalf("third delta sync failed: %v", err)
+	}
+	if want := syncStart.Format(changedAtFormat); site.userWatermark != want {
+		t.Errorf("watermark = %s, want it moved on to %s", site.userWatermark, want)
+	}
+}
+
+func TestUpdateUsersFullResync(t *testing.T) {
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  string
+	}{
+		{name: "before the full sync is due", after: 59 * time.Minute, want: "delta"},
+		{name: "full sync due", after: time.Hour, want: "full"},
+		{name: "full sync overdue", after: 3 * time.Hour, want: "full"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := syncStart
+			site, backend, _ := newSyncSite(t, &now)
+			now = now.Add(test.after)
+			if err := site.UpdateUsers(context.Background()); err != nil {
+				t.Fatalf("sync failed: %v", err)
+			}
+			if kinds := backend.take(); !slices.Equal(kinds, []string{test.want}) {
+				t.Errorf("queries = %v, want %s", kinds, test.want)
+			}
+			if test.want == "full" && !site.lastFullUserSync.Equal(now) {
+				t.Errorf("last full sync = %s, want %s", site.lastFullUserSync, now)
+			}
+		})
+	}
+}
+
+func TestUpdateUsersMissingUsers(t *testing.T) {
+	tests := []struct {
+		name        string
+		deactivated []int
+		uncached    int
+		queries     []string
+		users       int
+	}{
+		{name: "deactivated users are dropped", deactivated: []int{2}, queries: []string{"delta"}, users: 2},
+		{name: "uncached users are fetched", uncached: 2, queries: []string{"delta", "user 100", "user 101"}, users: 5},
+		{name: "at the limit", uncached: maxMissingUsers, users: 3 + maxMissingUsers},
+		{name: "deleting and restoring users runs a full sync", deactivated: []int{1}, uncached: maxMissingUsers + 1, queries: []string{"delta", "full"}, users: 2 + maxMissingUsers + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := syncStart
+			site, backend, _ := newSyncSite(t, &now)
+			for _, id := range test.deactivated {
+				backend.SetUserActive(id, false)
+			}
+			// Users restored from a backup keep their changed times, so they are active but never seen by a delta.
+			for id := 100; id < 100+test.uncached; id++ {
+				backend.AddUser(testUser(id, "Restored", strconv.Itoa(id), strconv.Itoa(id), 1, ""))
+				backend.SetUserChanged(id, syncStart.Add(-2*time.Hour))
+			}
+			now = now.Add(time.Minute)
+			if err := site.UpdateUsers(context.Background()); err != nil {
+				t.Fatalf("sync failed: %v", err)
+			}
+			kinds := backend.take()
+			if test.queries != nil && !slices.Equal(kinds, test.queries) {
+				t.Errorf("queries = %v, want %v", kinds, test.queries)
+			}
+			if slices.Contains(kinds, "full") != slices.Contains(test.queries, "full") {
+				t.Errorf("queries = %v, want a full sync %t", kinds, slices.Contains(test.queries, "full"))
+			}
+			if got := len(site.GetUsers()); got != test.users {
+				t.Errorf("users = %d, want %d", got, test.users)
+			}
+			for _, id := range test.deactivated {
+				if site.GetUser(id) != nil {
+					t.Errorf("deactivated user %d is still cached", id)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUsersPublishesRemovedUsers(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(site *Site, backend *queryRecorder) error
+	}{
+		{name: "made inactive", remove: func(site *Site, backend *queryRecorder) error {
+			backend.SetUserActive(2, false)
+			return site.UpdateUsers(context.Background())
+		}},
+		{name: "deleted in Net2", remove: func(site *Site, backend *queryRecorder) error {
+			if err := backend.DeleteUser(context.Background(), 2); err != nil {
+				return err
+			}
+			return site.UpdateUsers(context.Background())
+		}},
+		{name: "deleted through the site", remove: func(site *Site, _ *queryRecorder) error {
+			_, err := site.DeleteUser(context.Background(), 2)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := syncStart
+			site, backend, changes := newSyncSite(t, &now)
+			now = now.Add(time.Minute)
+			if err := test.remove(site, backend); err != nil {
+				t.Fatalf("removing user: %v", err)
+			}
+			if site.GetUser(2) != nil {
+				t.Fatal("removed user is still cached")
+			}
+			select {
+			case change := <-changes:
+				if change.Type != ChangeUserDeactivated || change.Data.(UserChange).User.ID != 2 {
+					t.Errorf("published %s for user %d, want %s for user 2", change.Type, change.Data.(UserChange).User.ID, ChangeUserDeactivated)
+				}
+			default:
+				t.Fatal("nothing published for the removed user")
+			}
+			if ids := publishedUsers(changes); len(ids) != 0 {
+				t.Errorf("changes also published for users %v", ids)
+			}
+		})
+	}
+}
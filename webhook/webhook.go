@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/net2"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxAttemptHistory = 1000
+	initialBackoff    = time.Second
+	// queueSize is how many changes can wait for each webhook before new ones are dead lettered.
+	queueSize = 1000
+)
+
+var errQueueFull = errors.New("webhook queue full")
+
+type Attempt struct {
+	Webhook    string    `json:"webhook"`
+	ChangeID   uint64    `json:"changeID"`
+	ChangeType string    `json:"changeType"`
+	SiteID     int       `json:"siteID"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+}
+
+type DeadLetter struct {
+	Webhook  string      `json:"webhook"`
+	Time     time.Time   `json:"time"`
+	Attempts int         `json:"attempts"`
+	Error    string      `json:"error"`
+	Change   net2.Change `json:"change"`
+}
+
+// Dispatcher delivers changes to webhooks.  Each webhook has its own queue and worker, so its deliveries are made in
+// order, one at a time, and a slow receiver doesn't hold up the others.
+type Dispatcher struct {
+	lock           sync.Mutex
+	webhooks       []config.Webhook
+	queues         []chan net2.Change
+	client         *http.Client
+	attempts       []Attempt
+	deadLetterPath string
+	deadLetters    []DeadLetter
+	backoff        time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+}
+
+func NewDispatcher(webhooks []config.Webhook, deadLetterPath string) (*Dispatcher, error) {
+	for index := range webhooks {
+		for _, event := range webhooks[index].Events {
+			if !lo.Contains(net2.ChangeTypes, event) {
+				return nil, fmt.Errorf("invalid event %s for webhook: %s", event, webhooks[index].Name)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		webhooks: webhooks,
+		queues: lo.Times(len(webhooks), func(int) chan net2.Change {
+			return make(chan net2.Change, queueSize)
+		}),
+		client:         &http.Client{},
+		attempts:       make([]Attempt, 0),
+		deadLetterPath: deadLetterPath,
+		deadLetters:    make([]DeadLetter, 0),
+		backoff:        initialBackoff,
+		ctx:            ctx,
+		cancel:         cancel,
+	}, nil
+}
+
+func (d *Dispatcher) Start(bus *net2.ChangeBus) {
+	for index := range d.webhooks {
+		d.wg.Go(func() {
+			d.work(d.webhooks[index], d.queues[index])
+		})
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		var lastID uint64
+		for {
+			changes, backlog := bus.Subscribe(lastID)
+			for index := range backlog {
+				d.dispatch(backlog[index])
+				lastID = backlog[index].ID
+			}
+			if !d.consume(changes, &lastID) {
+				bus.Unsubscribe(changes)
+				return
+			}
+			log.Warn().Msg("Webhook dispatcher fell behind, resubscribing")
+		}
+	}()
+}
+
+func (d *Dispatcher) consume(changes chan net2.Change, lastID *uint64) bool {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return false
+		case change, ok := <-changes:
+			if !ok {
+				return true
+			}
+			d.dispatch(change)
+			*lastID = change.ID
+		}
+	}
+}
+
+// Stop cancels any deliveries in flight and waits for the workers to finish.  Queued changes aren't delivered.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) dispatch(change net2.Change) {
+	for index := range d.webhooks {
+		webhook := d.webhooks[index]
+		if len(webhook.Events) > 0 && !lo.Contains(webhook.Events, change.Type) {
+			continue
+		}
+		if len(webhook.Sites) > 0 && !lo.Contains(webhook.Sites, change.SiteID) {
+			continue
+		}
+		select {
+		case d.queues[index] <- change:
+		default:
+			d.deadLetter(DeadLetter{
+				Webhook: webhook.Name,
+				Time:    time.Now(),
+				Error:   errQueueFull.Error(),
+				Change:  change,
+			})
+		}
+	}
+}
+
+func (d *Dispatcher) work(webhook config.Webhook, queue chan net2.Change) {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case change := <-queue:
+			d.deliver(webhook, change)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(webhook config.Webhook, change net2.Change) {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.Error().Err(err).Str("Webhook", webhook.Name).Msg("Unable to marshal webhook payload")
+		return
+	}
+	backoff := d.backoff
+	for attempt := 1; attempt <= webhook.MaxAttempts; attempt++ {
+		statusCode, err := d.send(webhook, change, payload)
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.recordAttempt(Attempt{
+			Webhook:    webhook.Name,
+			ChangeID:   change.ID,
+			ChangeType: change.Type,
+			SiteID:     change.SiteID,
+			Attempt:    attempt,
+			Time:       time.Now(),
+			StatusCode: statusCode,
+			Error:      errorString(err),
+			Success:    err == nil,
+		})
+		if err == nil {
+			return
+		}
+		log.Debug().Err(err).Str("Webhook", webhook.Name).Int("Attempt", attempt).Msg("Webhook delivery failed")
+		if attempt == webhook.MaxAttempts {
+			d.deadLetter(DeadLetter{
+				Webhook:  webhook.Name,
+				Time:     time.Now(),
+				Attempts: attempt,
+				Error:    err.Error(),
+				Change:   change,
+			})
+			return
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) send(webhook config.Webhook, change net2.Change, payload []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", net2.JsonContentType)
+	req.Header.Set("X-Net2-Event", change.Type)
+	req.Header.Set("X-Net2-Delivery", strconv.FormatUint(change.ID, 10))
+	req.Header.Set("X-Net2-Timestamp", timestamp)
+	req.Header.Set("X-Net2-Signature", "sha256="+Sign(webhook.Secret.Value(), timestamp, payload))
+	client := *d.client
+	client.Timeout = time.Duration(webhook.Timeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) recordAttempt(attempt Attempt) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.attempts) == maxAttemptHistory {
+		d.attempts = append(d.attempts[:0], d.attempts[1:]...)
+	}
+	d.attempts = append(d.attempts, attempt)
+}
+
+func (d *Dispatcher) deadLetter(letter DeadLetter) {
+	log.Error().Str("Webhook", letter.Webhook).Uint64("Change", letter.Change.ID).Msg("Webhook delivery failed, dead lettering")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.deadLetterPath == "" {
+		if len(d.deadLetters) == maxAttemptHistory {
+			d.deadLetters = append(d.deadLetters[:0], d.deadLetters[1:]...)
+		}
+		d.deadLetters = append(d.deadLetters, letter)
+		return
+	}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal dead letter")
+		return
+	}
+	file, err := os.OpenFile(d.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to open dead letter log")
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		log.Error().Err(err).Msg("Unable to write dead letter")
+	}
+}
+
+func (d *Dispatcher) Attempts(webhook string) []Attempt {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return lo.Filter(d.attempts, func(item Attempt, _ int) bool {
+		return webhook == "" || item.Webhook == webhook
+	})
+}
+
+func (d *Dispatcher) DeadLetters(webhook string) ([]DeadLetter, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	letters := d.deadLetters
+	if d.deadLetterPath != "" {
+		var err error
+		letters, err = readDeadLetters(d.deadLetterPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lo.Filter(letters, func(item DeadLetter, _ int) bool {
+		return webhook == "" || item.Webhook == webhook
+	}), nil
+}
+
+func readDeadLetters(path string) ([]DeadLetter, error) {
+	letters := make([]DeadLetter, 0)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return letters, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		letter := DeadLetter{}
+		if err = json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greboid/net2/config"
+	"github.com/greboid/net2/internal/testutil"
+	"github.com/greboid/net2/net2"
+	"gopkg.in/yaml.v3"
+)
+
+type received struct {
+	event     string
+	delivery  string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+// newReceiver records every request and answers with the next status from statuses, repeating the last one.
+func newReceiver(t *testing.T, statuses ...int) (*httptest.Server, func() []received) {
+	t.Helper()
+	lock := sync.Mutex{}
+	requests := make([]received, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		status := statuses[min(len(requests), len(statuses)-1)]
+		requests = append(requests, received{
+			event:     r.Header.Get("X-Net2-Event"),
+			delivery:  r.Header.Get("X-Net2-Delivery"),
+			timestamp: r.Header.Get("X-Net2-Timestamp"),
+			signature: r.Header.Get("X-Net2-Signature"),
+			body:      body,
+		})
+		lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []received {
+		lock.Lock()
+		defer lock.Unlock()
+		return slices.Clone(requests)
+	}
+}
+
+func newWebhook(t *testing.T, url string, maxAttempts int) config.Webhook {
+	t.Helper()
+	webhook := config.Webhook{}
+	if err := yaml.Unmarshal([]byte("name: hook\nurl: "+url+"\nsecret: topsecret\n"), &webhook); err != nil {
+		t.Fatalf("parsing webhook: %v", err)
+	}
+	webhook.MaxAttempts = maxAttempts
+	webhook.Timeout = config.Duration(time.Second)
+	return webhook
+}
+
+func newTestDispatcher(t *testing.T, webhook config.Webhook, deadLetterPath string) *Dispatcher {
+	t.Helper()
+	dispatcher, err := NewDispatcher([]config.Webhook{webhook}, deadLetterPath)
+	if err != nil {
+		t.Fatalf("creating dispatcher: %v", err)
+	}
+	dispatcher.backoff = time.Millisecond
+	dispatcher.Start(net2.NewChangeBus(10))
+	t.Cleanup(dispatcher.Stop)
+	return dispatcher
+}
+
+func TestDeliverySignature(t *testing.T) {
+	receiver, requests := newReceiver(t, http.StatusOK)
+	dispatcher := newTestDispatcher(t, newWebhook(t, receiver.URL, 1), "")
+	dispatcher.dispatch(net2.Change{ID: 7, Type: net2.ChangeDoorAlarm, SiteID: 1})
+	testutil.WaitFor(t, func() bool {
+		return len(dispatcher.Attempts("hook")) == 1
+	})
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("requests = %d, want 1", len(got))
+	}
+	if got[0].event != net2.ChangeDoorAlarm || got[0].delivery != "7" {
+		t.Errorf("event = %s, delivery = %s", got[0].event, got[0].delivery)
+	}
+	if want := "sha256=" + Sign("topsecret", got[0].timestamp, got[0].body); got[0].signature != want {
+		t.Errorf("signature = %s, want %s", got[0].signature, want)
+	}
+	if got[0].signature == "sha256="+Sign("wrong", got[0].timestamp, got[0].body) {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	receiver, requests := newReceiver(t, http.StatusOK)
+	dispatcher := newTestDispatcher(t, newWebhook(t, receiver.URL, 1), "")
+	for id := uint64(1); id <= 20; id++ {
+		dispatcher.dispatch(net2.Change{ID: id, Type: net2.ChangeUserUpdated, SiteID: 1})
+	}
+	testutil.WaitFor(t, func() bool {
+		return len(requests()) == 20
+	})
+	for index, request := range requests() {
+		if request.delivery != strconv.Itoa(index+1) {
+			t.Fatalf("delivery %d = %s, want in order", index, request.delivery)
+		}
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		attempts    int
+		deadLetter  bool
+	}{
+		{name: "first attempt", statuses: []int{http.StatusOK}, maxAttempts: 3, attempts: 1},
+		{name: "after failures", statuses: []int{http.StatusBadGateway, http.StatusInternalServerError, http.StatusOK}, maxAttempts: 3, attempts: 3},
+		{name: "exhausted", statuses: []int{http.StatusInternalServerError}, maxAttempts: 3, attempts: 3, deadLetter: true},
+		{name: "client error", statuses: []int{http.StatusBadRequest}, maxAttempts: 2, attempts: 2, deadLetter: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver, requests := newReceiver(t, test.statuses...)
+			deadLetterPath := filepath.Join(t.TempDir(), "deadletters.log")
+			dispatcher := newTestDispatcher(t, newWebhook(t, receiver.URL, test.maxAttempts), deadLetterPath)
+			change := net2.Change{ID: 3, Type: net2.ChangeUserAdded, SiteID: 2, Data: map[string]int{"user": 4}}
+			dispatcher.dispatch(change)
+			testutil.WaitFor(t, func() bool {
+				if len(dispatcher.Attempts("")) != test.attempts {
+					return false
+				}
+				letters, _ := dispatcher.DeadLetters("")
+				return !test.deadLetter || len(letters) == 1
+			})
+			if len(requests()) != test.attempts {
+				t.Errorf("requests = %d, want %d", len(requests()), test.attempts)
+			}
+			for index, attempt := range dispatcher.Attempts("") {
+				if attempt.Attempt != index+1 || attempt.ChangeID != change.ID || attempt.SiteID != change.SiteID {
+					t.Errorf("attempt %d = %+v", index, attempt)
+				}
+			}
+			letters, err := dispatcher.DeadLetters("hook")
+			if err != nil {
+				t.Fatalf("reading dead letters: %v", err)
+			}
+			if !test.deadLetter {
+				if len(letters) != 0 {
+					t.Errorf("dead letters = %+v, want none", letters)
+				}
+				return
+			}
+			if len(letters) != 1 {
+				t.Fatalf("dead letters = %+v, want one", letters)
+			}
+			letter := letters[0]
+			if letter.Webhook != "hook" || letter.Attempts != test.maxAttempts || letter.Error == "" {
+				t.Errorf("dead letter = %+v", letter)
+			}
+			if letter.Change.ID != change.ID || letter.Change.Type != change.Type || letter.Change.SiteID != change.SiteID {
+				t.Errorf("dead letter change = %+v, want %+v", letter.Change, change)
+			}
+			if data, ok := letter.Change.Data.(map[string]interface{}); !ok || data["user"] != float64(4) {
+				t.Errorf("dead letter data = %#v", letter.Change.Data)
+			}
+		})
+	}
+}
+
+func TestDispatchFilters(t *testing.T) {
+	receiver, requests := newReceiver(t, http.StatusOK)
+	webhook := newWebhook(t, receiver.URL, 1)
+	webhook.Sites = []int{2}
+	webhook.Events = []string{net2.ChangeDoorAlarm}
+	dispatcher := newTestDispatcher(t, webhook, "")
+	dispatcher.dispatch(net2.Change{ID: 1, Type: net2.ChangeDoorAlarm, SiteID: 1})
+	dispatcher.dispatch(net2.Change{ID: 2, Type: net2.ChangeDoorStatus, SiteID: 2})
+	dispatcher.dispatch(net2.Change{ID: 3, Type: net2.ChangeDoorAlarm, SiteID: 2})
+	testutil.WaitFor(t, func() bool {
+		return len(dispatcher.Attempts("")) == 1
+	})
+	if got := requests(); len(got) != 1 || got[0].delivery != "3" {
+		t.Errorf("requests = %+v, want only delivery 3", got)
+	}
+}